@@ -6,8 +6,10 @@ import (
 	"crypto/cipher"
 	"crypto/sha256"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/ntons/log-go"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -18,14 +20,107 @@ type App struct {
 	Key uint32 `bson:"key"`
 	// 应用签名密钥，授权访问
 	Secret string `bson:"secret,omitempty"`
+	// 允许的登录态签名算法，为空时允许所有算法
+	SignatureAlgorithms []string `bson:"signature_algorithms,omitempty"`
+	// Ed25519公钥(base64)，用于验证登录服务器签发的登录态
+	SignPublicKey string `bson:"sign_public_key,omitempty"`
 	// 应用指纹，特异化应用数据，增加安全性
 	Fingerprint string `bson:"fingerprint,omitempty"`
 	// 允许的服务
 	Permissions []*Permission `bson:"permissions,omitempty"`
+	// 应用自定义的范围处罚，覆盖全局配置中的同名范围
+	SanctionScopes map[string][]*Permission `bson:"sanction_scopes,omitempty"`
+	// 第三方OIDC登录
+	OidcProviders []*OidcProvider `bson:"oidc_providers,omitempty"`
+	// 建立索引的元数据键，只有这些键可以用于查询
+	IndexedMetadataKeys []string `bson:"indexed_metadata_keys,omitempty"`
+	// 角色名在区服内唯一，否则在应用内唯一
+	RoleNamePerZone bool `bson:"role_name_per_zone,omitempty"`
+	// 会话有效期策略，为空时使用默认值
+	SessPolicy *SessPolicy `bson:"sess_policy,omitempty"`
+	// 允许设置的会话属性键
+	SessAttrKeys []string `bson:"sess_attr_keys,omitempty"`
+	// 发行商，相同发行商的应用共享玩家身份，为空时不共享
+	Publisher string `bson:"publisher,omitempty"`
+	// 参与发行商身份关联的账号ID前缀，如"email:"
+	PublisherAcctIdPrefixes []string `bson:"publisher_acct_id_prefixes,omitempty"`
+	// 维护窗口，为空时不维护
+	Maintenance *Maintenance `bson:"maintenance,omitempty"`
+	// 各平台的客户端版本要求
+	ClientVersionRules []*ClientVersionRule `bson:"client_version_rules,omitempty"`
+	// 设备策略，为空时只记录不限制
+	DevicePolicy *DevicePolicy `bson:"device_policy,omitempty"`
+	// 按地区限制登录，为空时不限制
+	RegionPolicy *RegionPolicy `bson:"region_policy,omitempty"`
+	// 生命周期钩子
+	Hooks []*Hook `bson:"hooks,omitempty"`
 	// AES密钥，由Fingerprint生成
 	block cipher.Block
 }
 
+// OIDC身份提供方
+type OidcProvider struct {
+	// 提供方名字，登录时指定
+	Name string `bson:"name"`
+	// id_token的iss
+	Issuer string `bson:"issuer"`
+	// 允许的aud，即在提供方注册的客户端ID
+	Audiences []string `bson:"audiences"`
+	// 公钥集合的地址
+	JwksUrl string `bson:"jwks_url,omitempty"`
+	// 内联的公钥集合(JSON)，优先于JwksUrl
+	Jwks string `bson:"jwks,omitempty"`
+	// 账号ID前缀，为空时使用提供方名字
+	AcctIdPrefix string `bson:"acct_id_prefix,omitempty"`
+}
+
+func (x *App) FindOidcProvider(name string) *OidcProvider {
+	for _, p := range x.OidcProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// 客户端版本要求
+type ClientVersionRule struct {
+	// 平台，与登录请求中的设备系统比较，忽略大小写，为空时匹配所有平台
+	Platform string `bson:"platform,omitempty"`
+	// 最低版本，低于时拒绝登录
+	MinVersion string `bson:"min_version,omitempty"`
+	// 推荐版本，低于时允许登录但提示升级
+	RecommendedVersion string `bson:"recommended_version,omitempty"`
+	// 下载地址
+	DownloadUrl string `bson:"download_url,omitempty"`
+	// 展示给玩家的升级提示
+	Message string `bson:"message,omitempty"`
+}
+
+// 平台的版本要求，没有专门的规则时使用通用规则
+func (x *App) FindClientVersionRule(platform string) *ClientVersionRule {
+	var r *ClientVersionRule
+	for _, rule := range x.ClientVersionRules {
+		if rule.Platform == "" {
+			if r == nil {
+				r = rule
+			}
+		} else if strings.EqualFold(rule.Platform, platform) {
+			return rule
+		}
+	}
+	return r
+}
+
+func (x *App) IsSessAttrAllowed(key string) bool {
+	for _, k := range x.SessAttrKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (x *App) parse() (err error) {
 	// check permission expression
 	for _, p := range x.Permissions {
@@ -33,6 +128,26 @@ func (x *App) parse() (err error) {
 			return
 		}
 	}
+	for _, ps := range x.SanctionScopes {
+		for _, p := range ps {
+			if err = p.parse(); err != nil {
+				return
+			}
+		}
+	}
+	for _, h := range x.Hooks {
+		if err = h.parse(); err != nil {
+			return
+		}
+	}
+	if x.Maintenance != nil {
+		if err = x.Maintenance.parse(); err != nil {
+			return
+		}
+	}
+	if err = x.checkSessPolicy(); err != nil {
+		return
+	}
 	// hash fingerprint to 32 bytes byte array, NewCipher must success
 	hash := sha256.Sum256([]byte(x.Fingerprint))
 	x.block, _ = aes.NewCipher(hash[:])
@@ -51,6 +166,38 @@ func (x *App) IsPermitted(path string) bool {
 	}
 	return false
 }
+func (x *App) IsSignatureAlgorithmAllowed(alg string) bool {
+	if len(x.SignatureAlgorithms) == 0 {
+		return true
+	}
+	for _, a := range x.SignatureAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// 处罚范围是否已配置
+func (x *App) HasSanctionScope(scope string) bool {
+	if _, ok := x.SanctionScopes[scope]; ok {
+		return true
+	}
+	_, ok := cfg.SanctionScopes[scope]
+	return ok
+}
+func (x *App) isSanctioned(scope, path string) bool {
+	ps, ok := x.SanctionScopes[scope]
+	if !ok {
+		ps = cfg.SanctionScopes[scope]
+	}
+	for _, p := range ps {
+		if p.isPermitted(path) {
+			return true
+		}
+	}
+	return false
+}
 
 // App collection with index
 type xAppIndex struct {
@@ -110,3 +257,34 @@ func loadApps(ctx context.Context) (err error) {
 	appWatcher.trigger(res)
 	return
 }
+
+// 修改应用配置，本进程立即重新加载，其他进程在下次加载时生效
+func updateApp(ctx context.Context, appId string, update bson.M) (err error) {
+	collection, err := getAppCollection(ctx)
+	if err != nil {
+		return
+	}
+	r, err := collection.UpdateOne(ctx, bson.M{"_id": appId}, update)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if r.MatchedCount == 0 {
+		return ErrInvalidAppId
+	}
+	if err = loadApps(ctx); err != nil {
+		log.Warnf("failed to load apps: %v", err)
+	}
+	return nil
+}
+
+// 设置客户端版本要求，为空时清除
+func SetAppClientVersionRules(
+	ctx context.Context, appId string, rules []*ClientVersionRule) error {
+	if len(rules) == 0 {
+		return updateApp(ctx, appId,
+			bson.M{"$unset": bson.M{"client_version_rules": 1}})
+	}
+	return updateApp(ctx, appId,
+		bson.M{"$set": bson.M{"client_version_rules": rules}})
+}
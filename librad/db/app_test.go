@@ -0,0 +1,66 @@
+package db
+
+import "testing"
+
+func TestOidcProviders(t *testing.T) {
+	app, ctx := testSetup(t, &App{
+		Id: "testoidc",
+		OidcProviders: []*OidcProvider{{
+			Name:      "google",
+			Issuer:    "https://accounts.google.com",
+			Audiences: []string{"client"},
+			JwksUrl:   "https://www.googleapis.com/oauth2/v3/certs",
+		}},
+	})
+	defer testSaveApp(t, app)()
+
+	// 提供方从应用配置中加载
+	if err := loadApps(ctx); err != nil {
+		t.Fatalf("failed to load apps: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil {
+		t.Fatal("expect app loaded")
+	}
+	p := app.FindOidcProvider("google")
+	if p == nil || p.Issuer != "https://accounts.google.com" ||
+		len(p.Audiences) != 1 || p.Audiences[0] != "client" {
+		t.Fatalf("unexpected provider: %+v", p)
+	}
+	if p = app.FindOidcProvider("apple"); p != nil {
+		t.Fatalf("unexpected provider: %+v", p)
+	}
+}
+
+func TestClientVersionRules(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testclientversion"})
+	defer testSaveApp(t, app)()
+
+	if err := SetAppClientVersionRules(ctx, app.Id, []*ClientVersionRule{
+		{MinVersion: "1.0.0"},
+		{Platform: "iOS", MinVersion: "1.2.0", RecommendedVersion: "1.3.0"},
+	}); err != nil {
+		t.Fatalf("failed to set client version rules: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil {
+		t.Fatal("expect app loaded")
+	}
+	if r := app.FindClientVersionRule("ios"); r == nil ||
+		r.MinVersion != "1.2.0" || r.RecommendedVersion != "1.3.0" {
+		t.Fatalf("unexpected rule: %+v", r)
+	}
+	if r := app.FindClientVersionRule("android"); r == nil ||
+		r.MinVersion != "1.0.0" {
+		t.Fatalf("unexpected rule: %+v", r)
+	}
+	if err := SetAppClientVersionRules(ctx, app.Id, nil); err != nil {
+		t.Fatalf("failed to clear client version rules: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil ||
+		len(app.ClientVersionRules) != 0 {
+		t.Fatal("expect client version rules cleared")
+	}
+	if err := SetAppClientVersionRules(
+		ctx, "testclientversionx", nil); err != ErrInvalidAppId {
+		t.Fatalf("expect invalid app id, but got: %v", err)
+	}
+}
@@ -2,8 +2,12 @@ package db
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"regexp"
 	"time"
 
+	"github.com/ntons/log-go"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -11,37 +15,63 @@ import (
 
 // 通用封禁
 
+const (
+	// 单页最多返回的封禁数
+	dbMaxBlockPageSize = 1000
+	// 批量导入时每批写入的封禁数
+	dbBlockImportBatchSize = 500
+)
+
 type BlockData struct {
 	Key string `bson:"_id"`
+	// 规则类型，为空视为精确匹配
+	Type string `bson:"type,omitempty"`
+	// 解析后的匹配模式
+	Pattern string `bson:"pattern,omitempty"`
 	// 封禁时间
 	BanAt time.Time `bson:"ban_at,omitempty"`
 	// 封禁时间
 	BanTo time.Time `bson:"ban_to,omitempty"`
 	// 封禁原因
 	BanFor string `bson:"ban_for,omitempty"`
+	// 封禁操作者
+	BanBy string `bson:"ban_by,omitempty"`
 }
 
-func Block(ctx context.Context, appId string, keys []string, banTo time.Time, banFor string) (err error) {
+// 封禁seconds秒，当前生效的封禁保存在封禁表中，同时留下处罚记录，返回新的处罚记录
+func Block(ctx context.Context, appId, operator string, keys []string, seconds int64, banFor string) (_ []*Sanction, err error) {
 	coll, err := getBlockCollection(ctx, appId)
 	if err != nil {
 		return
 	}
-	if _, err = coll.UpdateMany(
-		ctx,
-		bson.M{"_id": bson.M{"$in": keys}},
-		bson.M{"$set": bson.M{
-			"ban_at":  time.Now(),
-			"ban_to":  banTo,
-			"ban_for": banFor,
-		}},
-		options.Update().SetUpsert(true),
-	); err != nil {
-		return
+	// 中途失败时已写入的封禁也要生效
+	defer touchBlockSet(ctx, appId)
+	banTo := time.Now().Add(time.Duration(seconds) * time.Second)
+	// UpdateMany+upsert只能插入一条，需要逐个更新
+	for _, key := range keys {
+		typ, pattern := ParseBlockKey(key)
+		if _, err = coll.UpdateOne(
+			ctx,
+			bson.M{"_id": key},
+			bson.M{"$set": bson.M{
+				"type":    typ,
+				"pattern": pattern,
+				"ban_at":  time.Now(),
+				"ban_to":  banTo,
+				"ban_for": banFor,
+				"ban_by":  operator,
+			}},
+			options.Update().SetUpsert(true),
+		); err != nil {
+			return
+		}
 	}
-	return
+	return addSanctions(
+		ctx, appId, SanctionKindBlock, "", operator, keys,
+		seconds, banTo, banFor)
 }
 
-func Allow(ctx context.Context, appId string, keys []string) (err error) {
+func Allow(ctx context.Context, appId, operator string, keys []string, liftFor string) (err error) {
 	coll, err := getBlockCollection(ctx, appId)
 	if err != nil {
 		return
@@ -52,38 +82,30 @@ func Allow(ctx context.Context, appId string, keys []string) (err error) {
 	); err != nil {
 		return
 	}
-	return
+	touchBlockSet(ctx, appId)
+	return liftSanctions(
+		ctx, appId, SanctionKindBlock, "", operator, keys, liftFor)
 }
 
+// 检查给定的键是否被封禁，返回最近一次生效的封禁
+// 规则在内存中编译后匹配，不需要每次访问数据库
 func IsBlocked(ctx context.Context, appId string, keys []string) (_ *BlockData, err error) {
-	coll, err := getBlockCollection(ctx, appId)
-	if err != nil {
-		return
-	}
-	cur, err := coll.Find(
-		ctx,
-		bson.M{"_id": bson.M{"$in": keys}},
-	)
+	set, err := getBlockSet(ctx, appId)
 	if err != nil {
 		return
 	}
 
-	var blocks []*BlockData
-	if err = cur.All(ctx, &blocks); err != nil {
-		return
-	}
-
 	var (
 		now         = time.Now()
 		latestBlock *BlockData
-		latestBanAt time.Time
 	)
-	for _, block := range blocks {
-		if block.BanTo.After(now) &&
-			(latestBlock == nil || block.BanAt.After(latestBanAt)) {
-			latestBlock = block
-			latestBanAt = block.BanAt
-		}
+	for _, key := range keys {
+		set.match(key, func(block *BlockData) {
+			if block.BanTo.After(now) &&
+				(latestBlock == nil || block.BanAt.After(latestBlock.BanAt)) {
+				latestBlock = block
+			}
+		})
 	}
 
 	return latestBlock, nil
@@ -102,6 +124,205 @@ func getBlockCollection(
 	dbName := getAppDBName(appId)
 
 	collection := mdb.Database(dbName).Collection(tblName)
+	if _, err := collection.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				// 过期的封禁自动清除，处罚记录中依然保留历史
+				Keys:    bson.D{{Key: "ban_to", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+			{
+				Keys: bson.D{{Key: "type", Value: 1}},
+			},
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
 	dbBlockCollection[appId] = collection
 	return collection, nil
 }
+
+// 封禁列表过滤条件
+type BlockFilter struct {
+	// 规则类型
+	Type string
+	// 封禁键前缀
+	KeyPrefix string
+	// 封禁操作者
+	BanBy string
+}
+
+func (x *BlockFilter) toBson() bson.M {
+	filter := bson.M{"ban_to": bson.M{"$gt": time.Now()}}
+	if x == nil {
+		return filter
+	}
+	if x.Type != "" {
+		if x.Type == BlockTypeExact {
+			// 旧数据没有类型
+			filter["type"] = bson.M{"$in": []interface{}{x.Type, nil}}
+		} else {
+			filter["type"] = x.Type
+		}
+	}
+	if x.KeyPrefix != "" {
+		filter["_id"] = bson.M{
+			"$regex": "^" + regexp.QuoteMeta(x.KeyPrefix),
+		}
+	}
+	if x.BanBy != "" {
+		filter["ban_by"] = x.BanBy
+	}
+	return filter
+}
+
+// 分页列出生效中的封禁，按封禁键排序
+// 返回的next作为下一页的after，为空表示没有更多了
+func ListBlocks(
+	ctx context.Context, appId string, filter *BlockFilter,
+	after string, limit int) (_ []*BlockData, next string, err error) {
+	if limit <= 0 || limit > dbMaxBlockPageSize {
+		limit = dbMaxBlockPageSize
+	}
+	coll, err := getBlockCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	f := filter.toBson()
+	if after != "" {
+		if id, ok := f["_id"].(bson.M); ok {
+			id["$gt"] = after
+		} else {
+			f["_id"] = bson.M{"$gt": after}
+		}
+	}
+	cur, err := coll.Find(
+		ctx,
+		f,
+		options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		log.Warnf("failed to find blocks: %v", err)
+		return nil, "", ErrDatabaseUnavailable
+	}
+	var blocks []*BlockData
+	if err = cur.All(ctx, &blocks); err != nil {
+		log.Warnf("failed to decode blocks: %v", err)
+		return nil, "", ErrDatabaseUnavailable
+	}
+	if len(blocks) == limit {
+		next = blocks[len(blocks)-1].Key
+	}
+	return blocks, next, nil
+}
+
+// 导出生效中的封禁，用于在应用之间共享封禁列表
+func ExportBlocks(
+	ctx context.Context, appId string, filter *BlockFilter,
+	fn func(*BlockData) error) (err error) {
+	coll, err := getBlockCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cur, err := coll.Find(ctx, filter.toBson())
+	if err != nil {
+		log.Warnf("failed to find blocks: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		block := &BlockData{}
+		if err = cur.Decode(block); err != nil {
+			log.Warnf("failed to decode block: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		if err = fn(block); err != nil {
+			return
+		}
+	}
+	if err = cur.Err(); err != nil {
+		log.Warnf("failed to iterate blocks: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 批量导入封禁，next返回io.EOF表示结束
+// 导入的封禁保留原有的封禁时间和原因，操作者记为导入者
+func ImportBlocks(
+	ctx context.Context, appId, operator string,
+	next func() (*BlockData, error)) (n int, err error) {
+	coll, err := getBlockCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	// 中途失败时已导入的封禁也要生效
+	defer touchBlockSet(ctx, appId)
+	var (
+		now    = time.Now()
+		models []mongo.WriteModel
+		blocks []*BlockData
+	)
+	flush := func() (err error) {
+		if len(models) == 0 {
+			return
+		}
+		if _, err = coll.BulkWrite(
+			ctx, models, options.BulkWrite().SetOrdered(false),
+		); err != nil {
+			log.Warnf("failed to import blocks: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		// 导入的封禁没有请求的时长
+		sanctions := make([]*Sanction, 0, len(blocks))
+		for _, block := range blocks {
+			sanctions = append(sanctions, &Sanction{
+				Kind:     SanctionKindBlock,
+				Target:   block.Key,
+				Operator: operator,
+				Reason:   block.BanFor,
+				CreateAt: now,
+				ExpireAt: block.BanTo,
+			})
+		}
+		if err = insertSanctions(ctx, appId, sanctions); err != nil {
+			return
+		}
+		n += len(models)
+		models, blocks = models[:0], blocks[:0]
+		return
+	}
+	for {
+		var block *BlockData
+		if block, err = next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if block.Key == "" || !block.BanTo.After(now) {
+			continue
+		}
+		if block.BanAt.IsZero() {
+			block.BanAt = now
+		}
+		block.Type, block.Pattern = ParseBlockKey(block.Key)
+		block.BanBy = operator
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": block.Key}).
+			SetReplacement(block).
+			SetUpsert(true))
+		blocks = append(blocks, block)
+		if len(models) >= dbBlockImportBatchSize {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return
+	}
+	return n, nil
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 封禁规则类型
+const (
+	// 精确匹配
+	BlockTypeExact = "exact"
+	// 前缀匹配，如 "guest:*" 封禁所有游客账号
+	BlockTypePrefix = "prefix"
+	// IP段匹配，如 "10.0.0.0/8"
+	BlockTypeIpCidr = "ip-cidr"
+)
+
+// 解析封禁键
+// 合法的CIDR解析为IP段，以*结尾的解析为前缀，其余均为精确匹配
+func ParseBlockKey(key string) (typ, pattern string) {
+	if strings.Contains(key, "/") {
+		if _, ipNet, err := net.ParseCIDR(key); err == nil {
+			return BlockTypeIpCidr, ipNet.String()
+		}
+	}
+	if len(key) > 1 && strings.HasSuffix(key, "*") {
+		return BlockTypePrefix, strings.TrimSuffix(key, "*")
+	}
+	return BlockTypeExact, key
+}
+
+// 编译后的封禁规则集合
+// 匹配耗时只与键的长度和IP掩码种类有关，与规则数量无关
+type xBlockSet struct {
+	exact    map[string]*BlockData
+	prefixes map[string]*BlockData
+	// 掩码长度 -> 网络地址 -> 规则
+	cidrs map[int]map[string]*BlockData
+	// 规则中出现过的最长前缀
+	maxPrefixLen int
+	// 加载时的版本号
+	version int64
+}
+
+func newBlockSet(blocks []*BlockData, version int64) *xBlockSet {
+	x := &xBlockSet{
+		exact:    make(map[string]*BlockData),
+		prefixes: make(map[string]*BlockData),
+		cidrs:    make(map[int]map[string]*BlockData),
+		version:  version,
+	}
+	for _, b := range blocks {
+		typ, pattern := b.Type, b.Pattern
+		if typ == "" {
+			// 旧数据没有类型，均为精确匹配
+			typ, pattern = BlockTypeExact, b.Key
+		}
+		switch typ {
+		case BlockTypeExact:
+			x.exact[pattern] = b
+		case BlockTypePrefix:
+			x.prefixes[pattern] = b
+			if len(pattern) > x.maxPrefixLen {
+				x.maxPrefixLen = len(pattern)
+			}
+		case BlockTypeIpCidr:
+			_, ipNet, err := net.ParseCIDR(pattern)
+			if err != nil {
+				log.Warnf("malformed block cidr: %v, %v", b.Key, err)
+				continue
+			}
+			ones, _ := ipNet.Mask.Size()
+			m, ok := x.cidrs[ones]
+			if !ok {
+				m = make(map[string]*BlockData)
+				x.cidrs[ones] = m
+			}
+			m[ipNet.String()] = b
+		}
+	}
+	return x
+}
+
+// 找出所有匹配的规则
+func (x *xBlockSet) match(key string, fn func(*BlockData)) {
+	if b, ok := x.exact[key]; ok {
+		fn(b)
+	}
+	if len(x.prefixes) > 0 {
+		n := len(key)
+		if n > x.maxPrefixLen {
+			n = x.maxPrefixLen
+		}
+		for i := 1; i <= n; i++ {
+			if b, ok := x.prefixes[key[:i]]; ok {
+				fn(b)
+			}
+		}
+	}
+	if len(x.cidrs) > 0 {
+		ip := net.ParseIP(key)
+		if ip == nil {
+			return
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		for ones, m := range x.cidrs {
+			if ones > bits {
+				continue
+			}
+			ipNet := net.IPNet{
+				IP:   ip.Mask(net.CIDRMask(ones, bits)),
+				Mask: net.CIDRMask(ones, bits),
+			}
+			if b, ok := m[ipNet.String()]; ok {
+				fn(b)
+			}
+		}
+	}
+}
+
+var (
+	xBlockSetsMu sync.RWMutex
+	xBlockSets   = make(map[string]*xBlockSet)
+)
+
+func getBlockSetVersionKey(appId string) string {
+	return fmt.Sprintf("%s$blocks", appId)
+}
+
+// 封禁规则变更后增加版本号，各实例发现版本变化后重新加载
+func touchBlockSet(ctx context.Context, appId string) {
+	if err := rdbAuth.Incr(
+		ctx, getBlockSetVersionKey(appId)).Err(); err != nil {
+		log.Warnf("failed to incr block set version: %v", err)
+	}
+	xBlockSetsMu.Lock()
+	delete(xBlockSets, appId)
+	xBlockSetsMu.Unlock()
+}
+
+func getBlockSetVersion(ctx context.Context, appId string) (int64, error) {
+	v, err := rdbAuth.Get(ctx, getBlockSetVersionKey(appId)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return v, err
+}
+
+func loadBlockSet(ctx context.Context, appId string) (_ *xBlockSet, err error) {
+	version, err := getBlockSetVersion(ctx, appId)
+	if err != nil {
+		return
+	}
+	coll, err := getBlockCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	// 过期的规则不需要加载
+	cur, err := coll.Find(ctx, bson.M{"ban_to": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return
+	}
+	var blocks []*BlockData
+	if err = cur.All(ctx, &blocks); err != nil {
+		return
+	}
+	x := newBlockSet(blocks, version)
+	xBlockSetsMu.Lock()
+	xBlockSets[appId] = x
+	xBlockSetsMu.Unlock()
+	return x, nil
+}
+
+func getBlockSet(ctx context.Context, appId string) (*xBlockSet, error) {
+	xBlockSetsMu.RLock()
+	x, ok := xBlockSets[appId]
+	xBlockSetsMu.RUnlock()
+	if ok {
+		return x, nil
+	}
+	return loadBlockSet(ctx, appId)
+}
+
+// 检查已加载的封禁规则是否有变更
+func refreshBlockSets(ctx context.Context) {
+	xBlockSetsMu.RLock()
+	sets := make(map[string]*xBlockSet, len(xBlockSets))
+	for appId, x := range xBlockSets {
+		sets[appId] = x
+	}
+	xBlockSetsMu.RUnlock()
+
+	for appId, x := range sets {
+		version, err := getBlockSetVersion(ctx, appId)
+		if err != nil {
+			log.Warnf("failed to get block set version: %v", err)
+			continue
+		}
+		if version == x.version {
+			continue
+		}
+		if _, err = loadBlockSet(ctx, appId); err != nil {
+			log.Warnf("failed to load block set: %v", err)
+		}
+	}
+}
+
+func serveBlockSets(ctx context.Context) {
+	for {
+		refreshBlockSets(ctx)
+		jitter := time.Duration(rand.Int63n(int64(2 * time.Second)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(4*time.Second + jitter): // [4s,6s)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"fmt"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -51,10 +53,54 @@ type xConfig struct {
 		// parsed to
 		timeout time.Duration
 	}
+	// 角色
+	Role struct {
+		// 删除后的保留时长，期间可以恢复
+		Retention string
+		// 角色名释放后的冷却时长，期间不能被其他角色占用
+		NameCooldown string
+		// parsed to
+		retention    time.Duration
+		nameCooldown time.Duration
+	}
+	// 用户事件流
+	Events struct {
+		// pubsub的Redis，为空时不产生事件
+		Redis string
+		// 主题，默认为"libra.events"
+		Topic string
+		// 流的最大长度，默认为100000
+		MaxLen int64
+		// 发件箱中事件的保留时长，超过后没有发布也会过期
+		Retention string
+		// parsed to
+		retention time.Duration
+	}
+	// IP地理位置
+	GeoIP struct {
+		// MaxMind格式的数据库文件
+		Database string
+		// 检查文件变化的间隔
+		ReloadInterval string
+		// parsed to
+		reloadInterval time.Duration
+	}
+	// 生命周期钩子
+	Hooks struct {
+		// 接口可以设置的回调地址，格式为"scheme://host[:port]"，
+		// host以"*."开头时匹配所有子域名，为空时不能通过接口设置钩子
+		AllowedUrls []string
+		// parsed to
+		allowedUrls []*url.URL
+	}
+	// 单个用户或角色的元数据总大小上限
+	MaxMetadataSize int
 	// 配置/注册DB
 	Mongo string
 	// 每个App都有的通用权限
 	CommonPermissions []*Permission
+	// 范围处罚，处罚名到被禁止的接口
+	SanctionScopes map[string][]*Permission
 	// 配置DB名字
 	ConfigDBName string
 	// AppDB前缀
@@ -69,11 +115,66 @@ func (cfg *xConfig) parse() (err error) {
 	} else {
 		cfg.Nonce.timeout = time.Hour
 	}
+	if s := cfg.Role.Retention; s != "" {
+		if cfg.Role.retention, err = time.ParseDuration(s); err != nil {
+			return
+		}
+	} else {
+		cfg.Role.retention = 7 * 24 * time.Hour
+	}
+	if s := cfg.Role.NameCooldown; s != "" {
+		if cfg.Role.nameCooldown, err = time.ParseDuration(s); err != nil {
+			return
+		}
+	} else {
+		cfg.Role.nameCooldown = 24 * time.Hour
+	}
+	if cfg.Events.Topic == "" {
+		cfg.Events.Topic = "libra.events"
+	}
+	if cfg.Events.MaxLen <= 0 {
+		cfg.Events.MaxLen = 100000
+	}
+	if s := cfg.Events.Retention; s != "" {
+		if cfg.Events.retention, err = time.ParseDuration(s); err != nil {
+			return
+		}
+	} else {
+		cfg.Events.retention = 7 * 24 * time.Hour
+	}
+	if s := cfg.GeoIP.ReloadInterval; s != "" {
+		if cfg.GeoIP.reloadInterval, err = time.ParseDuration(s); err != nil {
+			return
+		}
+	} else {
+		cfg.GeoIP.reloadInterval = time.Minute
+	}
+	cfg.Hooks.allowedUrls = cfg.Hooks.allowedUrls[:0]
+	for _, s := range cfg.Hooks.AllowedUrls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid hook allowed url: %s", s)
+		}
+		cfg.Hooks.allowedUrls = append(cfg.Hooks.allowedUrls, u)
+	}
+	if cfg.MaxMetadataSize <= 0 {
+		cfg.MaxMetadataSize = 64 * 1024
+	}
 	for _, p := range cfg.CommonPermissions {
 		if err = p.parse(); err != nil {
 			return
 		}
 	}
+	for _, ps := range cfg.SanctionScopes {
+		for _, p := range ps {
+			if err = p.parse(); err != nil {
+				return
+			}
+		}
+	}
 	return
 }
 
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 邮箱密码凭证
+// 只保存密码的哈希，哈希算法和一次性验证码由注册服务负责。
+// 修改密码时比较旧的哈希，保证同一个验证码只能使用一次。
+
+var (
+	dbCredentialCollectionMu sync.Mutex
+	dbCredentialCollection   = make(map[string]*mongo.Collection)
+)
+
+type Credential struct {
+	// 归一化后的邮箱
+	Email string `bson:"_id"`
+	// 密码哈希
+	PasswordHash string `bson:"password_hash"`
+	// 邮箱验证时间，未验证时为空
+	VerifyAt time.Time `bson:"verify_at,omitempty"`
+	// 创建时间
+	CreateAt time.Time `bson:"create_at"`
+	// 更新时间
+	UpdateAt time.Time `bson:"update_at"`
+}
+
+func (x *Credential) IsVerified() bool {
+	return !x.VerifyAt.IsZero()
+}
+
+func getCredentialCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbCredentialCollectionMu.Lock()
+	defer dbCredentialCollectionMu.Unlock()
+
+	if collection, ok := dbCredentialCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.credentials"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	dbCredentialCollection[appId] = collection
+	return collection, nil
+}
+
+// 创建凭证，未验证的凭证超过pendingTimeout没有更新才可以被重新注册覆盖，
+// 避免邮箱被他人抢注，也避免待验证的密码被他人替换。
+// 已验证或者未过期的凭证返回ErrCredentialAlreadyExists
+func CreateCredential(
+	ctx context.Context, appId, email, passwordHash string,
+	pendingTimeout time.Duration) (_ *Credential, err error) {
+	collection, err := getCredentialCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	x := &Credential{}
+	if err = collection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":       email,
+			"verify_at": bson.M{"$exists": false},
+			"update_at": bson.M{"$lt": now.Add(-pendingTimeout)},
+		},
+		bson.M{
+			"$set": bson.M{
+				"password_hash": passwordHash,
+				"update_at":     now,
+			},
+			"$setOnInsert": bson.M{
+				"create_at": now,
+			},
+		},
+		options.FindOneAndUpdate().SetUpsert(true),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(x); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrCredentialAlreadyExists
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return x, nil
+}
+
+func GetCredential(
+	ctx context.Context, appId, email string) (_ *Credential, err error) {
+	collection, err := getCredentialCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	x := &Credential{}
+	if err = collection.FindOne(ctx, bson.M{"_id": email}).Decode(x); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrCredentialNotFound
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return x, nil
+}
+
+// 标记邮箱已验证，密码哈希必须与签发验证码时一致
+func VerifyCredential(
+	ctx context.Context, appId, email, passwordHash string) (err error) {
+	collection, err := getCredentialCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	res, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":           email,
+			"password_hash": passwordHash,
+			"verify_at":     bson.M{"$exists": false},
+		},
+		bson.M{
+			"$set": bson.M{
+				"verify_at": now,
+				"update_at": now,
+			},
+		},
+	)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if res.MatchedCount == 0 {
+		return ErrCredentialNotFound
+	}
+	return
+}
+
+// 修改密码，旧的哈希不一致时失败。
+// 能修改密码说明持有邮箱，未验证的凭证同时标记为已验证。
+func UpdateCredentialPassword(
+	ctx context.Context, appId, email, oldHash, newHash string) (err error) {
+	collection, err := getCredentialCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	res, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":           email,
+			"password_hash": oldHash,
+		},
+		bson.M{
+			"$set": bson.M{
+				"password_hash": newHash,
+				"update_at":     now,
+			},
+			"$min": bson.M{
+				"verify_at": now,
+			},
+		},
+	)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if res.MatchedCount == 0 {
+		return ErrCredentialNotFound
+	}
+	return
+}
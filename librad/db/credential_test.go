@@ -0,0 +1,93 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCredential(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testcredential"})
+
+	const email = "a@example.com"
+	if _, err := GetCredential(
+		ctx, app.Id, email); err != ErrCredentialNotFound {
+		t.Fatalf("expect credential not found, but got: %v", err)
+	}
+	if _, err := CreateCredential(
+		ctx, app.Id, email, "h1", time.Hour); err != nil {
+		t.Fatalf("failed to create credential: %v", err)
+	}
+	// 待验证的凭证不能被覆盖，过期后可以重新注册
+	if _, err := CreateCredential(
+		ctx, app.Id, email, "h2", time.Hour); err != ErrCredentialAlreadyExists {
+		t.Fatalf("expect credential already exists, but got: %v", err)
+	}
+	collection, err := getCredentialCollection(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to get credential collection: %v", err)
+	}
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": email},
+		bson.M{"$set": bson.M{"update_at": time.Now().Add(-2 * time.Hour)}},
+	); err != nil {
+		t.Fatalf("failed to update credential: %v", err)
+	}
+	x, err := CreateCredential(ctx, app.Id, email, "h2", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create credential: %v", err)
+	}
+	if x.PasswordHash != "h2" || x.IsVerified() {
+		t.Fatalf("unexpected credential: %+v", x)
+	}
+	// 被覆盖的哈希签发的验证码失效
+	if err = VerifyCredential(
+		ctx, app.Id, email, "h1"); err != ErrCredentialNotFound {
+		t.Fatalf("expect credential not found, but got: %v", err)
+	}
+	if err = VerifyCredential(ctx, app.Id, email, "h2"); err != nil {
+		t.Fatalf("failed to verify credential: %v", err)
+	}
+	if err = VerifyCredential(
+		ctx, app.Id, email, "h2"); err != ErrCredentialNotFound {
+		t.Fatalf("expect credential not found, but got: %v", err)
+	}
+	if _, err = CreateCredential(
+		ctx, app.Id, email, "h3", time.Hour); err != ErrCredentialAlreadyExists {
+		t.Fatalf("expect credential already exists, but got: %v", err)
+	}
+	if err = UpdateCredentialPassword(
+		ctx, app.Id, email, "h2", "h3"); err != nil {
+		t.Fatalf("failed to update password: %v", err)
+	}
+	// 同一个验证码只能使用一次
+	if err = UpdateCredentialPassword(
+		ctx, app.Id, email, "h2", "h4"); err != ErrCredentialNotFound {
+		t.Fatalf("expect credential not found, but got: %v", err)
+	}
+	if x, err = GetCredential(ctx, app.Id, email); err != nil {
+		t.Fatalf("failed to get credential: %v", err)
+	}
+	if x.PasswordHash != "h3" || !x.IsVerified() {
+		t.Fatalf("unexpected credential: %+v", x)
+	}
+
+	// 重置密码同时完成验证
+	const email2 = "b@example.com"
+	if _, err = CreateCredential(
+		ctx, app.Id, email2, "h1", time.Hour); err != nil {
+		t.Fatalf("failed to create credential: %v", err)
+	}
+	if err = UpdateCredentialPassword(
+		ctx, app.Id, email2, "h1", "h2"); err != nil {
+		t.Fatalf("failed to update password: %v", err)
+	}
+	if x, err = GetCredential(ctx, app.Id, email2); err != nil {
+		t.Fatalf("failed to get credential: %v", err)
+	}
+	if !x.IsVerified() {
+		t.Fatalf("expect credential verified: %+v", x)
+	}
+}
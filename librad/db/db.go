@@ -9,6 +9,7 @@ import (
 
 	"github.com/ntons/log-go"
 	"github.com/ntons/redis"
+	"github.com/ntons/redlock"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -24,12 +25,14 @@ import (
 
 const (
 	dbMaxAcctPerUser = 100
-	// 会话最长生命周期，即使一直在线，也会强制清除
+	// 默认的会话最长生命周期，即使一直在线，也会强制清除
 	dbSessTTL = 24 * time.Hour
 )
 
 var (
 	mdb *mongo.Client
+	// 是否支持事务，Standalone不支持
+	mdbTxn bool
 
 	rdbAuth  redis.Client
 	rdbNonce redis.Client
@@ -57,31 +60,65 @@ var (
 	// admin cache loaded from database
 	xAdmins = newAdminIndex(nil)
 
-	// 只更新会话数据
+	// 只更新会话数据，保留会话属性和原有的过期时间
 	luaUpdateSessData = redis.NewScript(`
 local b = redis.call("GET", KEYS[1])
-if not b then return Nil end
+if not b then return nil end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl <= 0 then return nil end
 local d = cmsgpack.unpack(b)
-d.data = cmsgpack.unpack(ARGV[1])
-return redis.call("SETEX", KEYS[1], %d, cmsgpack.pack(d))`,
-		dbSessTTL/time.Second,
-	)
+local data = cmsgpack.unpack(ARGV[1])
+if type(d.data) == "table" then data.attrs = d.data.attrs end
+d.data = data
+return redis.call("PSETEX", KEYS[1], ttl, cmsgpack.pack(d))`)
+	// 只更新会话中的范围处罚，保留原有的过期时间
+	luaUpdateSessSanctions = redis.NewScript(`
+local b = redis.call("GET", KEYS[1])
+if not b then return nil end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl <= 0 then return nil end
+local d = cmsgpack.unpack(b)
+d.sanctions = cmsgpack.unpack(ARGV[1])
+return redis.call("PSETEX", KEYS[1], ttl, cmsgpack.pack(d))`)
 )
 
 // 会话缓存数据
 type SessData struct {
 	RoleId    string `msgpack:"roleId"`
 	RoleIndex uint32 `msgpack:"roleIndex"`
+	// 会话属性，鉴权时作为可信头转发
+	Attrs map[string]string `msgpack:"attrs,omitempty"`
+}
+
+// 会话中缓存的范围处罚
+type SessSanction struct {
+	Scope  string `msgpack:"scope"`
+	BanTo  int64  `msgpack:"banTo"`
+	BanFor string `msgpack:"banFor"`
 }
 type Sess struct {
-	AppId  string   `msgpack:"-"`
-	UserId string   `msgpack:"-"`
-	Token  string   `msgpack:"token"`
-	Data   SessData `msgpack:"data"`
+	AppId  string `msgpack:"-"`
+	UserId string `msgpack:"-"`
+	Token  string `msgpack:"token"`
+	// 创建时间，用于计算最长生命周期
+	CreateAt  int64           `msgpack:"createAt,omitempty"`
+	Data      SessData        `msgpack:"data"`
+	Sanctions []*SessSanction `msgpack:"sanctions,omitempty"`
 	//// 中转数据
 	App *App `msgpack:"-"`
 }
 
+// 请求路径是否被生效中的范围处罚禁止
+func (s *Sess) IsSanctioned(path string) *SessSanction {
+	now := time.Now().Unix()
+	for _, x := range s.Sanctions {
+		if x.BanTo > now && s.App.isSanctioned(x.Scope, path) {
+			return x
+		}
+	}
+	return nil
+}
+
 func dialMongo(ctx context.Context) (_ *mongo.Client, err error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
@@ -95,6 +132,23 @@ func dialMongo(ctx context.Context) (_ *mongo.Client, err error) {
 	return cli, nil
 }
 
+// 副本集和分片集群支持事务
+func isTxnSupported(ctx context.Context) (_ bool, err error) {
+	var res struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err = mdb.Database("admin").RunCommand(
+		ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res); err != nil {
+		return false, fmt.Errorf("failed to check mongo topology: %w", err)
+	}
+	if res.SetName == "" && res.Msg != "isdbgrid" {
+		log.Infof("mongo is standalone, transactions disabled")
+		return false, nil
+	}
+	return true, nil
+}
+
 func dialDatabase(ctx context.Context) (err error) {
 	if rdbAuth, err = redis.Dial(
 		ctx, cfg.Auth.Redis, redis.WithPingTest()); err != nil {
@@ -107,6 +161,16 @@ func dialDatabase(ctx context.Context) (err error) {
 	if mdb, err = dialMongo(ctx); err != nil {
 		return
 	}
+	if mdbTxn, err = isTxnSupported(ctx); err != nil {
+		return
+	}
+	if cfg.Events.Redis != "" {
+		if rdbEvents, err = redis.Dial(
+			ctx, cfg.Events.Redis, redis.WithPingTest()); err != nil {
+			return
+		}
+		dlEvents = redlock.New(rdbEvents)
+	}
 	return
 }
 
@@ -117,10 +181,14 @@ func dbServe(ctx context.Context) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		// 一次性的数据迁移放在后台，不阻塞请求
+		roleIndexMigrated := make(map[string]bool)
 		for {
 			if err := loadApps(ctx); err != nil {
 				log.Warnf("failed to load apps: %v", err)
 			}
+			migrateRoleIndexes(ctx, roleIndexMigrated)
+			ensureMetadataIndexes(ctx, ListApps())
 			jitter := time.Duration(rand.Int63n(int64(30 * time.Second)))
 			select {
 			case <-ctx.Done():
@@ -130,6 +198,36 @@ func dbServe(ctx context.Context) {
 		}
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveBlockSets(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveRolePurge(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveCcuSample(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveGeoIP(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveEventRelay(ctx)
+	}()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -2,82 +2,134 @@ package db
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	v1pb "github.com/ntons/libra-go/api/libra/v1"
 	logcfg "github.com/ntons/log-go/config"
-	//"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var testApp = &App{
-	Id:  "testapp",
-	Key: 1024,
+var (
+	testOnce sync.Once
+	testErr  error
+)
+
+func testDial() error {
+	testOnce.Do(func() {
+		logcfg.DefaultZapJsonConfig.Use()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		cfg.Mongo = "mongodb://mongo0:27010,mongo1:27011,mongo2:27013/test?replicaSet=rs0"
+		cfg.Auth.Redis = "redis://localhost:6379/1"
+		cfg.Nonce.Redis = "redis://localhost:6379/1"
+		if testErr = cfg.parse(); testErr != nil {
+			return
+		}
+		testErr = dialDatabase(ctx)
+	})
+	return testErr
 }
 
-func testInit() (err error) {
-	logcfg.DefaultZapJsonConfig.Use()
+// 每个测试使用独立的应用，避免集合缓存互相影响
 
+func testInit(t *testing.T, app *App) *App {
+	if err := testDial(); err != nil {
+		t.Fatalf("failed to dial to database: %v", err)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-
-	const uri = "mongodb://mongo0:27010,mongo1:27011,mongo2:27013/test?replicaSet=rs0"
-	cli, err := mongo.NewClient(options.Client().ApplyURI(uri))
-	if err != nil {
-		return
+	// purge database
+	if err := mdb.Database(getAppDBName(app.Id)).Drop(ctx); err != nil {
+		t.Fatalf("failed to drop database: %v", err)
 	}
-	if err = cli.Connect(ctx); err != nil {
-		return
+	if err := app.parse(); err != nil {
+		t.Fatalf("failed to parse app: %v", err)
 	}
-	// purge collection
-	if err = cli.Database("testapp").Drop(ctx); err != nil {
-		return
+	apps := append([]*App{app}, ListApps()...)
+	xApps = newAppIndex(apps)
+	return app
+}
+
+// 测试应用的键，每个测试的应用使用不同的键
+
+var testAppKey uint32 = 2047
+
+// 测试夹具，创建独立的应用，返回测试结束时取消的上下文
+
+func testSetup(t *testing.T, app *App) (*App, context.Context) {
+	if app.Key == 0 {
+		app.Key = atomic.AddUint32(&testAppKey, 1)
 	}
-	mdb = cli
-	return
+	app = testInit(t, app)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	t.Cleanup(cancel)
+	return app, ctx
 }
 
-func TestBindAcctIdToUser(t *testing.T) {
-	if err := testInit(); err != nil {
-		t.Fatalf("failed to dial to database: %v", err)
+func testLoginUser(
+	t *testing.T, ctx context.Context, app *App, acctIds ...string) *User {
+	user, _, err := LoginUser(ctx, app, "127.0.0.1", "", acctIds, true, nil)
+	if err != nil {
+		t.Fatalf("failed to login user: %v", err)
 	}
+	return user
+}
+
+func testCreateRole(
+	t *testing.T, ctx context.Context, appId, userId string,
+	index uint32) *Role {
+	role, err := CreateRole(ctx, appId, userId, index)
+	if err != nil {
+		t.Fatalf("failed to create role: %v", err)
+	}
+	return role
+}
+
+// 保存应用配置，修改配置的测试需要，返回清理函数
 
+func testSaveApp(t *testing.T, app *App) func() {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+	collection, err := getAppCollection(ctx)
+	if err != nil {
+		t.Fatalf("failed to get app collection: %v", err)
+	}
+	if _, err = collection.ReplaceOne(
+		ctx, bson.M{"_id": app.Id}, app,
+		options.Replace().SetUpsert(true)); err != nil {
+		t.Fatalf("failed to save app: %v", err)
+	}
+	return func() {
+		collection.DeleteOne(context.Background(), bson.M{"_id": app.Id})
+	}
+}
 
-	if _, err := loginUser(
-		ctx,
-		testApp,
-		"127.0.0.1",
-		[]string{"acct1", "acct2"},
-		&v1pb.UserLoginOptions{},
-	); err != errUserNotFound {
+func TestBindAcctIdToUser(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testapp"})
+
+	if _, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "",
+		[]string{"acct1", "acct2"}, false, nil,
+	); err != ErrUserNotFound {
 		t.Fatalf("expect user not found, but got: %v", err)
 	}
 
-	u1, err := loginUser(
-		ctx,
-		testApp,
-		"127.0.0.1",
-		[]string{"acct1", "acct2"},
-		&v1pb.UserLoginOptions{
-			AutoCreate: true,
-		},
+	u1, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "",
+		[]string{"acct1", "acct2"}, true, nil,
 	)
 	if err != nil {
 		t.Fatalf("failed to login user: %v", err)
 	}
 
-	u2, err := loginUser(
-		ctx,
-		testApp,
-		"127.0.0.1",
-		[]string{"acct2", "acct3"},
-		&v1pb.UserLoginOptions{
-			AutoCreate: true,
-		},
+	u2, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "",
+		[]string{"acct2", "acct3"}, true, nil,
 	)
 	if err != nil {
 		t.Fatalf("failed to login user: %v", err)
@@ -86,56 +138,38 @@ func TestBindAcctIdToUser(t *testing.T) {
 	if u1.Id != u2.Id {
 		t.Fatalf("user id mismatch: %v, %v", u1.Id, u2.Id)
 	}
-	if len(u2.AcctIds) != 3 {
+	// 包含占位账号
+	if len(u2.AcctIds) != 4 {
 		t.Fatalf("user acct ids: %v", u2.AcctIds)
 	}
 
-	u3, err := loginUser(
-		ctx,
-		testApp,
-		"127.0.0.1",
-		[]string{"acct4", "acct5"},
-		&v1pb.UserLoginOptions{
-			AutoCreate: true,
-		},
+	u3, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "",
+		[]string{"acct4", "acct5"}, true, nil,
 	)
 	if err != nil {
 		t.Fatalf("failed to login user: %v", err)
 	}
 
-	if _, err = bindAcctIdToUser(
-		ctx,
-		testApp.Id,
-		u3.Id,
-		[]string{"acct3", "acct6"},
-		&v1pb.UserBindOptions{},
-	); err != errAcctAlreadyExists {
+	if _, err = BindAcctIdToUser(
+		ctx, app.Id, u3.Id, []string{"acct3", "acct6"}, false,
+	); err != ErrAcctAlreadyExists {
 		t.Fatalf("expect acct already exists, but got: %v", err)
 	}
 
-	if acctIds, err := bindAcctIdToUser(
-		ctx,
-		testApp.Id,
-		u3.Id,
-		[]string{"acct5", "acct7"},
-		&v1pb.UserBindOptions{},
+	if acctIds, err := BindAcctIdToUser(
+		ctx, app.Id, u3.Id, []string{"acct5", "acct7"}, false,
 	); err != nil {
 		t.Fatalf("failed to bind acct to user: %v", err)
-	} else if len(acctIds) != 3 {
-		t.Fatalf("expected acct ids count 3, but got: %v", len(acctIds))
-	}
-
-	if acctIds, err := bindAcctIdToUser(
-		ctx,
-		testApp.Id,
-		u3.Id,
-		[]string{"acct3", "acct6"},
-		&v1pb.UserBindOptions{
-			AutoTransfer: true,
-		},
+	} else if len(acctIds) != 4 {
+		t.Fatalf("expected acct ids count 4, but got: %v", len(acctIds))
+	}
+
+	if acctIds, err := BindAcctIdToUser(
+		ctx, app.Id, u3.Id, []string{"acct3", "acct6"}, true,
 	); err != nil {
 		t.Fatalf("failed to bind acct to user: %v", err)
-	} else if len(acctIds) != 5 {
-		t.Fatalf("expected acct ids count 5, but got: %v", len(acctIds))
+	} else if len(acctIds) != 6 {
+		t.Fatalf("expected acct ids count 6, but got: %v", len(acctIds))
 	}
 }
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 设备记录
+// 登录时记录设备和用户的对应关系，每对设备和用户一条记录，
+// 用于查询设备上的用户、用户的设备，以及发现同一设备批量注册的小号。
+// 应用可以配置设备策略，超过告警阈值时记录告警日志，
+// 超过限制时拒绝在该设备上创建新用户，已有用户不受影响。
+
+const (
+	// 单次查询最多返回的记录数
+	dbMaxDeviceLogins = 100
+	// 新用户数的统计窗口
+	dbDeviceNewUserWindow = 24 * time.Hour
+)
+
+var (
+	dbDeviceCollectionMu sync.Mutex
+	dbDeviceCollection   = make(map[string]*mongo.Collection)
+)
+
+// 设备策略，为0时不限制
+type DevicePolicy struct {
+	// 每个设备每天最多创建的新用户数
+	MaxNewUsersPerDay int64 `bson:"max_new_users_per_day,omitempty"`
+	// 每个设备每天创建的新用户数达到时告警
+	AlertNewUsersPerDay int64 `bson:"alert_new_users_per_day,omitempty"`
+	// 每个设备登录过的用户数达到时告警
+	AlertUsers int64 `bson:"alert_users,omitempty"`
+}
+
+// 设备上的一次登录记录
+type DeviceLogin struct {
+	// 设备ID
+	DeviceId string `bson:"device_id"`
+	// 用户ID
+	UserId string `bson:"user_id"`
+	// 用户是否在该设备上创建
+	NewUser bool `bson:"new_user,omitempty"`
+	// 首次登录时间
+	FirstLoginAt time.Time `bson:"first_login_at"`
+	// 最后登录时间
+	LastLoginAt time.Time `bson:"last_login_at"`
+	// 最后登录IP
+	LastLoginIp string `bson:"last_login_ip,omitempty"`
+	// 最后登录的地理位置
+	LastLoginGeo *GeoLocation `bson:"last_login_geo,omitempty"`
+	// 登录次数
+	LoginCount int64 `bson:"login_count"`
+}
+
+func getDeviceCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbDeviceCollectionMu.Lock()
+	defer dbDeviceCollectionMu.Unlock()
+
+	if collection, ok := dbDeviceCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.devices"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	if _, err := collection.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys: bson.D{
+					{Key: "device_id", Value: 1},
+					{Key: "user_id", Value: 1},
+				},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{
+					{Key: "user_id", Value: 1},
+					{Key: "last_login_at", Value: -1},
+				},
+			},
+			{
+				Keys: bson.D{
+					{Key: "device_id", Value: 1},
+					{Key: "first_login_at", Value: -1},
+				},
+			},
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	dbDeviceCollection[appId] = collection
+	return collection, nil
+}
+
+func (x *App) getDevicePolicy() *DevicePolicy {
+	if x.DevicePolicy != nil {
+		return x.DevicePolicy
+	}
+	return &DevicePolicy{}
+}
+
+// 设备在统计窗口内创建的新用户数
+func countDeviceNewUsers(
+	ctx context.Context, collection *mongo.Collection,
+	deviceId string, now time.Time) (int64, error) {
+	return collection.CountDocuments(ctx, bson.M{
+		"device_id":      deviceId,
+		"new_user":       true,
+		"first_login_at": bson.M{"$gte": now.Add(-dbDeviceNewUserWindow)},
+	})
+}
+
+// 登录前检查是否还可以在设备上创建新用户，失败时不限制
+func canCreateUserOnDevice(
+	ctx context.Context, app *App, deviceId string, now time.Time) bool {
+	p := app.getDevicePolicy()
+	if deviceId == "" || p.MaxNewUsersPerDay <= 0 {
+		return true
+	}
+	collection, err := getDeviceCollection(ctx, app.Id)
+	if err != nil {
+		log.Warnf("failed to get device collection: %v", err)
+		return true
+	}
+	n, err := countDeviceNewUsers(ctx, collection, deviceId, now)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return true
+	}
+	return n < p.MaxNewUsersPerDay
+}
+
+// 记录设备登录并检查告警阈值，失败只记录日志
+func recordDeviceLogin(
+	ctx context.Context, app *App, deviceId, userId, clientIp string,
+	geo *GeoLocation, newUser bool, now time.Time) {
+	if deviceId == "" {
+		return
+	}
+	collection, err := getDeviceCollection(ctx, app.Id)
+	if err != nil {
+		log.Warnf("failed to get device collection: %v", err)
+		return
+	}
+	set := bson.M{"last_login_at": now}
+	if clientIp != "" {
+		set["last_login_ip"] = clientIp
+	}
+	if geo != nil {
+		set["last_login_geo"] = geo
+	}
+	setOnInsert := bson.M{"first_login_at": now}
+	if newUser {
+		setOnInsert["new_user"] = true
+	}
+	r, err := collection.UpdateOne(
+		ctx,
+		bson.M{"device_id": deviceId, "user_id": userId},
+		bson.M{
+			"$set":         set,
+			"$setOnInsert": setOnInsert,
+			"$inc":         bson.M{"login_count": 1},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return
+	}
+	// 只在设备上出现新用户时检查告警
+	if r.UpsertedCount == 0 {
+		return
+	}
+	p := app.getDevicePolicy()
+	if newUser && p.AlertNewUsersPerDay > 0 {
+		if n, err := countDeviceNewUsers(
+			ctx, collection, deviceId, now); err != nil {
+			log.Warnf("failed to access mongo: %v", err)
+		} else if n >= p.AlertNewUsersPerDay {
+			log.Warnw("too many new users on device",
+				"app_id", app.Id, "device_id", deviceId,
+				"user_id", userId, "new_users", n)
+		}
+	}
+	if p.AlertUsers > 0 {
+		if n, err := collection.CountDocuments(
+			ctx, bson.M{"device_id": deviceId}); err != nil {
+			log.Warnf("failed to access mongo: %v", err)
+		} else if n >= p.AlertUsers {
+			log.Warnw("too many users on device",
+				"app_id", app.Id, "device_id", deviceId,
+				"user_id", userId, "users", n)
+		}
+	}
+}
+
+func listDeviceLogins(
+	ctx context.Context, appId string, filter bson.M) (
+	_ []*DeviceLogin, err error) {
+	collection, err := getDeviceCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Find(
+		ctx,
+		filter,
+		options.Find().
+			SetSort(bson.D{{Key: "last_login_at", Value: -1}}).
+			SetLimit(dbMaxDeviceLogins),
+	)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var r []*DeviceLogin
+	if err = cursor.All(ctx, &r); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return r, nil
+}
+
+// 设备上登录过的用户，按最后登录时间倒序
+func ListDeviceUsers(
+	ctx context.Context, appId, deviceId string) ([]*DeviceLogin, error) {
+	return listDeviceLogins(ctx, appId, bson.M{"device_id": deviceId})
+}
+
+// 用户登录过的设备，按最后登录时间倒序
+func ListUserDevices(
+	ctx context.Context, appId, userId string) ([]*DeviceLogin, error) {
+	return listDeviceLogins(ctx, appId, bson.M{"user_id": userId})
+}
+
+// 设置设备策略，为空时清除
+func SetAppDevicePolicy(
+	ctx context.Context, appId string, p *DevicePolicy) error {
+	if p == nil {
+		return updateApp(ctx, appId,
+			bson.M{"$unset": bson.M{"device_policy": 1}})
+	}
+	if p.MaxNewUsersPerDay < 0 || p.AlertNewUsersPerDay < 0 ||
+		p.AlertUsers < 0 {
+		return newInvalidArgumentError("invalid device policy")
+	}
+	return updateApp(ctx, appId, bson.M{"$set": bson.M{"device_policy": p}})
+}
@@ -0,0 +1,52 @@
+package db
+
+import "testing"
+
+func TestDeviceLogins(t *testing.T) {
+	app, ctx := testSetup(t, &App{
+		Id:           "testdevice",
+		DevicePolicy: &DevicePolicy{MaxNewUsersPerDay: 2},
+	})
+
+	u1, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "dev1", []string{"acct1"}, true, nil)
+	if err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.1", "dev1", []string{"acct2"}, true, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	// 超过限制后不能在设备上创建新用户，已有用户不受影响
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.1", "dev1", []string{"acct3"}, true, nil); err !=
+		ErrDeviceUserLimitExceeded {
+		t.Fatalf("expect device user limit exceeded, but got: %v", err)
+	}
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.2", "dev1", []string{"acct1"}, false, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.1", "dev2", []string{"acct1"}, false, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+
+	users, err := ListDeviceUsers(ctx, app.Id, "dev1")
+	if err != nil {
+		t.Fatalf("failed to list device users: %v", err)
+	}
+	if len(users) != 2 || users[0].UserId != u1.Id ||
+		users[0].LoginCount != 2 || users[0].LastLoginIp != "127.0.0.2" ||
+		!users[0].NewUser {
+		t.Fatalf("unexpected device users: %+v", users)
+	}
+	devices, err := ListUserDevices(ctx, app.Id, u1.Id)
+	if err != nil {
+		t.Fatalf("failed to list user devices: %v", err)
+	}
+	if len(devices) != 2 || devices[0].DeviceId != "dev2" ||
+		devices[0].NewUser {
+		t.Fatalf("unexpected user devices: %+v", devices)
+	}
+}
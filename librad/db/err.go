@@ -57,6 +57,12 @@ func newUnavailableError(msg interface{}) error {
 func newPermissionDeniedError(msg interface{}) error {
 	return newError(codes.PermissionDenied, msg)
 }
+func newFailedPreconditionError(msg interface{}) error {
+	return newError(codes.FailedPrecondition, msg)
+}
+func newResourceExhaustedError(msg interface{}) error {
+	return newError(codes.ResourceExhausted, msg)
+}
 
 func newErrorDetail(code v1pb.ErrorCode, data proto.Message) *v1pb.ErrorDetail {
 	r := &v1pb.ErrorDetail{Code: code}
@@ -71,20 +77,56 @@ var (
 	// NotFound
 	ErrUserNotFound = newNotFoundError("user not found")
 	ErrRoleNotFound = newNotFoundError("role not found")
+	ErrZoneNotFound = newNotFoundError("zone not found")
+
+	ErrRoleNameNotFound = newNotFoundError("role name not found")
+
+	ErrCredentialNotFound = newNotFoundError("credential not found")
+
+	ErrPublisherIdentityNotFound = newNotFoundError("publisher identity not found")
 
 	ErrAcctIdNotFound = newNotFoundError("acct id not found")
 
 	// AlreadyExists
-	ErrAcctAlreadyExists = newAlreadyExistsError("acct already exists")
+	ErrAcctAlreadyExists      = newAlreadyExistsError("acct already exists")
+	ErrRoleIndexAlreadyExists = newAlreadyExistsError("role index already exists")
+	ErrRoleNameAlreadyExists  = newAlreadyExistsError("role name already exists")
+
+	ErrCredentialAlreadyExists = newAlreadyExistsError("credential already exists")
 
 	// InvalidArgument
 	ErrInvalidNonce  = newInvalidArgumentError("invalid nonce")
 	ErrInvalidAppId  = newInvalidArgumentError("invalid app id")
 	ErrInvalidAcctId = newInvalidArgumentError("invalid acct id")
 
+	ErrMetadataTooLarge  = newInvalidArgumentError("metadata too large")
+	ErrSessAttrsTooLarge = newInvalidArgumentError("session attributes too large")
+
+	ErrInvalidOtp          = newInvalidArgumentError("invalid otp")
+	ErrInvalidTransferCode = newInvalidArgumentError("invalid transfer code")
+
+	// FailedPrecondition
+	ErrZoneNotOpen     = newFailedPreconditionError("zone not open")
+	ErrZoneMaintenance = newFailedPreconditionError("zone under maintenance")
+
+	ErrMetadataConflict = newFailedPreconditionError("metadata conflict")
+
+	// ResourceExhausted
+	ErrZoneFull = newResourceExhaustedError("zone full")
+
+	ErrOtpCooldown      = newResourceExhaustedError("otp cooldown")
+	ErrOtpLimitExceeded = newResourceExhaustedError("otp limit exceeded")
+	ErrTooManyAttempts  = newResourceExhaustedError("too many attempts")
+
+	ErrTransferCodeAttemptsExceeded = newResourceExhaustedError("transfer code attempts exceeded")
+
+	ErrDeviceUserLimitExceeded = newResourceExhaustedError("device user limit exceeded")
+
 	// Internal
 	ErrMalformedSessData = newInternalError("malformed session data")
 
 	// Unavailable
 	ErrDatabaseUnavailable = newUnavailableError("database unavailable")
+
+	ErrHookUnavailable = newUnavailableError("hook unavailable")
 )
@@ -0,0 +1,20 @@
+package db
+
+import (
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+)
+
+// 扩展错误码
+// libra-go是单独发布的协议仓库，其中只定义了封禁(70001)，
+// 协议更新前先在这里顺延定义，客户端按数值识别，
+// libra-go补充定义后改为引用其中的值，数值保持不变。
+const (
+	// 维护中
+	ErrorCodeMaintenance v1pb.ErrorCode = 70002
+	// 需要升级客户端
+	ErrorCodeUpgradeRequired v1pb.ErrorCode = 70003
+	// 所在地区不允许登录
+	ErrorCodeRegionDenied v1pb.ErrorCode = 70004
+	// 被钩子否决
+	ErrorCodeHookRejected v1pb.ErrorCode = 70005
+)
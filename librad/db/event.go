@@ -0,0 +1,328 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+	"github.com/ntons/redlock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// 用户事件流
+// 配置了事件流时，用户和角色的状态变化与事件在同一个事务中写入应用的
+// 事件发件箱(libra.outbox)，事件写入失败时状态修改一起回滚；
+// Standalone不支持事务，状态和事件依次写入。没有配置事件流时不写事件。
+// 后台任务按顺序把事件发布到pubsub的Redis流"<应用ID>:<主题>"，发布后删除，
+// Redis暂时不可用时事件保留在发件箱中，恢复后继续发布，超过保留时长后过期。
+// 多个进程通过分布式锁保证同一应用只有一个发布者，
+// 发布后删除前进程退出会重复发布，消费者可以用事件ID去重。
+//
+// 消息格式与pubsub.Publish相同，载荷是google.protobuf.Struct，
+// 包含id、type、app_id、time(毫秒)和事件相关的字段。
+
+// 事件类型
+const (
+	EventUserCreated  = "UserCreated"
+	EventUserLogin    = "UserLogin"
+	EventAcctBound    = "AcctBound"
+	EventAcctUnbound  = "AcctUnbound"
+	EventUserBanned   = "UserBanned"
+	EventRoleCreated  = "RoleCreated"
+	EventRoleSignedIn = "RoleSignedIn"
+)
+
+const (
+	// 事件消息的生产者
+	dbEventProducer = "librad"
+	// 每批发布的事件数
+	dbEventRelayBatch = 100
+	// 发布间隔
+	dbEventRelayInterval = time.Second
+	// 发布锁的有效期
+	dbEventRelayLockTTL = 30 * time.Second
+)
+
+var (
+	rdbEvents redis.Client
+	dlEvents  *redlock.Client
+
+	dbOutboxCollectionMu sync.Mutex
+	dbOutboxCollection   = make(map[string]*mongo.Collection)
+)
+
+type xOutboxEvent struct {
+	Id       primitive.ObjectID     `bson:"_id,omitempty"`
+	Type     string                 `bson:"type"`
+	Data     map[string]interface{} `bson:"data,omitempty"`
+	CreateAt time.Time              `bson:"create_at"`
+}
+
+func getOutboxCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbOutboxCollectionMu.Lock()
+	defer dbOutboxCollectionMu.Unlock()
+
+	if collection, ok := dbOutboxCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.outbox"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	// 发布后没有删除和长期没有发布的事件过期，
+	// 索引在事务外创建，不使用调用方可能带有的会话
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := collection.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys: bson.D{{Key: "create_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(
+				int32(cfg.Events.retention / time.Second)),
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	dbOutboxCollection[appId] = collection
+	return collection, nil
+}
+
+// 修改状态并写入事件，配置了事件流并且支持事务时在事务中执行，
+// fn返回错误时整个事务回滚
+func runEventTx(
+	ctx context.Context, appId string,
+	fn func(ctx context.Context) error) (err error) {
+	if rdbEvents == nil || !mdbTxn {
+		return fn(ctx)
+	}
+	if _, err = getOutboxCollection(ctx, appId); err != nil {
+		log.Warnf("failed to get outbox collection: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return runTx(ctx, fn)
+}
+
+// 在事务中执行，Standalone中不能执行
+func runTx(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	sess, err := mdb.StartSession()
+	if err != nil {
+		log.Warnf("failed to start db session: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	defer sess.EndSession(ctx)
+	var fnErr error
+	if _, err = sess.WithTransaction(
+		ctx,
+		func(ctx mongo.SessionContext) (interface{}, error) {
+			fnErr = fn(ctx)
+			return nil, fnErr
+		},
+	); err != nil && err != fnErr {
+		// 提交失败
+		log.Warnf("failed to commit transaction: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 写入事件，伴随Mongo中的状态修改时在runEventTx中调用，没有配置事件流时忽略
+func emitEvent(
+	ctx context.Context, appId, typ string,
+	data map[string]interface{}) (err error) {
+	if rdbEvents == nil {
+		return
+	}
+	collection, err := getOutboxCollection(ctx, appId)
+	if err != nil {
+		log.Warnf("failed to get outbox collection: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if _, err = collection.InsertOne(ctx, &xOutboxEvent{
+		Type:     typ,
+		Data:     data,
+		CreateAt: time.Now(),
+	}); err != nil {
+		log.Warnw("failed to emit event", "app_id", appId,
+			"type", typ, "data", data, "error", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+func toEventMsg(appId string, x *xOutboxEvent) (_ *v1pb.PubSub_Msg, err error) {
+	fields := map[string]interface{}{
+		"id":     x.Id.Hex(),
+		"type":   x.Type,
+		"app_id": appId,
+		"time":   x.CreateAt.UnixNano() / int64(time.Millisecond),
+	}
+	for k, v := range x.Data {
+		switch v := v.(type) {
+		case primitive.A:
+			fields[k] = []interface{}(v)
+		case time.Time:
+			fields[k] = v.Unix()
+		case primitive.DateTime:
+			fields[k] = v.Time().Unix()
+		default:
+			fields[k] = v
+		}
+	}
+	s, err := structpb.NewStruct(fields)
+	if err != nil {
+		return
+	}
+	a, err := anypb.New(s)
+	if err != nil {
+		return
+	}
+	return &v1pb.PubSub_Msg{
+		Producer:  dbEventProducer,
+		ProduceAt: x.CreateAt.Unix(),
+		Value:     &v1pb.PubSub_Msg_Any{Any: a},
+	}, nil
+}
+
+func publishEvent(ctx context.Context, appId string, x *xOutboxEvent) error {
+	msg, err := toEventMsg(appId, x)
+	if err != nil {
+		// 无法编码的事件记录日志后丢弃，避免阻塞后续事件
+		log.Warnw("failed to encode event", "app_id", appId,
+			"id", x.Id.Hex(), "type", x.Type, "data", x.Data, "error", err)
+		return nil
+	}
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	args := &redis.XAddArgs{
+		Stream: appId + ":" + cfg.Events.Topic,
+		MaxLen: cfg.Events.MaxLen,
+		Approx: true,
+		ID:     "*",
+		Values: []interface{}{"pubsub", base64.StdEncoding.EncodeToString(b)},
+	}
+	return rdbEvents.XAdd(ctx, args).Err()
+}
+
+// 按顺序发布应用的事件，发布失败时停止，下次从失败的事件继续
+func relayEvents(ctx context.Context, appId string) (err error) {
+	lock, err := dlEvents.Obtain(
+		ctx, "outbox$"+appId, dbEventRelayLockTTL)
+	if err != nil {
+		if err == redlock.ErrNotObtained {
+			return nil
+		}
+		return
+	}
+	defer dlEvents.Release(ctx, lock)
+
+	collection, err := getOutboxCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(dbEventRelayLockTTL / 2)
+	for time.Now().Before(deadline) {
+		cursor, err := collection.Find(
+			ctx,
+			bson.M{},
+			options.Find().
+				SetSort(bson.D{{Key: "_id", Value: 1}}).
+				SetLimit(dbEventRelayBatch),
+		)
+		if err != nil {
+			return err
+		}
+		var (
+			n   int
+			ids []interface{}
+		)
+		for ; err == nil && cursor.Next(ctx); n++ {
+			x := &xOutboxEvent{}
+			if e := cursor.Decode(x); e != nil {
+				// 无法解码的事件记录原文后丢弃，避免阻塞后续事件
+				log.Warnw("failed to decode event", "app_id", appId,
+					"raw", cursor.Current.String(), "error", e)
+				ids = append(ids, cursor.Current.Lookup("_id"))
+				continue
+			}
+			if err = publishEvent(ctx, appId, x); err == nil {
+				ids = append(ids, x.Id)
+			}
+		}
+		if e := cursor.Err(); err == nil {
+			err = e
+		}
+		cursor.Close(ctx)
+		if len(ids) > 0 {
+			if _, err := collection.DeleteMany(
+				ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+				return err
+			}
+		}
+		if err != nil || n < dbEventRelayBatch {
+			return err
+		}
+	}
+	return
+}
+
+func serveEventRelay(ctx context.Context) {
+	if rdbEvents == nil {
+		return
+	}
+	for {
+		for _, app := range ListApps() {
+			if err := relayEvents(ctx, app.Id); err != nil {
+				log.Warnf("failed to relay events: %v, %v", app.Id, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dbEventRelayInterval):
+		}
+	}
+}
+
+func toInterfaceSlice(a []string) []interface{} {
+	r := make([]interface{}, 0, len(a))
+	for _, s := range a {
+		r = append(r, s)
+	}
+	return r
+}
+
+// 每个被封禁的用户一个事件，scope为空表示完全封禁
+func emitUserBannedEvents(
+	ctx context.Context, appId, scope, operator string, userIds []string,
+	banTo time.Time, banFor string) (err error) {
+	for _, userId := range userIds {
+		data := map[string]interface{}{
+			"user_id":  userId,
+			"operator": operator,
+			"ban_to":   banTo.Unix(),
+			"ban_for":  banFor,
+		}
+		if scope != "" {
+			data["scope"] = scope
+		}
+		if err = emitEvent(ctx, appId, EventUserBanned, data); err != nil {
+			return
+		}
+	}
+	return
+}
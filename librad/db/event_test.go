@@ -0,0 +1,96 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ntons/redlock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestOutbox(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testoutbox"})
+
+	collection, err := getOutboxCollection(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to get outbox collection: %v", err)
+	}
+	// 发件箱中的事件会过期
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	var specs []bson.M
+	if err = cursor.All(ctx, &specs); err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	var ttl bool
+	for _, spec := range specs {
+		_, ok := spec["expireAfterSeconds"]
+		ttl = ttl || ok
+	}
+	if !ttl {
+		t.Fatal("expect ttl index on outbox")
+	}
+
+	rdb, dl := rdbEvents, dlEvents
+	defer func() { rdbEvents, dlEvents = rdb, dl }()
+
+	// 没有配置事件流时不写事件
+	rdbEvents, dlEvents = nil, nil
+	testLoginUser(t, ctx, app, "acct0")
+	if n, err := collection.CountDocuments(
+		ctx, bson.M{}); err != nil || n != 0 {
+		t.Fatalf("unexpected outbox size: %v, %v", n, err)
+	}
+
+	// 配置事件流后事件写入发件箱
+	rdbEvents, dlEvents = rdbAuth, redlock.New(rdbAuth)
+	user := testLoginUser(t, ctx, app, "acct1")
+	testCreateRole(t, ctx, app.Id, user.Id, 1)
+	if _, err := BanUsers(
+		ctx, app.Id, "admin", []string{user.Id}, 60, "cheat"); err != nil {
+		t.Fatalf("failed to ban users: %v", err)
+	}
+	// 被拒绝的登录没有事件
+	if _, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct1"}, false, nil); err == nil {
+		t.Fatal("expect user banned")
+	}
+
+	cursor, err = collection.Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		t.Fatalf("failed to find events: %v", err)
+	}
+	var events []*xOutboxEvent
+	if err = cursor.All(ctx, &events); err != nil {
+		t.Fatalf("failed to find events: %v", err)
+	}
+	var types []string
+	for _, x := range events {
+		types = append(types, x.Type)
+	}
+	if strings.Join(types, ",") != strings.Join([]string{
+		EventUserCreated, EventUserLogin, EventRoleCreated, EventUserBanned,
+	}, ",") {
+		t.Fatalf("unexpected events: %v", types)
+	}
+
+	// 发布积压的事件，发布后删除
+	stream := app.Id + ":" + cfg.Events.Topic
+	if err = rdbAuth.Del(ctx, stream).Err(); err != nil {
+		t.Fatalf("failed to reset stream: %v", err)
+	}
+	if err = relayEvents(ctx, app.Id); err != nil {
+		t.Fatalf("failed to relay events: %v", err)
+	}
+	if n, err := rdbAuth.XLen(ctx, stream).Result(); err != nil || n != 4 {
+		t.Fatalf("unexpected stream length: %v, %v", n, err)
+	}
+	if n, err := collection.CountDocuments(
+		ctx, bson.M{}); err != nil || n != 0 {
+		t.Fatalf("unexpected outbox size: %v, %v", n, err)
+	}
+}
@@ -0,0 +1,213 @@
+package db
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"github.com/oschwald/maxminddb-golang"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// IP地理位置
+// 使用MaxMind格式的离线数据库解析登录IP的国家和地区，
+// 结果记录在用户和设备登录记录上，并用于按地区限制登录。
+// 数据库整个读入内存，定期检查文件变化并重新加载，替换数据库文件即可更新。
+// 没有配置数据库或解析失败时地理位置为空。
+
+type GeoLocation struct {
+	// ISO 3166-1国家代码，如"CN"
+	Country string `bson:"country,omitempty"`
+	// ISO 3166-2地区代码，如"CN-GD"
+	Region string `bson:"region,omitempty"`
+}
+
+// 按地区限制登录，地区可以是国家代码或地区代码
+type RegionPolicy struct {
+	// 允许的地区，为空时允许所有地区
+	Allow []string `bson:"allow,omitempty"`
+	// 禁止的地区，优先于允许
+	Deny []string `bson:"deny,omitempty"`
+	// 拒绝无法解析地理位置的登录
+	DenyUnknown bool `bson:"deny_unknown,omitempty"`
+	// 展示给玩家的提示
+	Message string `bson:"message,omitempty"`
+}
+
+// 国家的用户数
+type CountryUsers struct {
+	Country string `bson:"_id"`
+	Users   int64  `bson:"users"`
+}
+
+type xGeoRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+type xGeoIP struct {
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+var geoIP = &xGeoIP{}
+
+// 文件有变化时重新加载，加载失败时保留旧的数据库
+func (g *xGeoIP) load(path string) (err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	g.mu.RLock()
+	unchanged := g.reader != nil &&
+		fi.ModTime().Equal(g.modTime) && fi.Size() == g.size
+	g.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return
+	}
+	g.mu.Lock()
+	g.reader, g.modTime, g.size = reader, fi.ModTime(), fi.Size()
+	g.mu.Unlock()
+	log.Infof("geoip database loaded: %s, %s",
+		reader.Metadata.DatabaseType,
+		time.Unix(int64(reader.Metadata.BuildEpoch), 0).Format(time.RFC3339))
+	return
+}
+
+func (g *xGeoIP) lookup(ip string) *GeoLocation {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	g.mu.RLock()
+	reader := g.reader
+	g.mu.RUnlock()
+	if reader == nil {
+		return nil
+	}
+	var r xGeoRecord
+	if err := reader.Lookup(addr, &r); err != nil {
+		log.Warnf("failed to lookup geoip: %v, %v", ip, err)
+		return nil
+	}
+	if r.Country.IsoCode == "" {
+		return nil
+	}
+	x := &GeoLocation{Country: r.Country.IsoCode}
+	if len(r.Subdivisions) > 0 && r.Subdivisions[0].IsoCode != "" {
+		x.Region = r.Country.IsoCode + "-" + r.Subdivisions[0].IsoCode
+	}
+	return x
+}
+
+// 解析IP的地理位置，无法解析时返回nil
+func LookupGeoLocation(ip string) *GeoLocation {
+	return geoIP.lookup(ip)
+}
+
+func serveGeoIP(ctx context.Context) {
+	if cfg.GeoIP.Database == "" {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.GeoIP.reloadInterval):
+		}
+		if err := geoIP.load(cfg.GeoIP.Database); err != nil {
+			log.Warnf("failed to load geoip database: %v", err)
+		}
+	}
+}
+
+func matchRegion(codes []string, geo *GeoLocation) bool {
+	for _, code := range codes {
+		if strings.EqualFold(code, geo.Country) ||
+			(geo.Region != "" && strings.EqualFold(code, geo.Region)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *RegionPolicy) isAllowed(geo *GeoLocation) bool {
+	if geo == nil {
+		return !x.DenyUnknown
+	}
+	if matchRegion(x.Deny, geo) {
+		return false
+	}
+	return len(x.Allow) == 0 || matchRegion(x.Allow, geo)
+}
+
+// 检查登录地区
+func (x *App) checkRegion(geo *GeoLocation) error {
+	p := x.RegionPolicy
+	if p == nil || p.isAllowed(geo) {
+		return nil
+	}
+	data := map[string]interface{}{"message": p.Message}
+	if geo != nil {
+		data["country"] = geo.Country
+		data["region"] = geo.Region
+	}
+	detail, _ := structpb.NewStruct(data)
+	return newPermissionDeniedError(
+		newErrorDetail(ErrorCodeRegionDenied, detail))
+}
+
+// 设置地区限制，为空时清除
+func SetAppRegionPolicy(
+	ctx context.Context, appId string, p *RegionPolicy) error {
+	if p == nil {
+		return updateApp(ctx, appId,
+			bson.M{"$unset": bson.M{"region_policy": 1}})
+	}
+	return updateApp(ctx, appId, bson.M{"$set": bson.M{"region_policy": p}})
+}
+
+// 按最后登录的国家统计用户数，无法解析的国家为空，按用户数倒序
+func CountUsersByCountry(
+	ctx context.Context, appId string) (_ []*CountryUsers, err error) {
+	collection, err := getUserCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Aggregate(ctx, []bson.M{
+		{"$group": bson.M{
+			"_id":   bson.M{"$ifNull": bson.A{"$login_geo.country", ""}},
+			"users": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.D{{Key: "users", Value: -1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var r []*CountryUsers
+	if err = cursor.All(ctx, &r); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return r, nil
+}
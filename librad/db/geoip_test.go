@@ -0,0 +1,67 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRegionPolicy(t *testing.T) {
+	geo := &GeoLocation{Country: "CN", Region: "CN-GD"}
+	for _, c := range []struct {
+		p   *RegionPolicy
+		geo *GeoLocation
+		ok  bool
+	}{
+		{&RegionPolicy{}, nil, true},
+		{&RegionPolicy{DenyUnknown: true}, nil, false},
+		{&RegionPolicy{Allow: []string{"cn"}}, geo, true},
+		{&RegionPolicy{Allow: []string{"US"}}, geo, false},
+		{&RegionPolicy{Allow: []string{"CN"}, Deny: []string{"CN-GD"}}, geo, false},
+	} {
+		if ok := c.p.isAllowed(c.geo); ok != c.ok {
+			t.Errorf("%+v: unexpected result: %v", c.p, ok)
+		}
+	}
+
+	app, ctx := testSetup(t, &App{Id: "testregion"})
+	defer testSaveApp(t, app)()
+
+	u1 := testLoginUser(t, ctx, app, "acct1")
+	testLoginUser(t, ctx, app, "acct2")
+	users, err := getUserCollection(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to get user collection: %v", err)
+	}
+	if _, err = users.UpdateOne(ctx, bson.M{"_id": u1.Id},
+		bson.M{"$set": bson.M{"login_geo": geo}}); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	countries, err := CountUsersByCountry(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to count users: %v", err)
+	}
+	if len(countries) != 2 || countries[0].Country != "" ||
+		countries[1].Country != "CN" || countries[1].Users != 1 {
+		t.Fatalf("unexpected countries: %+v", countries)
+	}
+
+	// 本地地址无法解析地理位置
+	if err = SetAppRegionPolicy(ctx, app.Id,
+		&RegionPolicy{DenyUnknown: true}); err != nil {
+		t.Fatalf("failed to set region policy: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil || app.RegionPolicy == nil {
+		t.Fatal("expect region policy loaded")
+	}
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct1"}, false, nil); err == nil {
+		t.Fatal("expect region denied")
+	}
+	if err = SetAppRegionPolicy(ctx, app.Id, nil); err != nil {
+		t.Fatalf("failed to clear region policy: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil || app.RegionPolicy != nil {
+		t.Fatal("expect region policy cleared")
+	}
+}
@@ -0,0 +1,408 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/ntons/libra/librad/common/util"
+)
+
+// 生命周期钩子
+// 应用可以在用户创建、登录、角色创建和角色登录时回调自己的后端。
+// 前置钩子同步调用，可以否决本次操作；后置钩子在操作成功后异步调用，不影响结果。
+//
+// 事件以JSON发送，使用应用密钥签名：
+// 签名 = hex(HMAC-SHA256(密钥, 时间戳 + "." + 事件JSON))
+//
+// HTTP钩子：POST事件JSON，时间戳和签名在X-Libra-Hook-Timestamp和
+// X-Libra-Hook-Signature头中。2xx表示通过，4xx(408、429除外)表示否决，
+// 否决时只返回状态，响应体仅记录日志，其他状态码和网络错误会重试。
+//
+// gRPC钩子：地址为grpc://host:port/package.Service/Method，TLS使用grpcs://，
+// 请求为google.protobuf.BytesValue(事件JSON)，时间戳和签名在元数据中。
+// 返回成功表示通过，Unavailable、DeadlineExceeded、Aborted、Internal、
+// Unknown会重试，其他错误表示否决，只返回状态码，错误信息仅记录日志。
+//
+// 通过接口设置钩子时，回调地址必须在配置的白名单(hooks.allowedurls)中。
+
+// 钩子事件
+const (
+	HookEventUserCreate = "user.create"
+	HookEventUserLogin  = "user.login"
+	HookEventRoleCreate = "role.create"
+	HookEventRoleSignIn = "role.sign_in"
+)
+
+// 钩子阶段
+const (
+	// 同步调用，可以否决
+	HookPhasePre = "pre"
+	// 异步调用
+	HookPhasePost = "post"
+)
+
+const (
+	dbDefaultHookTimeout = 3 * time.Second
+	dbMaxHookRetries     = 5
+	// 重试间隔的初始值，每次翻倍
+	dbHookRetryBackoff = 100 * time.Millisecond
+	// 同时进行的后置钩子上限，超过时丢弃
+	dbMaxPendingHooks = 1024
+	// 日志中否决原因的最大长度
+	dbMaxHookMessageLen = 256
+	// 返回给客户端的否决原因，不透传钩子的响应
+	dbHookRejectedMessage = "rejected by hook"
+
+	xLibraHookTimestamp = "X-Libra-Hook-Timestamp"
+	xLibraHookSignature = "X-Libra-Hook-Signature"
+)
+
+type Hook struct {
+	// 事件
+	Event string `bson:"event"`
+	// 阶段
+	Phase string `bson:"phase"`
+	// 回调地址
+	Url string `bson:"url"`
+	// 单次调用的超时(毫秒)，为0时使用默认值
+	Timeout int64 `bson:"timeout,omitempty"`
+	// 失败重试次数
+	Retries int `bson:"retries,omitempty"`
+	// 前置钩子不可用时放行，否则拒绝
+	FailOpen bool `bson:"fail_open,omitempty"`
+	// 解析后的地址
+	u *url.URL
+}
+
+// 钩子事件数据
+type HookEvent struct {
+	// 事件ID，重试时不变，可以用于去重
+	Id        string `json:"id"`
+	Event     string `json:"event"`
+	AppId     string `json:"app_id"`
+	UserId    string `json:"user_id,omitempty"`
+	RoleId    string `json:"role_id,omitempty"`
+	RoleIndex uint32 `json:"role_index,omitempty"`
+	ClientIp  string `json:"client_ip,omitempty"`
+	DeviceId  string `json:"device_id,omitempty"`
+	// 事件时间(毫秒)
+	Time int64 `json:"time"`
+}
+
+// 钩子调用的错误，被否决时不重试
+type xHookError struct {
+	msg      string
+	rejected bool
+	// 被否决时的HTTP状态或gRPC状态码
+	status string
+}
+
+func (e *xHookError) Error() string { return e.msg }
+
+var (
+	hookHttpClient = &http.Client{}
+
+	hookGrpcConnsMu sync.Mutex
+	hookGrpcConns   = make(map[string]*grpc.ClientConn)
+
+	hookPending = make(chan struct{}, dbMaxPendingHooks)
+)
+
+func (x *Hook) parse() (err error) {
+	switch x.Event {
+	case HookEventUserCreate, HookEventUserLogin,
+		HookEventRoleCreate, HookEventRoleSignIn:
+	default:
+		return fmt.Errorf("invalid hook event: %s", x.Event)
+	}
+	switch x.Phase {
+	case HookPhasePre, HookPhasePost:
+	default:
+		return fmt.Errorf("invalid hook phase: %s", x.Phase)
+	}
+	if x.Timeout < 0 || x.Retries < 0 || x.Retries > dbMaxHookRetries {
+		return fmt.Errorf("invalid hook timeout or retries: %s", x.Url)
+	}
+	if x.u, err = url.Parse(x.Url); err != nil {
+		return
+	}
+	switch x.u.Scheme {
+	case "http", "https":
+	case "grpc", "grpcs":
+		if x.u.Host == "" || strings.Count(x.u.Path, "/") != 2 {
+			return fmt.Errorf("invalid grpc hook url: %s", x.Url)
+		}
+	default:
+		return fmt.Errorf("invalid hook url: %s", x.Url)
+	}
+	return
+}
+
+func (x *Hook) getTimeout() time.Duration {
+	if x.Timeout > 0 {
+		return time.Duration(x.Timeout) * time.Millisecond
+	}
+	return dbDefaultHookTimeout
+}
+
+func (x *App) hasHook(event, phase string) bool {
+	for _, h := range x.Hooks {
+		if h.Event == event && h.Phase == phase {
+			return true
+		}
+	}
+	return false
+}
+
+func signHookEvent(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, util.StringToBytes(secret))
+	mac.Write(util.StringToBytes(strconv.FormatInt(ts, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getHookGrpcConn(u *url.URL) (_ *grpc.ClientConn, err error) {
+	hookGrpcConnsMu.Lock()
+	defer hookGrpcConnsMu.Unlock()
+	key := u.Scheme + "://" + u.Host
+	if conn, ok := hookGrpcConns[key]; ok {
+		return conn, nil
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return
+	}
+	hookGrpcConns[key] = conn
+	return conn, nil
+}
+
+func truncateHookMessage(msg string) string {
+	if len(msg) > dbMaxHookMessageLen {
+		return msg[:dbMaxHookMessageLen]
+	}
+	return msg
+}
+
+func callHttpHook(
+	ctx context.Context, h *Hook, ts int64, sig string, body []byte) error {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, h.Url, bytes.NewReader(body))
+	if err != nil {
+		return &xHookError{msg: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(xLibraHookTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(xLibraHookSignature, sig)
+	resp, err := hookHttpClient.Do(req)
+	if err != nil {
+		return &xHookError{msg: err.Error()}
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, dbMaxHookMessageLen))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout &&
+		resp.StatusCode != http.StatusTooManyRequests:
+		msg := string(b)
+		if msg == "" {
+			msg = resp.Status
+		}
+		return &xHookError{msg: msg, rejected: true, status: resp.Status}
+	default:
+		return &xHookError{msg: resp.Status}
+	}
+}
+
+func callGrpcHook(
+	ctx context.Context, h *Hook, ts int64, sig string, body []byte) error {
+	conn, err := getHookGrpcConn(h.u)
+	if err != nil {
+		return &xHookError{msg: err.Error()}
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		strings.ToLower(xLibraHookTimestamp), strconv.FormatInt(ts, 10),
+		strings.ToLower(xLibraHookSignature), sig)
+	if err = conn.Invoke(
+		ctx, h.u.Path, wrapperspb.Bytes(body), &emptypb.Empty{}); err != nil {
+		s := status.Convert(err)
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted,
+			codes.Internal, codes.Unknown, codes.Canceled:
+			return &xHookError{msg: s.Message()}
+		default:
+			return &xHookError{
+				msg:      truncateHookMessage(s.Message()),
+				rejected: true,
+				status:   s.Code().String(),
+			}
+		}
+	}
+	return nil
+}
+
+// 调用钩子，失败时按配置重试
+func callHook(ctx context.Context, app *App, h *Hook, body []byte) (err error) {
+	backoff := dbHookRetryBackoff
+	for i := 0; ; i++ {
+		ts := time.Now().Unix()
+		sig := signHookEvent(app.Secret, ts, body)
+		err = func() error {
+			ctx, cancel := context.WithTimeout(ctx, h.getTimeout())
+			defer cancel()
+			if h.u.Scheme == "grpc" || h.u.Scheme == "grpcs" {
+				return callGrpcHook(ctx, h, ts, sig, body)
+			}
+			return callHttpHook(ctx, h, ts, sig, body)
+		}()
+		if err == nil || err.(*xHookError).rejected || i >= h.Retries {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func newHookEvent(app *App, event string, e *HookEvent) (*HookEvent, []byte) {
+	x := *e
+	x.Id = primitive.NewObjectID().Hex()
+	x.Event = event
+	x.AppId = app.Id
+	x.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	b, _ := json.Marshal(&x)
+	return &x, b
+}
+
+// 依次调用前置钩子，被否决时返回错误
+func runPreHooks(
+	ctx context.Context, app *App, event string, e *HookEvent) error {
+	if !app.hasHook(event, HookPhasePre) {
+		return nil
+	}
+	e, body := newHookEvent(app, event, e)
+	for _, h := range app.Hooks {
+		if h.Event != event || h.Phase != HookPhasePre {
+			continue
+		}
+		err := callHook(ctx, app, h, body)
+		if err == nil {
+			continue
+		}
+		if x := err.(*xHookError); x.rejected {
+			log.Infow("hook rejected", "app_id", app.Id, "event", event,
+				"event_id", e.Id, "url", h.Url, "reason", x.msg)
+			detail, _ := structpb.NewStruct(map[string]interface{}{
+				"event":   event,
+				"status":  x.status,
+				"message": dbHookRejectedMessage,
+			})
+			return newPermissionDeniedError(
+				newErrorDetail(ErrorCodeHookRejected, detail))
+		}
+		log.Warnw("failed to call hook", "app_id", app.Id, "event", event,
+			"event_id", e.Id, "url", h.Url, "error", err)
+		if !h.FailOpen {
+			return ErrHookUnavailable
+		}
+	}
+	return nil
+}
+
+// 异步调用后置钩子，积压过多时丢弃
+func runPostHooks(app *App, event string, e *HookEvent) {
+	if !app.hasHook(event, HookPhasePost) {
+		return
+	}
+	e, body := newHookEvent(app, event, e)
+	for _, h := range app.Hooks {
+		if h.Event != event || h.Phase != HookPhasePost {
+			continue
+		}
+		select {
+		case hookPending <- struct{}{}:
+		default:
+			log.Warnw("too many pending hooks", "app_id", app.Id,
+				"event", event, "event_id", e.Id, "url", h.Url)
+			continue
+		}
+		go func(h *Hook) {
+			defer func() { <-hookPending }()
+			if err := callHook(
+				context.Background(), app, h, body); err != nil {
+				log.Warnw("failed to call hook", "app_id", app.Id,
+					"event", event, "event_id", e.Id, "url", h.Url,
+					"error", err)
+			}
+		}(h)
+	}
+}
+
+// 回调地址是否在白名单中，避免应用密钥被用于访问内部服务
+func isHookUrlAllowed(u *url.URL) bool {
+	for _, a := range cfg.Hooks.allowedUrls {
+		if u.Scheme != a.Scheme || u.User != nil {
+			continue
+		}
+		if strings.HasPrefix(a.Host, "*.") {
+			if strings.HasSuffix(u.Host, a.Host[1:]) {
+				return true
+			}
+		} else if u.Host == a.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// 设置应用的钩子，为空时清除
+func SetAppHooks(ctx context.Context, appId string, hooks []*Hook) error {
+	if len(hooks) == 0 {
+		return updateApp(ctx, appId, bson.M{"$unset": bson.M{"hooks": 1}})
+	}
+	for _, h := range hooks {
+		if err := h.parse(); err != nil {
+			return newInvalidArgumentError(err.Error())
+		}
+		if !isHookUrlAllowed(h.u) {
+			return newPermissionDeniedError(
+				fmt.Sprintf("hook url not allowed: %s", h.Url))
+		}
+	}
+	return updateApp(ctx, appId, bson.M{"$set": bson.M{"hooks": hooks}})
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testhooks", Secret: "s3cret"})
+	defer testSaveApp(t, app)()
+
+	// 验证签名，否决设备bad上的新用户
+	var called int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			body, _ := io.ReadAll(r.Body)
+			ts, _ := strconv.ParseInt(r.Header.Get(xLibraHookTimestamp), 10, 64)
+			if r.Header.Get(xLibraHookSignature) !=
+				signHookEvent(app.Secret, ts, body) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			e := &HookEvent{}
+			if err := json.Unmarshal(body, e); err != nil ||
+				e.Event != HookEventUserCreate || e.AppId != app.Id {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if e.DeviceId == "bad" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("rejected"))
+			}
+		}))
+	defer srv.Close()
+
+	if err := SetAppHooks(ctx, app.Id, []*Hook{{
+		Event: "unknown", Phase: HookPhasePre, Url: srv.URL,
+	}}); err == nil {
+		t.Fatal("expect invalid hook")
+	}
+	// 回调地址必须在白名单中
+	allowed := cfg.Hooks.AllowedUrls
+	defer func() {
+		cfg.Hooks.AllowedUrls = allowed
+		cfg.parse()
+	}()
+	if err := SetAppHooks(ctx, app.Id, []*Hook{{
+		Event: HookEventUserCreate, Phase: HookPhasePre, Url: srv.URL,
+	}}); err == nil {
+		t.Fatal("expect hook url not allowed")
+	}
+	cfg.Hooks.AllowedUrls = []string{"http://" + srv.Listener.Addr().String()}
+	if err := cfg.parse(); err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if err := SetAppHooks(ctx, app.Id, []*Hook{{
+		Event: HookEventUserCreate, Phase: HookPhasePre, Url: srv.URL,
+	}}); err != nil {
+		t.Fatalf("failed to set hooks: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil || len(app.Hooks) != 1 {
+		t.Fatal("expect hooks loaded")
+	}
+	if _, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "bad", []string{"acct1"}, true, nil); err == nil ||
+		err == ErrUserNotFound {
+		t.Fatalf("expect hook rejected, but got: %v", err)
+	}
+	if _, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "good", []string{"acct1"}, true, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	// 已有用户登录不调用创建钩子
+	if _, _, err := LoginUser(
+		ctx, app, "127.0.0.1", "bad", []string{"acct1"}, true, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	if n := atomic.LoadInt32(&called); n != 2 {
+		t.Fatalf("unexpected hook calls: %v", n)
+	}
+
+	if err := SetAppHooks(ctx, app.Id, nil); err != nil {
+		t.Fatalf("failed to clear hooks: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil || len(app.Hooks) != 0 {
+		t.Fatal("expect hooks cleared")
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 // userId{10}: appKey{4}+rand{5}+rand{1}&0xF0|0x1
 // roleId{10}: appKey{4}+rand{5}+rand{1}&0xF0|0x2
+// publisherIdentityId{10}: 0{4}+rand{5}+rand{1}&0xF0|0x3
 
 const (
 	rawIdLen    = 10
@@ -35,6 +36,8 @@ const (
 const (
 	UserIdTag uint8 = 0x1
 	RoleIdTag uint8 = 0x2
+
+	PublisherIdentityIdTag uint8 = 0x3
 )
 
 // generate id
@@ -79,6 +82,9 @@ func idBelongToApp(app *App, ids ...string) bool {
 func newUserId(appKey uint32) string { return newId(appKey, UserIdTag) }
 func newRoleId(appKey uint32) string { return newId(appKey, RoleIdTag) }
 
+// 发行商身份不属于任何应用
+func newPublisherIdentityId() string { return newId(0, PublisherIdentityIdTag) }
+
 func newToken(app *App, id string) (string, error) {
 	raw, err := newTokenV1(app, id)
 	if err != nil {
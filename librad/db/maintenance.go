@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/ntons/log-go"
+	"github.com/vmihailenco/msgpack/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// 维护模式
+// 维护窗口保存在应用上，维护期间登录和鉴权返回维护错误，
+// 白名单中的用户和IP不受影响，方便维护期间验证。
+// 指定角色索引时只维护这些区服，登录不受影响，绑定了这些区服角色的会话鉴权失败。
+// 其他进程在下次加载应用时生效，开启时可以同时踢出在线的会话。
+
+// 踢出会话时每批读取的会话数
+const dbMaintenanceKickBatch = 500
+
+type Maintenance struct {
+	// 开始时间，为空时立即开始
+	StartAt time.Time `bson:"start_at,omitempty"`
+	// 结束时间，为空时持续到关闭
+	EndAt time.Time `bson:"end_at,omitempty"`
+	// 展示给玩家的维护公告
+	Message string `bson:"message,omitempty"`
+	// 维护的角色索引，为空时维护整个应用
+	RoleIndexes []uint32 `bson:"role_indexes,omitempty"`
+	// 白名单用户ID
+	AllowUserIds []string `bson:"allow_user_ids,omitempty"`
+	// 白名单IP，可以是CIDR
+	AllowIps []string `bson:"allow_ips,omitempty"`
+	// 解析后的白名单IP
+	allowNets []*net.IPNet
+}
+
+func parseIpOrCidr(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (x *Maintenance) parse() (err error) {
+	x.allowNets = nil
+	for _, s := range x.AllowIps {
+		var n *net.IPNet
+		if n, err = parseIpOrCidr(s); err != nil {
+			return
+		}
+		x.allowNets = append(x.allowNets, n)
+	}
+	return
+}
+
+func (x *Maintenance) IsActive(now time.Time) bool {
+	return !now.Before(x.StartAt) && (x.EndAt.IsZero() || now.Before(x.EndAt))
+}
+
+func (x *Maintenance) isRoleIndexAffected(roleIndex uint32) bool {
+	for _, i := range x.RoleIndexes {
+		if i == roleIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *Maintenance) isAllowed(userId, clientIp string) bool {
+	if userId != "" && containsString(x.AllowUserIds, userId) {
+		return true
+	}
+	if ip := net.ParseIP(clientIp); ip != nil {
+		for _, n := range x.allowNets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (x *Maintenance) newError() error {
+	data := map[string]interface{}{"message": x.Message}
+	if !x.StartAt.IsZero() {
+		data["start_at"] = x.StartAt.Unix()
+	}
+	if !x.EndAt.IsZero() {
+		data["end_at"] = x.EndAt.Unix()
+	}
+	if len(x.RoleIndexes) > 0 {
+		indexes := make([]interface{}, 0, len(x.RoleIndexes))
+		for _, i := range x.RoleIndexes {
+			indexes = append(indexes, i)
+		}
+		data["role_indexes"] = indexes
+	}
+	detail, _ := structpb.NewStruct(data)
+	return newUnavailableError(newErrorDetail(ErrorCodeMaintenance, detail))
+}
+
+// 检查维护状态，roleIndex为nil表示没有绑定角色
+func (x *App) checkMaintenance(
+	userId, clientIp string, roleIndex *uint32) error {
+	m := x.Maintenance
+	if m == nil || !m.IsActive(time.Now()) {
+		return nil
+	}
+	if len(m.RoleIndexes) > 0 &&
+		(roleIndex == nil || !m.isRoleIndexAffected(*roleIndex)) {
+		return nil
+	}
+	if m.isAllowed(userId, clientIp) {
+		return nil
+	}
+	return m.newError()
+}
+
+// 鉴权时检查维护状态
+func (s *Sess) CheckMaintenance(clientIp string) error {
+	var roleIndex *uint32
+	if s.Data.RoleId != "" {
+		roleIndex = &s.Data.RoleIndex
+	}
+	return s.App.checkMaintenance(s.UserId, clientIp, roleIndex)
+}
+
+// 开启或关闭维护，m为nil时关闭。
+// kick为真且维护已经开始时，踢出受影响的在线会话，返回踢出的数量。
+// 会话中没有IP，白名单IP的会话也会被踢出，重新登录即可。
+func SetAppMaintenance(
+	ctx context.Context, appId string, m *Maintenance, kick bool) (
+	_ int, err error) {
+	if m != nil {
+		if err = m.parse(); err != nil {
+			return 0, newInvalidArgumentError(err.Error())
+		}
+		if !m.EndAt.IsZero() && !m.EndAt.After(m.StartAt) {
+			return 0, newInvalidArgumentError("invalid maintenance window")
+		}
+	}
+	update := bson.M{"$unset": bson.M{"maintenance": 1}}
+	if m != nil {
+		update = bson.M{"$set": bson.M{"maintenance": m}}
+	}
+	if err = updateApp(ctx, appId, update); err != nil {
+		return
+	}
+	if m == nil || !kick || !m.IsActive(time.Now()) {
+		return 0, nil
+	}
+	return kickMaintenanceSess(ctx, appId, m)
+}
+
+// 踢出维护影响的在线会话
+func kickMaintenanceSess(
+	ctx context.Context, appId string, m *Maintenance) (n int, err error) {
+	userIds, err := rdbAuth.ZRange(ctx, getUserOnlineKey(appId), 0, -1).Result()
+	if err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return 0, ErrDatabaseUnavailable
+	}
+	for len(userIds) > 0 {
+		batch := userIds
+		if len(batch) > dbMaintenanceKickBatch {
+			batch = batch[:dbMaintenanceKickBatch]
+		}
+		userIds = userIds[len(batch):]
+
+		cmds, err := rdbAuth.Pipelined(ctx, func(p redis.Pipeliner) error {
+			for _, userId := range batch {
+				p.Get(ctx, userId)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			log.Warnf("failed to access redis: %v", err)
+			return n, ErrDatabaseUnavailable
+		}
+		var kicked []string
+		for i, cmd := range cmds {
+			b, err := cmd.(*redis.StringCmd).Bytes()
+			if err != nil {
+				continue
+			}
+			if containsString(m.AllowUserIds, batch[i]) {
+				continue
+			}
+			if len(m.RoleIndexes) > 0 {
+				s := &Sess{}
+				if err := msgpack.Unmarshal(b, s); err != nil ||
+					s.Data.RoleId == "" ||
+					!m.isRoleIndexAffected(s.Data.RoleIndex) {
+					continue
+				}
+			}
+			kicked = append(kicked, batch[i])
+		}
+		if err = LogoutUser(ctx, kicked...); err != nil {
+			return n, err
+		}
+		n += len(kicked)
+	}
+	return
+}
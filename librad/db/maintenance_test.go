@@ -0,0 +1,74 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testmaintenance"})
+
+	// 维护窗口保存在应用配置上
+	defer testSaveApp(t, app)()
+	if err := rdbAuth.Del(ctx, getUserOnlineKey(app.Id)).Err(); err != nil {
+		t.Fatalf("failed to reset presence: %v", err)
+	}
+
+	_, s1, err := LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct1"}, true, nil)
+	if err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	u2, s2, err := LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct2"}, true, nil)
+	if err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+
+	now := time.Now()
+	if _, err = SetAppMaintenance(ctx, app.Id, &Maintenance{
+		StartAt: now,
+		EndAt:   now.Add(-time.Minute),
+	}, false); err == nil {
+		t.Fatal("expect invalid maintenance window")
+	}
+	// 白名单用户不会被踢出，也可以登录
+	n, err := SetAppMaintenance(ctx, app.Id, &Maintenance{
+		Message:      "maintenance",
+		AllowUserIds: []string{u2.Id},
+	}, true)
+	if err != nil {
+		t.Fatalf("failed to set maintenance: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected kicked: %v", n)
+	}
+	if _, err = CheckToken(ctx, s1.Token); err == nil {
+		t.Fatal("expect session kicked")
+	}
+	if _, err = CheckToken(ctx, s2.Token); err != nil {
+		t.Fatalf("failed to check token: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil || app.Maintenance == nil {
+		t.Fatal("expect maintenance loaded")
+	}
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct1"}, false, nil); err == nil {
+		t.Fatal("expect maintenance error")
+	}
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct2"}, false, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+
+	if _, err = SetAppMaintenance(ctx, app.Id, nil, false); err != nil {
+		t.Fatalf("failed to clear maintenance: %v", err)
+	}
+	if app = FindAppById(app.Id); app == nil || app.Maintenance != nil {
+		t.Fatal("expect maintenance cleared")
+	}
+	if _, _, err = LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct1"}, false, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 元数据查询
+// 只能按照应用声明的索引键查询，结果按(值,ID)排序，通过游标翻页。
+// 索引在后台定期加载应用配置后创建，创建完成之前查询不使用索引。
+
+const (
+	dbDefaultMetadataPageSize = 100
+	dbMaxMetadataPageSize     = 1000
+)
+
+// 元数据查询条件，Eq、Prefix、范围三选一
+// 范围为左闭右开区间，Min和Max可以只给一个。
+// 元数据的值都是字符串，范围按字节序比较，数值需要补齐到相同长度才能按大小查询，
+// 比如"9"大于"10"，而"09"小于"10"
+type MetadataFilter struct {
+	Key    string
+	Eq     string
+	Prefix string
+	Min    string
+	Max    string
+}
+
+func (x *MetadataFilter) toBson() (_ bson.M, err error) {
+	cond := bson.M{}
+	switch {
+	case x.Eq != "":
+		if x.Prefix != "" || x.Min != "" || x.Max != "" {
+			return nil, newInvalidArgumentError("ambiguous metadata filter")
+		}
+		return bson.M{"metadata." + x.Key: x.Eq}, nil
+	case x.Prefix != "":
+		if x.Min != "" || x.Max != "" {
+			return nil, newInvalidArgumentError("ambiguous metadata filter")
+		}
+		cond["$regex"] = "^" + regexp.QuoteMeta(x.Prefix)
+	case x.Min != "" || x.Max != "":
+		if x.Min != "" {
+			cond["$gte"] = x.Min
+		}
+		if x.Max != "" {
+			cond["$lt"] = x.Max
+		}
+	default:
+		// 所有设置了该键的文档
+		cond["$exists"] = true
+	}
+	return bson.M{"metadata." + x.Key: cond}, nil
+}
+
+// 元数据键不能包含Mongo路径的特殊字符
+func isValidMetadataKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, ".$")
+}
+
+func (x *App) isIndexedMetadataKey(key string) bool {
+	for _, k := range x.IndexedMetadataKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	xMetadataIndexesMu sync.Mutex
+	xMetadataIndexes   = make(map[string]bool)
+)
+
+// 创建元数据索引，同一进程只创建一次
+func ensureMetadataIndex(
+	ctx context.Context, collection *mongo.Collection, key string) (err error) {
+	name := collection.Database().Name() + "." + collection.Name() + "/" + key
+	xMetadataIndexesMu.Lock()
+	defer xMetadataIndexesMu.Unlock()
+	if xMetadataIndexes[name] {
+		return
+	}
+	if _, err = collection.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "metadata." + key, Value: 1},
+				{Key: "_id", Value: 1},
+			},
+			Options: options.Index().SetPartialFilterExpression(
+				bson.M{"metadata." + key: bson.M{"$exists": true}}),
+		},
+	); err != nil {
+		return fmt.Errorf("failed to create metadata index: %v, %w", name, err)
+	}
+	xMetadataIndexes[name] = true
+	return
+}
+
+// 为应用声明的元数据键创建索引，随应用列表的加载定期调用，失败的下次重试
+func ensureMetadataIndexes(ctx context.Context, apps []*App) {
+	for _, app := range apps {
+		if len(app.IndexedMetadataKeys) == 0 {
+			continue
+		}
+		users, err := getUserCollection(ctx, app.Id)
+		if err != nil {
+			log.Warnf("failed to get user collection: %v, %v", app.Id, err)
+			continue
+		}
+		roles, err := getRoleCollection(ctx, app.Id)
+		if err != nil {
+			log.Warnf("failed to get role collection: %v, %v", app.Id, err)
+			continue
+		}
+		for _, key := range app.IndexedMetadataKeys {
+			if !isValidMetadataKey(key) {
+				continue
+			}
+			for _, collection := range []*mongo.Collection{users, roles} {
+				if err = ensureMetadataIndex(ctx, collection, key); err != nil {
+					log.Warnf("%v", err)
+				}
+			}
+		}
+	}
+}
+
+// 游标为最后一条结果的(值,ID)
+func encMetadataCursor(val, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(val + "\x00" + id))
+}
+func decMetadataCursor(cursor string) (val, id string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", newInvalidArgumentError("invalid cursor")
+	}
+	a := strings.SplitN(string(b), "\x00", 2)
+	if len(a) != 2 {
+		return "", "", newInvalidArgumentError("invalid cursor")
+	}
+	return a[0], a[1], nil
+}
+
+func getMetadataPageSize(limit int) int {
+	if limit <= 0 {
+		return dbDefaultMetadataPageSize
+	} else if limit > dbMaxMetadataPageSize {
+		return dbMaxMetadataPageSize
+	}
+	return limit
+}
+
+func queryByMetadata(
+	ctx context.Context, appId string, collection *mongo.Collection,
+	filter *MetadataFilter, extra bson.M, cursor string, limit int,
+	results interface{}) (err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return ErrInvalidAppId
+	}
+	if filter == nil || !isValidMetadataKey(filter.Key) {
+		return newInvalidArgumentError("invalid metadata key")
+	}
+	if !app.isIndexedMetadataKey(filter.Key) {
+		return newInvalidArgumentError("metadata key not indexed")
+	}
+	cond, err := filter.toBson()
+	if err != nil {
+		return
+	}
+	and := bson.A{cond}
+	if len(extra) > 0 {
+		and = append(and, extra)
+	}
+	if cursor != "" {
+		var val, id string
+		if val, id, err = decMetadataCursor(cursor); err != nil {
+			return
+		}
+		field := "metadata." + filter.Key
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{field: bson.M{"$gt": val}},
+			bson.M{field: val, "_id": bson.M{"$gt": id}},
+		}})
+	}
+	cur, err := collection.Find(
+		ctx,
+		bson.M{"$and": and},
+		options.Find().
+			SetSort(bson.D{
+				{Key: "metadata." + filter.Key, Value: 1},
+				{Key: "_id", Value: 1},
+			}).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		log.Warnf("failed to query by metadata: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if err = cur.All(ctx, results); err != nil {
+		log.Warnf("failed to decode query results: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 按元数据查询用户，没有更多结果时next为空
+func QueryUsersByMetadata(
+	ctx context.Context, appId string, filter *MetadataFilter,
+	cursor string, limit int) (_ []*User, next string, err error) {
+	collection, err := getUserCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	limit = getMetadataPageSize(limit)
+	var users []*User
+	if err = queryByMetadata(
+		ctx, appId, collection, filter, nil, cursor, limit, &users); err != nil {
+		return
+	}
+	if err = fillUserBans(ctx, appId, users...); err != nil {
+		return
+	}
+	if n := len(users); n > 0 && n == limit {
+		last := users[n-1]
+		next = encMetadataCursor(last.Metadata[filter.Key], last.Id)
+	}
+	return users, next, nil
+}
+
+// 按元数据查询角色，不包括已删除的角色
+func QueryRolesByMetadata(
+	ctx context.Context, appId string, filter *MetadataFilter,
+	cursor string, limit int) (_ []*Role, next string, err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	limit = getMetadataPageSize(limit)
+	var roles []*Role
+	if err = queryByMetadata(
+		ctx, appId, collection, filter, dbRoleAliveFilter,
+		cursor, limit, &roles); err != nil {
+		return
+	}
+	if n := len(roles); n > 0 && n == limit {
+		last := roles[n-1]
+		next = encMetadataCursor(last.Metadata[filter.Key], last.Id)
+	}
+	return roles, next, nil
+}
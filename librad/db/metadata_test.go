@@ -0,0 +1,78 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestQueryRolesByMetadata(t *testing.T) {
+	app, ctx := testSetup(t, &App{
+		Id:                  "testmetadataquery",
+		IndexedMetadataKeys: []string{"guild"},
+	})
+
+	// 索引在后台创建
+	ensureMetadataIndexes(ctx, []*App{app})
+	collection, err := getRoleCollection(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to get role collection: %v", err)
+	}
+	cur, err := collection.Indexes().List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	var specs []bson.M
+	if err = cur.All(ctx, &specs); err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	var indexed bool
+	for _, spec := range specs {
+		indexed = indexed || spec["name"] == "metadata.guild_1__id_1"
+	}
+	if !indexed {
+		t.Fatalf("expect metadata index: %v", specs)
+	}
+
+	for i, guild := range []string{"a1", "a2", "a3", "b1"} {
+		role := testCreateRole(t, ctx, app.Id, "testuser", uint32(i+1))
+		if err := SetRoleMetadata(ctx, app.Id, role.Id, map[string]string{
+			"guild": guild,
+			"other": guild,
+		}); err != nil {
+			t.Fatalf("failed to set role metadata: %v", err)
+		}
+	}
+	if _, _, err := QueryRolesByMetadata(
+		ctx, app.Id, &MetadataFilter{Key: "other", Eq: "a1"}, "", 0); err == nil {
+		t.Fatalf("expect error when querying not indexed key")
+	}
+	// 分页取出所有前缀为a的角色
+	var guilds []string
+	var cursor string
+	for {
+		roles, next, err := QueryRolesByMetadata(
+			ctx, app.Id, &MetadataFilter{Key: "guild", Prefix: "a"}, cursor, 2)
+		if err != nil {
+			t.Fatalf("failed to query roles: %v", err)
+		}
+		for _, role := range roles {
+			guilds = append(guilds, role.Metadata["guild"])
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(guilds) != 3 || guilds[0] != "a1" || guilds[2] != "a3" {
+		t.Fatalf("unexpected query results: %v", guilds)
+	}
+	roles, _, err := QueryRolesByMetadata(
+		ctx, app.Id, &MetadataFilter{Key: "guild", Min: "a2", Max: "b1"}, "", 0)
+	if err != nil {
+		t.Fatalf("failed to query roles: %v", err)
+	}
+	if len(roles) != 2 {
+		t.Fatalf("unexpected query results: %v", len(roles))
+	}
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 元数据更新
+// 只有设置和删除的更新直接使用$set和$unset写入；
+// 带有期望值或增量的更新需要先读取当前值，
+// 文档上的metadata_rev在每次更新时递增，写入时以读到的版本为条件，
+// 版本变化说明有并发修改，重新读取后再次尝试。
+
+// 并发冲突时的最大重试次数
+const dbMaxMetadataUpdateRetry = 8
+
+// 元数据操作
+type MetadataOp struct {
+	Key string
+	// 期望的当前值，为nil时不检查，指向空串时要求键不存在
+	Expect *string
+	// 新值，为空时删除
+	Value string
+	// 数值增量，非0时忽略Value，当前值必须是整数，不存在视为0
+	Incr int64
+}
+
+type xMetadataDoc struct {
+	Metadata map[string]string `bson:"metadata,omitempty"`
+	Rev      int64             `bson:"metadata_rev,omitempty"`
+}
+
+func getMetadataSize(md map[string]string) (n int) {
+	for key, val := range md {
+		n += len(key) + len(val)
+	}
+	return
+}
+
+// 超过上限的文档依然可以缩小
+func checkMetadataSize(oldSize, newSize int) error {
+	if newSize > cfg.MaxMetadataSize && newSize > oldSize {
+		return ErrMetadataTooLarge
+	}
+	return nil
+}
+
+func updateMetadata(
+	ctx context.Context, collection *mongo.Collection, filter bson.M,
+	notFound error, ops []*MetadataOp) (_ map[string]string, err error) {
+	conditional := false
+	for _, op := range ops {
+		if !isValidMetadataKey(op.Key) {
+			return nil, newInvalidArgumentError("invalid metadata key")
+		}
+		if op.Expect != nil || op.Incr != 0 {
+			conditional = true
+		}
+	}
+	if !conditional {
+		return setMetadata(ctx, collection, filter, notFound, ops)
+	}
+	return casMetadata(ctx, collection, filter, notFound, ops)
+}
+
+// 直接写入，不以版本为条件，大小上限按写入前读到的元数据检查，
+// 并发写入时可能略微超过上限
+func setMetadata(
+	ctx context.Context, collection *mongo.Collection, filter bson.M,
+	notFound error, ops []*MetadataOp) (_ map[string]string, err error) {
+	doc := &xMetadataDoc{}
+	if err = collection.FindOne(
+		ctx,
+		filter,
+		options.FindOne().SetProjection(bson.M{"metadata": 1}),
+	).Decode(doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, notFound
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	md := make(map[string]string, len(doc.Metadata))
+	for key, val := range doc.Metadata {
+		md[key] = val
+	}
+	set, unset := bson.M{}, bson.M{}
+	for _, op := range ops {
+		if op.Value != "" {
+			md[op.Key] = op.Value
+			set["metadata."+op.Key] = op.Value
+		} else {
+			delete(md, op.Key)
+			unset["metadata."+op.Key] = 1
+		}
+	}
+	if err = checkMetadataSize(
+		getMetadataSize(doc.Metadata), getMetadataSize(md)); err != nil {
+		return
+	}
+	// 递增版本，让并发的条件更新重试
+	update := bson.M{"$inc": bson.M{"metadata_rev": 1}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if err = collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().
+			SetProjection(bson.M{"metadata": 1}).
+			SetReturnDocument(options.After),
+	).Decode(doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, notFound
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return doc.Metadata, nil
+}
+
+// 检查期望值或计算增量，以读到的版本为条件写入
+func casMetadata(
+	ctx context.Context, collection *mongo.Collection, filter bson.M,
+	notFound error, ops []*MetadataOp) (_ map[string]string, err error) {
+	for i := 0; i < dbMaxMetadataUpdateRetry; i++ {
+		doc := &xMetadataDoc{}
+		if err = collection.FindOne(
+			ctx,
+			filter,
+			options.FindOne().SetProjection(
+				bson.M{"metadata": 1, "metadata_rev": 1}),
+		).Decode(doc); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, notFound
+			}
+			log.Warnf("failed to access mongo: %v", err)
+			return nil, ErrDatabaseUnavailable
+		}
+		md := make(map[string]string, len(doc.Metadata))
+		for key, val := range doc.Metadata {
+			md[key] = val
+		}
+		set, unset := bson.M{}, bson.M{}
+		for _, op := range ops {
+			cur := md[op.Key]
+			if op.Expect != nil && *op.Expect != cur {
+				return nil, ErrMetadataConflict
+			}
+			val := op.Value
+			if op.Incr != 0 {
+				var n int64
+				if cur != "" {
+					if n, err = strconv.ParseInt(cur, 10, 64); err != nil {
+						return nil, newInvalidArgumentError(
+							"metadata value not an integer")
+					}
+				}
+				val = strconv.FormatInt(n+op.Incr, 10)
+			}
+			if val != "" {
+				md[op.Key] = val
+				set["metadata."+op.Key] = val
+				delete(unset, "metadata."+op.Key)
+			} else {
+				delete(md, op.Key)
+				unset["metadata."+op.Key] = 1
+				delete(set, "metadata."+op.Key)
+			}
+		}
+		if err = checkMetadataSize(
+			getMetadataSize(doc.Metadata), getMetadataSize(md)); err != nil {
+			return
+		}
+		update := bson.M{"$inc": bson.M{"metadata_rev": 1}}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		cond := bson.M{"metadata_rev": doc.Rev}
+		if doc.Rev == 0 {
+			cond = bson.M{"metadata_rev": bson.M{"$exists": false}}
+		}
+		var r *mongo.UpdateResult
+		if r, err = collection.UpdateOne(
+			ctx, bson.M{"$and": bson.A{filter, cond}}, update); err != nil {
+			log.Warnf("failed to access mongo: %v", err)
+			return nil, ErrDatabaseUnavailable
+		}
+		if r.MatchedCount > 0 {
+			return md, nil
+		}
+	}
+	return nil, ErrMetadataConflict
+}
+
+// 原子地更新用户元数据，返回更新后的全部元数据
+func UpdateUserMetadata(
+	ctx context.Context, appId, userId string, ops []*MetadataOp) (
+	_ map[string]string, err error) {
+	collection, err := getUserCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	return updateMetadata(
+		ctx, collection, bson.M{"_id": userId}, ErrUserNotFound, ops)
+}
+
+// 原子地更新角色元数据，返回更新后的全部元数据
+func UpdateRoleMetadata(
+	ctx context.Context, appId, roleId string, ops []*MetadataOp) (
+	_ map[string]string, err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	return updateMetadata(
+		ctx,
+		collection,
+		bson.M{
+			"_id":       roleId,
+			"delete_at": dbRoleAliveFilter["delete_at"],
+		},
+		ErrRoleNotFound,
+		ops,
+	)
+}
+
+func toMetadataOps(md map[string]string) []*MetadataOp {
+	ops := make([]*MetadataOp, 0, len(md))
+	for key, val := range md {
+		ops = append(ops, &MetadataOp{Key: key, Value: val})
+	}
+	return ops
+}
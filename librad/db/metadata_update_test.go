@@ -0,0 +1,70 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUpdateMetadata(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testmetadataupdate"})
+
+	role := testCreateRole(t, ctx, app.Id, "testuser", 1)
+	// 直接写入，值以$开头也不会被当作字段路径
+	md, err := UpdateRoleMetadata(ctx, app.Id, role.Id, []*MetadataOp{
+		{Key: "a", Value: "$a"},
+		{Key: "b", Value: "1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to update metadata: %v", err)
+	}
+	if md["a"] != "$a" || md["b"] != "1" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+	empty, one := "", "1"
+	if _, err = UpdateRoleMetadata(ctx, app.Id, role.Id, []*MetadataOp{
+		{Key: "b", Expect: &empty, Value: "2"},
+	}); err != ErrMetadataConflict {
+		t.Fatalf("expect metadata conflict, but got: %v", err)
+	}
+	if md, err = UpdateRoleMetadata(ctx, app.Id, role.Id, []*MetadataOp{
+		{Key: "b", Expect: &one, Incr: 2},
+		{Key: "a"},
+	}); err != nil {
+		t.Fatalf("failed to update metadata: %v", err)
+	}
+	if _, ok := md["a"]; ok || md["b"] != "3" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+
+	// 超过上限的写入被拒绝，已经超过上限的文档依然可以缩小
+	large := strings.Repeat("x", cfg.MaxMetadataSize)
+	if _, err = UpdateRoleMetadata(ctx, app.Id, role.Id, []*MetadataOp{
+		{Key: "c", Value: large},
+	}); err != ErrMetadataTooLarge {
+		t.Fatalf("expect metadata too large, but got: %v", err)
+	}
+	collection, err := getRoleCollection(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to get role collection: %v", err)
+	}
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": role.Id},
+		bson.M{"$set": bson.M{"metadata.c": large}},
+	); err != nil {
+		t.Fatalf("failed to update role: %v", err)
+	}
+	if _, err = UpdateRoleMetadata(ctx, app.Id, role.Id, []*MetadataOp{
+		{Key: "c", Value: large[1:]},
+	}); err != nil {
+		t.Fatalf("failed to shrink metadata: %v", err)
+	}
+	if _, err = UpdateRoleMetadata(ctx, app.Id, role.Id, []*MetadataOp{
+		{Key: "b", Incr: 1},
+		{Key: "c", Value: large[2:]},
+	}); err != nil {
+		t.Fatalf("failed to shrink metadata: %v", err)
+	}
+}
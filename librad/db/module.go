@@ -34,6 +34,11 @@ func (m *module) Initialize(jb json.RawMessage) (err error) {
 	if err = cfg.parse(); err != nil {
 		return
 	}
+	if cfg.GeoIP.Database != "" {
+		if err = geoIP.load(cfg.GeoIP.Database); err != nil {
+			return fmt.Errorf("failed to load geoip database: %v", err)
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	if err = dialDatabase(ctx); err != nil {
@@ -0,0 +1,387 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/width"
+)
+
+// 角色名
+// 角色名在应用内唯一，应用开启分区命名时在区服内唯一。
+// 名字按照归一化后的形式占用，忽略大小写和全角半角的区别，
+// 释放后的名字在冷却期内不能被其他角色占用。
+// 是否分区命名决定了名字的键格式，在占用第一个名字时固定下来，
+// 之后修改应用设置不再生效，避免已占用的名字失效。
+
+// 角色名最大长度(字符数)
+const dbMaxRoleNameLen = 32
+
+// 记录是否分区命名的文档，名字的键都是字符串，不会冲突
+const dbRoleNameModeId = 0
+
+var (
+	dbNameCollectionMu sync.Mutex
+	dbNameCollection   = make(map[string]*mongo.Collection)
+
+	dbRoleNamePerZoneMu sync.Mutex
+	dbRoleNamePerZone   = make(map[string]bool)
+)
+
+type RoleName struct {
+	// 归一化后的名字，分区命名时带有区服前缀
+	Key string `bson:"_id"`
+	// 原始名字
+	Name string `bson:"name"`
+	// 区服
+	Zone uint32 `bson:"zone"`
+	// 占用的角色，释放后为空
+	RoleId string `bson:"role_id,omitempty"`
+	// 占用时间
+	ReserveAt time.Time `bson:"reserve_at,omitempty"`
+	// 冷却结束时间，释放后才有
+	FreeAt time.Time `bson:"free_at,omitempty"`
+}
+
+func getNameCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbNameCollectionMu.Lock()
+	defer dbNameCollectionMu.Unlock()
+
+	if collection, ok := dbNameCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.names"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	if _, err := collection.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys: bson.D{{Key: "role_id", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(
+				bson.M{"role_id": bson.M{"$exists": true}}),
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	dbNameCollection[appId] = collection
+	return collection, nil
+}
+
+// 名字归一化，全角转半角，忽略大小写
+func NormalizeRoleName(name string) (_ string, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", newInvalidArgumentError("empty name")
+	}
+	if !utf8.ValidString(name) {
+		return "", newInvalidArgumentError("invalid name")
+	}
+	if utf8.RuneCountInString(name) > dbMaxRoleNameLen {
+		return "", newInvalidArgumentError("name too long")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", newInvalidArgumentError("invalid name")
+		}
+	}
+	return cases.Fold().String(width.Fold.String(name)), nil
+}
+
+// 是否分区命名，fix为true时没有记录则按当前设置记录下来
+func isRoleNamePerZone(
+	ctx context.Context, app *App, fix bool) (_ bool, err error) {
+	dbRoleNamePerZoneMu.Lock()
+	perZone, ok := dbRoleNamePerZone[app.Id]
+	dbRoleNamePerZoneMu.Unlock()
+	if ok {
+		return perZone, nil
+	}
+	collection, err := getNameCollection(ctx, app.Id)
+	if err != nil {
+		return
+	}
+	var x struct {
+		PerZone bool `bson:"per_zone"`
+	}
+	if fix {
+		err = collection.FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": dbRoleNameModeId},
+			bson.M{"$setOnInsert": bson.M{"per_zone": app.RoleNamePerZone}},
+			options.FindOneAndUpdate().SetUpsert(true),
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&x)
+	} else {
+		err = collection.FindOne(
+			ctx, bson.M{"_id": dbRoleNameModeId}).Decode(&x)
+	}
+	if err == mongo.ErrNoDocuments {
+		// 还没有占用过名字
+		return app.RoleNamePerZone, nil
+	} else if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return false, ErrDatabaseUnavailable
+	}
+	if x.PerZone != app.RoleNamePerZone {
+		log.Warnf("role name per zone is fixed once names exist: %v, %v",
+			app.Id, x.PerZone)
+	}
+	dbRoleNamePerZoneMu.Lock()
+	dbRoleNamePerZone[app.Id] = x.PerZone
+	dbRoleNamePerZoneMu.Unlock()
+	return x.PerZone, nil
+}
+
+func getRoleNameKey(
+	ctx context.Context, app *App, zone uint32, norm string, fix bool) (
+	_ string, err error) {
+	perZone, err := isRoleNamePerZone(ctx, app, fix)
+	if err != nil {
+		return
+	}
+	if perZone {
+		return fmt.Sprintf("%d:%s", zone, norm), nil
+	}
+	return norm, nil
+}
+
+func getAliveRole(
+	ctx context.Context, appId, roleId string) (_ *Role, err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	role := &Role{}
+	if err = collection.FindOne(
+		ctx,
+		bson.M{
+			"_id":       roleId,
+			"delete_at": dbRoleAliveFilter["delete_at"],
+		},
+	).Decode(role); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrRoleNotFound
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return role, nil
+}
+
+// 为角色占用名字，已占用时直接返回
+func reserveRoleName(
+	ctx context.Context, app *App, role *Role, name string) (err error) {
+	norm, err := NormalizeRoleName(name)
+	if err != nil {
+		return
+	}
+	collection, err := getNameCollection(ctx, app.Id)
+	if err != nil {
+		return
+	}
+	key, err := getRoleNameKey(ctx, app, role.Index, norm, true)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	// 名字被其他角色占用或在冷却期内时，条件不满足转为插入，
+	// 由_id的唯一性保证冲突
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id": key,
+			"$or": bson.A{
+				bson.M{"role_id": role.Id},
+				bson.M{
+					"role_id": bson.M{"$exists": false},
+					"free_at": bson.M{"$lte": now},
+				},
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"name":       name,
+				"zone":       role.Index,
+				"role_id":    role.Id,
+				"reserve_at": now,
+			},
+			"$unset": bson.M{"free_at": 1},
+		},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrRoleNameAlreadyExists
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 释放角色占用的名字，进入冷却期
+func releaseRoleName(
+	ctx context.Context, app *App, role *Role, name string) (err error) {
+	return freeRoleName(
+		ctx, app, role, name, time.Now().Add(cfg.Role.nameCooldown))
+}
+
+// 撤销没有生效的占用，名字立即可用
+func cancelRoleName(ctx context.Context, app *App, role *Role, name string) {
+	if err := freeRoleName(ctx, app, role, name, time.Now()); err != nil {
+		log.Warnf("failed to cancel role name: %v, %v, %v",
+			app.Id, role.Id, err)
+	}
+}
+
+func freeRoleName(
+	ctx context.Context, app *App, role *Role, name string,
+	freeAt time.Time) (err error) {
+	norm, err := NormalizeRoleName(name)
+	if err != nil {
+		return
+	}
+	collection, err := getNameCollection(ctx, app.Id)
+	if err != nil {
+		return
+	}
+	key, err := getRoleNameKey(ctx, app, role.Index, norm, false)
+	if err != nil {
+		return
+	}
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":     key,
+			"role_id": role.Id,
+		},
+		bson.M{
+			"$set":   bson.M{"free_at": freeAt},
+			"$unset": bson.M{"role_id": 1},
+		},
+	); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+func setRoleName(
+	ctx context.Context, appId, roleId, name string) (err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	update := bson.M{"$set": bson.M{"name": name}}
+	if name == "" {
+		update = bson.M{"$unset": bson.M{"name": 1}}
+	}
+	if _, err = collection.UpdateOne(
+		ctx, bson.M{"_id": roleId}, update); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 占用名字，角色已有名字时视为改名
+// 新名字占用成功后才释放旧名字，记录到角色失败时撤销新名字的占用
+func ReserveRoleName(
+	ctx context.Context, appId, roleId, name string) (err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return ErrInvalidAppId
+	}
+	role, err := getAliveRole(ctx, appId, roleId)
+	if err != nil {
+		return
+	}
+	// 只改变了大小写或全角半角时，占用的还是原来的名字
+	sameNorm := false
+	if role.Name != "" {
+		oldNorm, _ := NormalizeRoleName(role.Name)
+		norm, _ := NormalizeRoleName(name)
+		sameNorm = oldNorm != "" && norm == oldNorm
+	}
+	if err = reserveRoleName(ctx, app, role, name); err != nil {
+		return
+	}
+	if err = setRoleName(ctx, appId, roleId, name); err != nil {
+		if !sameNorm {
+			cancelRoleName(ctx, app, role, name)
+		}
+		return
+	}
+	if role.Name == "" || sameNorm {
+		return
+	}
+	return releaseRoleName(ctx, app, role, role.Name)
+}
+
+// 释放角色名
+func ReleaseRoleName(ctx context.Context, appId, roleId string) (err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return ErrInvalidAppId
+	}
+	role, err := getAliveRole(ctx, appId, roleId)
+	if err != nil {
+		return
+	}
+	if role.Name == "" {
+		return
+	}
+	if err = releaseRoleName(ctx, app, role, role.Name); err != nil {
+		return
+	}
+	return setRoleName(ctx, appId, roleId, "")
+}
+
+// 通过名字查找角色ID，未开启分区命名时忽略区服
+func LookupRoleName(
+	ctx context.Context, appId string, zone uint32, name string) (
+	_ string, err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return "", ErrInvalidAppId
+	}
+	norm, err := NormalizeRoleName(name)
+	if err != nil {
+		return
+	}
+	collection, err := getNameCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	key, err := getRoleNameKey(ctx, app, zone, norm, false)
+	if err != nil {
+		return
+	}
+	x := &RoleName{}
+	if err = collection.FindOne(
+		ctx,
+		bson.M{
+			"_id":     key,
+			"role_id": bson.M{"$exists": true},
+		},
+	).Decode(x); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", ErrRoleNameNotFound
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return "", ErrDatabaseUnavailable
+	}
+	return x.RoleId, nil
+}
@@ -0,0 +1,43 @@
+package db
+
+import "testing"
+
+func TestRoleName(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testrolename"})
+
+	r1 := testCreateRole(t, ctx, app.Id, "testuser1", 1)
+	r2 := testCreateRole(t, ctx, app.Id, "testuser2", 1)
+	if err := ReserveRoleName(ctx, app.Id, r1.Id, "Alice"); err != nil {
+		t.Fatalf("failed to reserve role name: %v", err)
+	}
+	// 忽略大小写和全角半角
+	if err := ReserveRoleName(
+		ctx, app.Id, r2.Id, "ＡＬＩＣＥ"); err != ErrRoleNameAlreadyExists {
+		t.Fatalf("expect role name already exists, but got: %v", err)
+	}
+	if roleId, err := LookupRoleName(ctx, app.Id, 0, "alice"); err != nil {
+		t.Fatalf("failed to lookup role name: %v", err)
+	} else if roleId != r1.Id {
+		t.Fatalf("unexpected role id: %v", roleId)
+	}
+	// 改名后旧名字进入冷却期
+	if err := ReserveRoleName(ctx, app.Id, r1.Id, "Bob"); err != nil {
+		t.Fatalf("failed to reserve role name: %v", err)
+	}
+	if _, err := LookupRoleName(
+		ctx, app.Id, 0, "alice"); err != ErrRoleNameNotFound {
+		t.Fatalf("expect role name not found, but got: %v", err)
+	}
+	if err := ReserveRoleName(
+		ctx, app.Id, r2.Id, "alice"); err != ErrRoleNameAlreadyExists {
+		t.Fatalf("expect role name already exists, but got: %v", err)
+	}
+
+	// 占用过名字后修改分区命名的设置不影响已有的名字
+	app.RoleNamePerZone = true
+	if roleId, err := LookupRoleName(ctx, app.Id, 1, "bob"); err != nil {
+		t.Fatalf("failed to lookup role name: %v", err)
+	} else if roleId != r1.Id {
+		t.Fatalf("unexpected role id: %v", roleId)
+	}
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+)
+
+// 一次性验证码
+// 验证码保存在随机数Redis中，每个目标(如手机号)同时只有一个有效的验证码，
+// 限制重发间隔、单个目标和单个IP在统计窗口内的发送次数，
+// 以及单个验证码的尝试次数，超过次数后验证码失效。
+// 密码这类不经过验证码的验证使用同样的计数限制尝试次数。
+
+var (
+	// 计数并在首次计数时设置过期时间
+	luaIncrOtpCounter = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return n`)
+	// 覆盖之前的验证码
+	luaSetOtp = redis.NewScript(`
+redis.call("DEL", KEYS[1])
+redis.call("HSET", KEYS[1], "code", ARGV[1], "attempts", 0)
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1`)
+	// 验证成功或尝试次数用尽时删除验证码，返回剩余尝试次数
+	luaCheckOtp = redis.NewScript(`
+local code = redis.call("HGET", KEYS[1], "code")
+if not code then return -1 end
+if code == ARGV[1] then
+  redis.call("DEL", KEYS[1])
+  return 0
+end
+local n = redis.call("HINCRBY", KEYS[1], "attempts", 1)
+if n >= tonumber(ARGV[2]) then
+  redis.call("DEL", KEYS[1])
+  return -1
+end
+return tonumber(ARGV[2]) - n`)
+)
+
+// 验证码策略
+type OtpPolicy struct {
+	// 有效期
+	Timeout time.Duration
+	// 重发间隔
+	Cooldown time.Duration
+	// 单个验证码的最大尝试次数
+	MaxAttempts int
+	// 发送次数的统计窗口
+	Window time.Duration
+	// 窗口内单个目标的最大发送次数
+	MaxPerTarget int
+	// 窗口内单个IP的最大发送次数
+	MaxPerIp int
+}
+
+func getOtpKey(appId, kind, target string) string {
+	return fmt.Sprintf("otp$%s$%s$%s", appId, kind, target)
+}
+
+func incrOtpCounter(
+	ctx context.Context, key string, window time.Duration) (int, error) {
+	return luaIncrOtpCounter.Run(
+		ctx, rdbNonce, []string{key}, window.Milliseconds()).Int()
+}
+
+// 为目标签发验证码，kind区分不同用途，验证码由调用方生成
+func IssueOtp(
+	ctx context.Context, appId, kind, target, clientIp, code string,
+	p *OtpPolicy) (err error) {
+	if p.Cooldown > 0 {
+		ok, err := rdbNonce.SetNX(
+			ctx, getOtpKey(appId, kind+".cd", target), "", p.Cooldown).Result()
+		if err != nil {
+			log.Warnf("failed to access redis: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		if !ok {
+			return ErrOtpCooldown
+		}
+	}
+	if p.MaxPerTarget > 0 {
+		n, err := incrOtpCounter(
+			ctx, getOtpKey(appId, kind+".n", target), p.Window)
+		if err != nil {
+			log.Warnf("failed to access redis: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		if n > p.MaxPerTarget {
+			return ErrOtpLimitExceeded
+		}
+	}
+	if p.MaxPerIp > 0 && clientIp != "" {
+		n, err := incrOtpCounter(
+			ctx, getOtpKey(appId, kind+".ip", clientIp), p.Window)
+		if err != nil {
+			log.Warnf("failed to access redis: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		if n > p.MaxPerIp {
+			return ErrOtpLimitExceeded
+		}
+	}
+	if err = luaSetOtp.Run(
+		ctx, rdbNonce, []string{getOtpKey(appId, kind, target)},
+		code, p.Timeout.Milliseconds()).Err(); err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 验证并消耗验证码
+func CheckOtp(
+	ctx context.Context, appId, kind, target, code string,
+	p *OtpPolicy) (err error) {
+	if code == "" {
+		return ErrInvalidOtp
+	}
+	left, err := luaCheckOtp.Run(
+		ctx, rdbNonce, []string{getOtpKey(appId, kind, target)},
+		code, p.MaxAttempts).Int()
+	if err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if left != 0 {
+		return ErrInvalidOtp
+	}
+	return
+}
+
+// 次数限制策略，用于密码这类可以反复尝试的验证和验证邮件的发送
+type AttemptPolicy struct {
+	// 次数的统计窗口
+	Window time.Duration
+	// 窗口内单个目标的最大次数
+	MaxPerTarget int
+	// 窗口内单个IP的最大次数
+	MaxPerIp int
+}
+
+func getAttemptKeys(
+	appId, kind, target, clientIp string, p *AttemptPolicy) (
+	keys []string, limits []int) {
+	if p.MaxPerTarget > 0 {
+		keys = append(keys, getOtpKey(appId, kind+".n", target))
+		limits = append(limits, p.MaxPerTarget)
+	}
+	if p.MaxPerIp > 0 && clientIp != "" {
+		keys = append(keys, getOtpKey(appId, kind+".ip", clientIp))
+		limits = append(limits, p.MaxPerIp)
+	}
+	return
+}
+
+// 检查次数是否已经用尽，在验证之前调用，不计数
+func CheckAttempts(
+	ctx context.Context, appId, kind, target, clientIp string,
+	p *AttemptPolicy) (err error) {
+	keys, limits := getAttemptKeys(appId, kind, target, clientIp, p)
+	for i, key := range keys {
+		n, err := rdbNonce.Get(ctx, key).Int()
+		if err != nil && err != redis.Nil {
+			log.Warnf("failed to access redis: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		if n >= limits[i] {
+			return ErrTooManyAttempts
+		}
+	}
+	return
+}
+
+// 计数一次，计数后超过限制时返回ErrTooManyAttempts
+func AddAttempt(
+	ctx context.Context, appId, kind, target, clientIp string,
+	p *AttemptPolicy) (err error) {
+	keys, limits := getAttemptKeys(appId, kind, target, clientIp, p)
+	for i, key := range keys {
+		n, err := incrOtpCounter(ctx, key, p.Window)
+		if err != nil {
+			log.Warnf("failed to access redis: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		if n > limits[i] {
+			return ErrTooManyAttempts
+		}
+	}
+	return
+}
+
+// 验证成功后清除目标的计数，IP的计数保留
+func ResetAttempts(
+	ctx context.Context, appId, kind, target string) (err error) {
+	if err = rdbNonce.Del(
+		ctx, getOtpKey(appId, kind+".n", target)).Err(); err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttempts(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testattempts"})
+
+	p := &AttemptPolicy{Window: time.Minute, MaxPerTarget: 2, MaxPerIp: 3}
+	for _, target := range []string{"a", "b"} {
+		if err := ResetAttempts(ctx, app.Id, "test", target); err != nil {
+			t.Fatalf("failed to reset attempts: %v", err)
+		}
+	}
+	if err := rdbNonce.Del(
+		ctx, getOtpKey(app.Id, "test.ip", "1.1.1.1")).Err(); err != nil {
+		t.Fatalf("failed to reset attempts: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := CheckAttempts(
+			ctx, app.Id, "test", "a", "1.1.1.1", p); err != nil {
+			t.Fatalf("failed to check attempts: %v", err)
+		}
+		if err := AddAttempt(
+			ctx, app.Id, "test", "a", "1.1.1.1", p); err != nil {
+			t.Fatalf("failed to add attempt: %v", err)
+		}
+	}
+	if err := CheckAttempts(
+		ctx, app.Id, "test", "a", "1.1.1.1", p); err != ErrTooManyAttempts {
+		t.Fatalf("expect too many attempts, but got: %v", err)
+	}
+	// 成功后目标的计数清零，IP的计数保留
+	if err := ResetAttempts(ctx, app.Id, "test", "a"); err != nil {
+		t.Fatalf("failed to reset attempts: %v", err)
+	}
+	if err := CheckAttempts(
+		ctx, app.Id, "test", "a", "1.1.1.1", p); err != nil {
+		t.Fatalf("failed to check attempts: %v", err)
+	}
+	if err := AddAttempt(
+		ctx, app.Id, "test", "b", "1.1.1.1", p); err != nil {
+		t.Fatalf("failed to add attempt: %v", err)
+	}
+	if err := AddAttempt(
+		ctx, app.Id, "test", "b", "1.1.1.1", p); err != ErrTooManyAttempts {
+		t.Fatalf("expect too many attempts, but got: %v", err)
+	}
+	if err := CheckAttempts(
+		ctx, app.Id, "test", "c", "1.1.1.1", p); err != ErrTooManyAttempts {
+		t.Fatalf("expect too many attempts, but got: %v", err)
+	}
+	if err := CheckAttempts(ctx, app.Id, "test", "c", "", p); err != nil {
+		t.Fatalf("failed to check attempts: %v", err)
+	}
+}
+
+func TestOtp(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testotp"})
+
+	const ip = "1.1.1.1"
+	var keys []string
+	for _, target := range []string{"a", "b"} {
+		keys = append(keys,
+			getOtpKey(app.Id, "test", target),
+			getOtpKey(app.Id, "test.cd", target),
+			getOtpKey(app.Id, "test.n", target))
+	}
+	keys = append(keys, getOtpKey(app.Id, "test.ip", ip))
+	if err := rdbNonce.Del(ctx, keys...).Err(); err != nil {
+		t.Fatalf("failed to reset otp: %v", err)
+	}
+
+	p := &OtpPolicy{
+		Timeout:     time.Minute,
+		MaxAttempts: 2,
+		Window:      time.Minute,
+		MaxPerIp:    3,
+	}
+	if err := IssueOtp(ctx, app.Id, "test", "a", ip, "1234", p); err != nil {
+		t.Fatalf("failed to issue otp: %v", err)
+	}
+	if err := CheckOtp(ctx, app.Id, "test", "a", "", p); err != ErrInvalidOtp {
+		t.Fatalf("expect invalid otp, but got: %v", err)
+	}
+	if err := CheckOtp(ctx, app.Id, "test", "a", "1234", p); err != nil {
+		t.Fatalf("failed to check otp: %v", err)
+	}
+	// 验证码只能使用一次
+	if err := CheckOtp(
+		ctx, app.Id, "test", "a", "1234", p); err != ErrInvalidOtp {
+		t.Fatalf("expect invalid otp, but got: %v", err)
+	}
+	// 尝试次数用尽后验证码失效
+	if err := IssueOtp(ctx, app.Id, "test", "a", ip, "1234", p); err != nil {
+		t.Fatalf("failed to issue otp: %v", err)
+	}
+	for i := 0; i < p.MaxAttempts; i++ {
+		if err := CheckOtp(
+			ctx, app.Id, "test", "a", "0000", p); err != ErrInvalidOtp {
+			t.Fatalf("expect invalid otp, but got: %v", err)
+		}
+	}
+	if err := CheckOtp(
+		ctx, app.Id, "test", "a", "1234", p); err != ErrInvalidOtp {
+		t.Fatalf("expect invalid otp, but got: %v", err)
+	}
+	// 窗口内IP的发送次数用尽
+	if err := IssueOtp(
+		ctx, app.Id, "test", "b", ip, "1234", p); err != nil {
+		t.Fatalf("failed to issue otp: %v", err)
+	}
+	if err := IssueOtp(
+		ctx, app.Id, "test", "b", ip, "1234", p); err != ErrOtpLimitExceeded {
+		t.Fatalf("expect otp limit exceeded, but got: %v", err)
+	}
+
+	p = &OtpPolicy{
+		Timeout:      time.Minute,
+		Cooldown:     time.Minute,
+		MaxAttempts:  2,
+		Window:       time.Minute,
+		MaxPerTarget: 1,
+	}
+	if err := IssueOtp(ctx, app.Id, "test", "b", "", "5678", p); err != nil {
+		t.Fatalf("failed to issue otp: %v", err)
+	}
+	if err := IssueOtp(
+		ctx, app.Id, "test", "b", "", "5678", p); err != ErrOtpCooldown {
+		t.Fatalf("expect otp cooldown, but got: %v", err)
+	}
+	if err := rdbNonce.Del(
+		ctx, getOtpKey(app.Id, "test.cd", "b")).Err(); err != nil {
+		t.Fatalf("failed to reset cooldown: %v", err)
+	}
+	if err := IssueOtp(
+		ctx, app.Id, "test", "b", "", "5678", p); err != ErrOtpLimitExceeded {
+		t.Fatalf("expect otp limit exceeded, but got: %v", err)
+	}
+	// 之前签发的验证码依然有效
+	if err := CheckOtp(ctx, app.Id, "test", "b", "5678", p); err != nil {
+		t.Fatalf("failed to check otp: %v", err)
+	}
+}
@@ -0,0 +1,408 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/ntons/log-go"
+	"github.com/vmihailenco/msgpack/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 在线状态
+// 登录、绑定角色和鉴权时记录活跃时间，登出时移出在线集合。
+// 鉴权时与会话续期同步记录，所以活跃时间的精度是续期间隔，
+// 超过在线窗口没有活跃的会话(包括过期的会话)视为离线。
+//
+// 每个应用在鉴权Redis中有以下有序集合，分数为毫秒时间戳：
+//
+//	presence$<app>$u        用户最后活跃时间
+//	presence$<app>$u$on     在线用户
+//	presence$<app>$r        角色最后活跃时间
+//	presence$<app>$r$on     在线角色
+//	presence$<app>$r$on$<i> 区服(角色索引)内的在线角色
+//	presence$<app>$i        出现过的角色索引(集合)
+//
+// 后台任务定期清理离线成员，并把在线人数采样保存到libra.ccu。
+
+const (
+	// 最小的在线窗口，不小于续期间隔的两倍
+	dbMinPresenceWindow = 5 * time.Minute
+	// 最后活跃时间的保留时长
+	dbPresenceRetention = 30 * 24 * time.Hour
+	// 在线人数采样间隔
+	dbCcuSampleInterval = time.Minute
+	// 采样保留时长
+	dbCcuRetention = 90 * 24 * time.Hour
+)
+
+var (
+	dbCcuCollectionMu sync.Mutex
+	dbCcuCollection   = make(map[string]*mongo.Collection)
+)
+
+type Presence struct {
+	// 用户或角色ID
+	Id string
+	// 是否在线
+	Online bool
+	// 最后活跃时间，从未活跃时为零值
+	LastSeen time.Time
+}
+
+// 在线人数采样
+type CcuSample struct {
+	// 采样时间，按采样间隔取整
+	Time time.Time `bson:"_id"`
+	// 在线用户数
+	Users int64 `bson:"users"`
+	// 在线角色数
+	Roles int64 `bson:"roles"`
+	// 各区服的在线角色数，键为角色索引
+	Indexes map[string]int64 `bson:"indexes,omitempty"`
+}
+
+func getCcuCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbCcuCollectionMu.Lock()
+	defer dbCcuCollectionMu.Unlock()
+
+	if collection, ok := dbCcuCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.ccu"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	if _, err := collection.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "expire_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	dbCcuCollection[appId] = collection
+	return collection, nil
+}
+
+func getUserPresenceKey(appId string) string {
+	return fmt.Sprintf("presence$%s$u", appId)
+}
+func getUserOnlineKey(appId string) string {
+	return fmt.Sprintf("presence$%s$u$on", appId)
+}
+func getRolePresenceKey(appId string) string {
+	return fmt.Sprintf("presence$%s$r", appId)
+}
+func getRoleOnlineKey(appId string) string {
+	return fmt.Sprintf("presence$%s$r$on", appId)
+}
+func getIndexOnlineKey(appId string, index uint32) string {
+	return fmt.Sprintf("presence$%s$r$on$%d", appId, index)
+}
+func getPresenceIndexesKey(appId string) string {
+	return fmt.Sprintf("presence$%s$i", appId)
+}
+
+// 在线窗口，鉴权时每个续期间隔才记录一次活跃
+func (x *App) getPresenceWindow() time.Duration {
+	if d := 2 * x.getSessRefreshInterval(); d > dbMinPresenceWindow {
+		return d
+	}
+	return dbMinPresenceWindow
+}
+
+func toMillis(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func fromMillis(v float64) time.Time {
+	return time.Unix(0, int64(v)*int64(time.Millisecond))
+}
+
+// 记录用户活跃，已绑定角色时同时记录角色，失败只记录日志
+func touchPresence(
+	ctx context.Context, appId, userId, roleId string, roleIndex uint32) {
+	now := toMillis(time.Now())
+	if _, err := rdbAuth.Pipelined(ctx, func(p redis.Pipeliner) error {
+		z := &redis.Z{Score: now, Member: userId}
+		p.ZAdd(ctx, getUserPresenceKey(appId), z)
+		p.ZAdd(ctx, getUserOnlineKey(appId), z)
+		if roleId != "" {
+			z := &redis.Z{Score: now, Member: roleId}
+			p.ZAdd(ctx, getRolePresenceKey(appId), z)
+			p.ZAdd(ctx, getRoleOnlineKey(appId), z)
+			p.ZAdd(ctx, getIndexOnlineKey(appId, roleIndex), z)
+			p.SAdd(ctx, getPresenceIndexesKey(appId), roleIndex)
+		}
+		return nil
+	}); err != nil {
+		log.Warnf("failed to touch presence: %v, %v, %v", appId, userId, err)
+	}
+}
+
+// 登出时移出在线集合，需要在删除会话前调用以取得绑定的角色
+func clearPresence(ctx context.Context, userIds []string) {
+	cmds, err := rdbAuth.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, userId := range userIds {
+			p.Get(ctx, userId)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		log.Warnf("failed to get sessions: %v", err)
+		return
+	}
+	now := toMillis(time.Now())
+	if _, err = rdbAuth.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, userId := range userIds {
+			app := findAppByKeyOfId(userId)
+			if app == nil {
+				continue
+			}
+			z := &redis.Z{Score: now, Member: userId}
+			p.ZAdd(ctx, getUserPresenceKey(app.Id), z)
+			p.ZRem(ctx, getUserOnlineKey(app.Id), userId)
+			b, err := cmds[i].(*redis.StringCmd).Bytes()
+			if err != nil {
+				continue
+			}
+			s := &Sess{}
+			if msgpack.Unmarshal(b, s) != nil || s.Data.RoleId == "" {
+				continue
+			}
+			roleId := s.Data.RoleId
+			p.ZAdd(ctx, getRolePresenceKey(app.Id),
+				&redis.Z{Score: now, Member: roleId})
+			p.ZRem(ctx, getRoleOnlineKey(app.Id), roleId)
+			p.ZRem(ctx, getIndexOnlineKey(app.Id, s.Data.RoleIndex), roleId)
+		}
+		return nil
+	}); err != nil {
+		log.Warnf("failed to clear presence: %v", err)
+	}
+}
+
+func findAppByKeyOfId(id string) *App {
+	appKey, _, err := DecId(id)
+	if err != nil {
+		return nil
+	}
+	return findAppByKey(appKey)
+}
+
+func getPresence(
+	ctx context.Context, app *App, lastSeenKey, onlineKey string,
+	ids []string) (_ []*Presence, err error) {
+	if len(ids) == 0 {
+		return
+	}
+	var lastSeen, online []*redis.FloatCmd
+	if _, err = rdbAuth.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, id := range ids {
+			lastSeen = append(lastSeen, p.ZScore(ctx, lastSeenKey, id))
+			online = append(online, p.ZScore(ctx, onlineKey, id))
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		log.Warnf("failed to access redis: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	since := toMillis(time.Now().Add(-app.getPresenceWindow()))
+	r := make([]*Presence, 0, len(ids))
+	for i, id := range ids {
+		x := &Presence{Id: id}
+		if v, err := lastSeen[i].Result(); err == nil {
+			x.LastSeen = fromMillis(v)
+		}
+		if v, err := online[i].Result(); err == nil && v >= since {
+			x.Online = true
+			if t := fromMillis(v); t.After(x.LastSeen) {
+				x.LastSeen = t
+			}
+		}
+		r = append(r, x)
+	}
+	return r, nil
+}
+
+// 批量查询用户的在线状态和最后活跃时间
+func GetUserPresence(
+	ctx context.Context, appId string, userIds []string) (
+	_ []*Presence, err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return nil, ErrInvalidAppId
+	}
+	return getPresence(ctx, app,
+		getUserPresenceKey(appId), getUserOnlineKey(appId), userIds)
+}
+
+// 批量查询角色的在线状态和最后活跃时间
+func GetRolePresence(
+	ctx context.Context, appId string, roleIds []string) (
+	_ []*Presence, err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return nil, ErrInvalidAppId
+	}
+	return getPresence(ctx, app,
+		getRolePresenceKey(appId), getRoleOnlineKey(appId), roleIds)
+}
+
+func countOnline(
+	ctx context.Context, key string, since float64) (int64, error) {
+	return rdbAuth.ZCount(
+		ctx, key, strconv.FormatFloat(since, 'f', 0, 64), "+inf").Result()
+}
+
+// 当前在线人数，角色按索引分组
+func CountOnline(
+	ctx context.Context, appId string) (_ *CcuSample, err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return nil, ErrInvalidAppId
+	}
+	now := time.Now()
+	since := toMillis(now.Add(-app.getPresenceWindow()))
+	x := &CcuSample{Time: now}
+	if x.Users, err = countOnline(
+		ctx, getUserOnlineKey(appId), since); err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	if x.Roles, err = countOnline(
+		ctx, getRoleOnlineKey(appId), since); err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	indexes, err := rdbAuth.SMembers(ctx, getPresenceIndexesKey(appId)).Result()
+	if err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	for _, s := range indexes {
+		index, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			continue
+		}
+		n, err := countOnline(
+			ctx, getIndexOnlineKey(appId, uint32(index)), since)
+		if err != nil {
+			log.Warnf("failed to access redis: %v", err)
+			return nil, ErrDatabaseUnavailable
+		}
+		if n > 0 {
+			if x.Indexes == nil {
+				x.Indexes = make(map[string]int64)
+			}
+			x.Indexes[s] = n
+		}
+	}
+	return x, nil
+}
+
+// 时间范围内的在线人数采样，按时间排序
+func ListCcuSamples(
+	ctx context.Context, appId string, from, to time.Time) (
+	_ []*CcuSample, err error) {
+	collection, err := getCcuCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{"_id": bson.M{"$gte": from, "$lt": to}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var r []*CcuSample
+	if err = cursor.All(ctx, &r); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return r, nil
+}
+
+// 清理离线成员并采样，多个进程同时采样时按时间覆盖
+func sampleCcu(ctx context.Context, app *App) (err error) {
+	now := time.Now()
+	before := strconv.FormatFloat(
+		toMillis(now.Add(-app.getPresenceWindow())), 'f', 0, 64)
+	expired := strconv.FormatFloat(
+		toMillis(now.Add(-dbPresenceRetention)), 'f', 0, 64)
+	indexes, err := rdbAuth.SMembers(ctx, getPresenceIndexesKey(app.Id)).Result()
+	if err != nil {
+		return
+	}
+	if _, err = rdbAuth.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRemRangeByScore(ctx, getUserOnlineKey(app.Id), "-inf", "("+before)
+		p.ZRemRangeByScore(ctx, getRoleOnlineKey(app.Id), "-inf", "("+before)
+		for _, s := range indexes {
+			if index, err := strconv.ParseUint(s, 10, 32); err == nil {
+				p.ZRemRangeByScore(ctx,
+					getIndexOnlineKey(app.Id, uint32(index)), "-inf", "("+before)
+			}
+		}
+		p.ZRemRangeByScore(ctx, getUserPresenceKey(app.Id), "-inf", "("+expired)
+		p.ZRemRangeByScore(ctx, getRolePresenceKey(app.Id), "-inf", "("+expired)
+		return nil
+	}); err != nil {
+		return
+	}
+	x, err := CountOnline(ctx, app.Id)
+	if err != nil {
+		return
+	}
+	collection, err := getCcuCollection(ctx, app.Id)
+	if err != nil {
+		return
+	}
+	x.Time = now.Truncate(dbCcuSampleInterval)
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": x.Time},
+		bson.M{"$set": bson.M{
+			"users":     x.Users,
+			"roles":     x.Roles,
+			"indexes":   x.Indexes,
+			"expire_at": x.Time.Add(dbCcuRetention),
+		}},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		return
+	}
+	return
+}
+
+func serveCcuSample(ctx context.Context) {
+	for {
+		for _, app := range ListApps() {
+			if err := sampleCcu(ctx, app); err != nil {
+				log.Warnf("failed to sample ccu: %v, %v", app.Id, err)
+			}
+		}
+		// 对齐到下一个采样时间，加少量抖动
+		now := time.Now()
+		next := now.Truncate(dbCcuSampleInterval).Add(dbCcuSampleInterval)
+		jitter := time.Duration(rand.Int63n(int64(5 * time.Second)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now) + jitter):
+		}
+	}
+}
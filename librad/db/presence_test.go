@@ -0,0 +1,66 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testpresence"})
+
+	if err := rdbAuth.Del(ctx,
+		getUserPresenceKey(app.Id), getUserOnlineKey(app.Id),
+		getRolePresenceKey(app.Id), getRoleOnlineKey(app.Id),
+		getIndexOnlineKey(app.Id, 1), getPresenceIndexesKey(app.Id),
+	).Err(); err != nil {
+		t.Fatalf("failed to reset presence: %v", err)
+	}
+	// 登录时记录活跃
+	u1 := testLoginUser(t, ctx, app, "acct1")
+	u2 := testLoginUser(t, ctx, app, "acct2")
+	touchPresence(ctx, app.Id, u1.Id, "role1", 1)
+
+	users, err := GetUserPresence(
+		ctx, app.Id, []string{u1.Id, u2.Id, "user3"})
+	if err != nil {
+		t.Fatalf("failed to get presence: %v", err)
+	}
+	if len(users) != 3 || !users[0].Online || !users[1].Online ||
+		users[2].Online || !users[2].LastSeen.IsZero() {
+		t.Fatalf("unexpected presence: %+v, %+v, %+v",
+			users[0], users[1], users[2])
+	}
+	x, err := CountOnline(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to count online: %v", err)
+	}
+	if x.Users != 2 || x.Roles != 1 || x.Indexes["1"] != 1 {
+		t.Fatalf("unexpected sample: %+v", x)
+	}
+
+	// 采样后可以按时间查询
+	if err = sampleCcu(ctx, app); err != nil {
+		t.Fatalf("failed to sample ccu: %v", err)
+	}
+	now := time.Now()
+	samples, err := ListCcuSamples(
+		ctx, app.Id, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to list samples: %v", err)
+	}
+	if len(samples) != 1 || samples[0].Users != 2 || samples[0].Roles != 1 {
+		t.Fatalf("unexpected samples: %+v", samples)
+	}
+
+	// 登出后离线，保留最后活跃时间
+	if err = LogoutUser(ctx, u2.Id); err != nil {
+		t.Fatalf("failed to logout user: %v", err)
+	}
+	if users, err = GetUserPresence(
+		ctx, app.Id, []string{u2.Id}); err != nil {
+		t.Fatalf("failed to get presence: %v", err)
+	}
+	if users[0].Online || users[0].LastSeen.IsZero() {
+		t.Fatalf("unexpected presence: %+v", users[0])
+	}
+}
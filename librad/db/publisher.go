@@ -0,0 +1,302 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 发行商账号
+// 同一发行商下的应用可以共享玩家身份。发行商有独立的身份集合，
+// 应用登录时用配置的共享账号(如邮箱、手机号、第三方账号)找到或创建身份，
+// 并把"p$<身份ID>"作为账号ID自动绑定到本应用的用户上。
+//
+// 隔离与授权规则：
+// 1. 只有配置了相同发行商的应用共享身份，未配置发行商的应用完全隔离；
+// 2. 只有应用配置的共享账号前缀参与关联，游客和设备账号不会跨应用；
+// 3. 玩家可以撤回某个应用的关联授权，撤回后不再自动关联；
+// 4. 关联应用列表只包含同一发行商的应用ID和关联时间，不暴露其他应用的用户数据。
+
+// 发行商身份账号ID的前缀
+const PublisherAcctIdPrefix = "p$"
+
+var (
+	dbPublisherCollectionMu sync.Mutex
+	dbPublisherCollection   = make(map[string]*mongo.Collection)
+)
+
+type PublisherIdentity struct {
+	Id string `bson:"_id"`
+	// 共享的账号列表
+	AcctIds []string `bson:"acct_ids,omitempty"`
+	// 应用ID到关联
+	Apps map[string]*PublisherAppLink `bson:"apps,omitempty"`
+	// 撤回授权的应用
+	OptOuts []string `bson:"opt_outs,omitempty"`
+	// 创建时间
+	CreateAt time.Time `bson:"create_at,omitempty"`
+}
+
+type PublisherAppLink struct {
+	// 应用ID，不保存
+	AppId string `bson:"-"`
+	// 应用内的用户ID
+	UserId string `bson:"user_id"`
+	// 关联时间
+	LinkAt time.Time `bson:"link_at"`
+}
+
+func getPublisherDBName(publisher string) string {
+	return cfg.AppDBNamePrefix + "publisher_" + publisher
+}
+
+func getPublisherCollection(
+	ctx context.Context, publisher string) (*mongo.Collection, error) {
+	dbPublisherCollectionMu.Lock()
+	defer dbPublisherCollectionMu.Unlock()
+
+	if collection, ok := dbPublisherCollection[publisher]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.identities"
+	dbName := getPublisherDBName(publisher)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	if _, err := collection.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "acct_ids", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	dbPublisherCollection[publisher] = collection
+	return collection, nil
+}
+
+// 用户账号中参与发行商关联的部分
+func getPublisherSharedAcctIds(app *App, acctIds []string) (r []string) {
+	for _, acctId := range acctIds {
+		for _, prefix := range app.PublisherAcctIdPrefixes {
+			if strings.HasPrefix(acctId, prefix) {
+				r = append(r, acctId)
+				break
+			}
+		}
+	}
+	return
+}
+
+func getPublisherIdentityId(acctIds []string) string {
+	for _, acctId := range acctIds {
+		if strings.HasPrefix(acctId, PublisherAcctIdPrefix) {
+			return acctId[len(PublisherAcctIdPrefix):]
+		}
+	}
+	return ""
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 登录时关联发行商身份，失败不影响登录
+func linkPublisherIdentity(ctx context.Context, app *App, user *User) {
+	if app.Publisher == "" {
+		return
+	}
+	shared := getPublisherSharedAcctIds(app, user.AcctIds)
+	if len(shared) == 0 {
+		return
+	}
+	if err := func() (err error) {
+		collection, err := getPublisherCollection(ctx, app.Publisher)
+		if err != nil {
+			return
+		}
+		x := &PublisherIdentity{}
+		// 与用户登录相同，共享账号映射到多个身份时addToSet失败
+		if err = collection.FindOneAndUpdate(
+			ctx,
+			bson.M{
+				"acct_ids": bson.M{
+					"$elemMatch": bson.M{
+						"$in": shared,
+					},
+				},
+			},
+			bson.M{
+				"$addToSet": bson.M{
+					"acct_ids": bson.M{
+						"$each": shared,
+					},
+				},
+				"$setOnInsert": bson.M{
+					"_id":       newPublisherIdentityId(),
+					"create_at": time.Now(),
+				},
+			},
+			options.FindOneAndUpdate().SetUpsert(true),
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(x); err != nil {
+			return
+		}
+		if containsString(x.OptOuts, app.Id) {
+			return
+		}
+		if link, ok := x.Apps[app.Id]; !ok || link.UserId != user.Id {
+			if _, err = collection.UpdateOne(
+				ctx,
+				bson.M{"_id": x.Id},
+				bson.M{"$set": bson.M{
+					"apps." + app.Id: &PublisherAppLink{
+						UserId: user.Id,
+						LinkAt: time.Now(),
+					},
+				}},
+			); err != nil {
+				return
+			}
+		}
+		acctId := PublisherAcctIdPrefix + x.Id
+		if containsString(user.AcctIds, acctId) {
+			return
+		}
+		users, err := getUserCollection(ctx, app.Id)
+		if err != nil {
+			return
+		}
+		// 每个用户只关联一个身份
+		if _, err = users.UpdateOne(
+			ctx,
+			bson.M{
+				"_id": user.Id,
+				"acct_ids": bson.M{
+					"$not": primitive.Regex{
+						Pattern: "^" + regexp.QuoteMeta(PublisherAcctIdPrefix),
+					},
+				},
+			},
+			bson.M{"$addToSet": bson.M{"acct_ids": acctId}},
+		); err != nil {
+			return
+		}
+		user.AcctIds = append(user.AcctIds, acctId)
+		return
+	}(); err != nil {
+		log.Warnf("failed to link publisher identity: %v, %v, %v",
+			app.Id, user.Id, err)
+	}
+}
+
+// 用户关联的身份，撤回授权后用户上没有身份账号，使用共享账号查找
+func getUserPublisherIdentity(
+	ctx context.Context, app *App, userId string) (
+	_ *PublisherIdentity, err error) {
+	if app.Publisher == "" {
+		return nil, ErrPublisherIdentityNotFound
+	}
+	user, err := GetUser(ctx, app.Id, userId)
+	if err != nil {
+		return
+	}
+	var filter bson.M
+	if id := getPublisherIdentityId(user.AcctIds); id != "" {
+		filter = bson.M{"_id": id}
+	} else if shared := getPublisherSharedAcctIds(
+		app, user.AcctIds); len(shared) > 0 {
+		filter = bson.M{"acct_ids": bson.M{"$in": shared}}
+	} else {
+		return nil, ErrPublisherIdentityNotFound
+	}
+	collection, err := getPublisherCollection(ctx, app.Publisher)
+	if err != nil {
+		return
+	}
+	x := &PublisherIdentity{}
+	if err = collection.FindOne(ctx, filter).Decode(x); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrPublisherIdentityNotFound
+		}
+		log.Warnf("failed to access mongo: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return x, nil
+}
+
+// 玩家关联的同一发行商下的应用，按关联时间排序
+func ListPublisherLinkedApps(
+	ctx context.Context, app *App, userId string) (
+	_ []*PublisherAppLink, err error) {
+	x, err := getUserPublisherIdentity(ctx, app, userId)
+	if err != nil {
+		return
+	}
+	links := make([]*PublisherAppLink, 0, len(x.Apps))
+	for appId, link := range x.Apps {
+		// 应用离开发行商后不再展示
+		if other := FindAppById(appId); other == nil ||
+			other.Publisher != app.Publisher {
+			continue
+		}
+		links = append(links, &PublisherAppLink{
+			AppId:  appId,
+			LinkAt: link.LinkAt,
+		})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].LinkAt.Before(links[j].LinkAt)
+	})
+	return links, nil
+}
+
+// 撤回或恢复本应用的关联授权，撤回时解除用户与身份的绑定，
+// 恢复后下次登录重新关联
+func SetPublisherLinkConsent(
+	ctx context.Context, app *App, userId string, consent bool) (err error) {
+	x, err := getUserPublisherIdentity(ctx, app, userId)
+	if err != nil {
+		return
+	}
+	collection, err := getPublisherCollection(ctx, app.Publisher)
+	if err != nil {
+		return
+	}
+	update := bson.M{"$pull": bson.M{"opt_outs": app.Id}}
+	if !consent {
+		update = bson.M{
+			"$addToSet": bson.M{"opt_outs": app.Id},
+			"$unset":    bson.M{"apps." + app.Id: ""},
+		}
+	}
+	if _, err = collection.UpdateOne(
+		ctx, bson.M{"_id": x.Id}, update); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if !consent {
+		if _, err = UnbindAcctIdFromUser(
+			ctx, app.Id, userId,
+			[]string{PublisherAcctIdPrefix + x.Id}); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package db
+
+import "testing"
+
+func TestPublisherLink(t *testing.T) {
+	const publisher = "testpub"
+	app1, ctx := testSetup(t, &App{
+		Id: "testpublisher1", Publisher: publisher,
+		PublisherAcctIdPrefixes: []string{"email:"},
+	})
+	app2, _ := testSetup(t, &App{
+		Id: "testpublisher2", Publisher: publisher,
+		PublisherAcctIdPrefixes: []string{"email:"},
+	})
+
+	if err := mdb.Database(
+		getPublisherDBName(publisher)).Drop(ctx); err != nil {
+		t.Fatalf("failed to drop database: %v", err)
+	}
+	u1 := testLoginUser(t, ctx, app1, "email:a", "dev1")
+	u2 := testLoginUser(t, ctx, app2, "email:a", "dev2")
+	if getPublisherIdentityId(u1.AcctIds) == "" ||
+		getPublisherIdentityId(u1.AcctIds) != getPublisherIdentityId(u2.AcctIds) {
+		t.Fatalf("unexpected acct ids: %v, %v", u1.AcctIds, u2.AcctIds)
+	}
+	links, err := ListPublisherLinkedApps(ctx, app1, u1.Id)
+	if err != nil {
+		t.Fatalf("failed to list linked apps: %v", err)
+	}
+	if len(links) != 2 || links[0].AppId != app1.Id ||
+		links[1].AppId != app2.Id || links[0].UserId != "" {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+
+	// 撤回授权后解除绑定，再次登录也不会关联
+	if err = SetPublisherLinkConsent(ctx, app2, u2.Id, false); err != nil {
+		t.Fatalf("failed to withdraw consent: %v", err)
+	}
+	if u2, _, err = LoginUser(
+		ctx, app2, "127.0.0.1", "", []string{"dev2"}, false, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	if id := getPublisherIdentityId(u2.AcctIds); id != "" {
+		t.Fatalf("unexpected identity: %v", id)
+	}
+	if links, err = ListPublisherLinkedApps(ctx, app1, u1.Id); err != nil {
+		t.Fatalf("failed to list linked apps: %v", err)
+	}
+	if len(links) != 1 || links[0].AppId != app1.Id {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+
+	// 恢复授权后下次登录重新关联
+	if err = SetPublisherLinkConsent(ctx, app2, u2.Id, true); err != nil {
+		t.Fatalf("failed to restore consent: %v", err)
+	}
+	if u2, _, err = LoginUser(
+		ctx, app2, "127.0.0.1", "", []string{"dev2"}, false, nil); err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	if getPublisherIdentityId(u2.AcctIds) != getPublisherIdentityId(u1.AcctIds) {
+		t.Fatalf("unexpected acct ids: %v", u2.AcctIds)
+	}
+}
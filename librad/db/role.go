@@ -27,6 +27,40 @@ type Role struct {
 	SignInAt time.Time `bson:"sign_in_at,omitempty"`
 	// 元数据
 	Metadata map[string]string `bson:"metadata,omitempty"`
+	// 角色名，由名字服务维护
+	Name string `bson:"name,omitempty"`
+	// 未删除，只用于序号的唯一索引，查询依然以删除时间为准
+	Alive bool `bson:"alive,omitempty"`
+	// 删除时间，软删除的角色在彻底清除前可以恢复
+	DeleteAt time.Time `bson:"delete_at,omitempty"`
+	// 彻底清除时间
+	PurgeAt time.Time `bson:"purge_at,omitempty"`
+	// 已确认清除了该角色数据的清除方
+	PurgedBy []string `bson:"purged_by,omitempty"`
+}
+
+// 未删除的角色
+var dbRoleAliveFilter = bson.M{"delete_at": bson.M{"$exists": false}}
+
+const (
+	// 旧版本的唯一索引，包含了已删除的角色
+	dbRoleLegacyIndexName = "user_id_1_index_1"
+	// 只约束未删除角色的唯一索引
+	// 部分索引不支持$exists: false，未删除的角色需要显式的alive字段
+	dbRoleAliveIndexName = "user_id_1_index_1_alive"
+)
+
+func newRoleAliveIndexModel() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "index", Value: 1},
+		},
+		Options: options.Index().
+			SetName(dbRoleAliveIndexName).
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"alive": true}),
+	}
 }
 
 // get role collection of app
@@ -43,14 +77,16 @@ func getRoleCollection(
 	dbName := getAppDBName(appId)
 
 	collection := mdb.Database(dbName).Collection(tblName)
-	if _, err := collection.Indexes().CreateOne(
+	// 旧索引的替换在migrateRoleIndexes中进行
+	if _, err := collection.Indexes().CreateMany(
 		ctx,
-		mongo.IndexModel{
-			Keys: bson.D{
-				{Key: "user_id", Value: 1},
-				{Key: "index", Value: 1},
+		[]mongo.IndexModel{
+			newRoleAliveIndexModel(),
+			{
+				Keys: bson.D{{Key: "purge_at", Value: 1}},
+				Options: options.Index().SetPartialFilterExpression(
+					bson.M{"purge_at": bson.M{"$exists": true}}),
 			},
-			Options: options.Index().SetUnique(true),
 		},
 	); err != nil {
 		return nil, fmt.Errorf("failed to create index: %w", err)
@@ -117,7 +153,10 @@ func GetRolesByUserId(
 	}
 	cursor, err := collection.Find(
 		ctx,
-		bson.M{"user_id": bson.M{"$in": userIds}},
+		bson.M{
+			"user_id":   bson.M{"$in": userIds},
+			"delete_at": dbRoleAliveFilter["delete_at"],
+		},
 	)
 	if err != nil {
 		return
@@ -135,7 +174,10 @@ func ListRoles(
 	if err != nil {
 		return
 	}
-	cur, err := collection.Find(ctx, bson.M{"user_id": userId})
+	cur, err := collection.Find(ctx, bson.M{
+		"user_id":   userId,
+		"delete_at": dbRoleAliveFilter["delete_at"],
+	})
 	if err != nil {
 		return
 	}
@@ -162,26 +204,57 @@ func CreateRole(
 		UserId:   userId,
 		Index:    index,
 		CreateAt: time.Now(),
+		Alive:    true,
+	}
+	hookEvent := &HookEvent{
+		UserId:    userId,
+		RoleId:    role.Id,
+		RoleIndex: index,
 	}
-	if _, err = collection.InsertOne(ctx, role); err != nil {
+	if err = runPreHooks(
+		ctx, app, HookEventRoleCreate, hookEvent); err != nil {
 		return
 	}
+	if err = acquireZoneSeat(ctx, appId, index); err != nil {
+		return
+	}
+	if err = runEventTx(ctx, appId, func(ctx context.Context) (err error) {
+		if _, err = collection.InsertOne(ctx, role); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrRoleIndexAlreadyExists
+			}
+			log.Warnf("failed to access mongo: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		return emitEvent(ctx, appId, EventRoleCreated, map[string]interface{}{
+			"user_id":    userId,
+			"role_id":    role.Id,
+			"role_index": int64(index),
+		})
+	}); err != nil {
+		releaseZoneSeat(ctx, appId, index)
+		return
+	}
+	runPostHooks(app, HookEventRoleCreate, hookEvent)
 	return role, nil
 }
 
 func SignInRole(
 	ctx context.Context, appId /*,userId*/, roleId string) (err error) {
+	app := FindAppById(appId)
+	if app == nil {
+		return ErrInvalidAppId
+	}
 	collection, err := getRoleCollection(ctx, appId)
 	if err != nil {
 		return
 	}
+	filter := bson.M{
+		"_id":       roleId, /*, "user_id": userId*/
+		"delete_at": dbRoleAliveFilter["delete_at"],
+	}
 	var role Role
-	if err = collection.FindOneAndUpdate(
-		ctx,
-		bson.M{"_id": roleId /*, "user_id": userId*/},
-		bson.M{"$set": bson.M{"sign_in_at": time.Now()}},
-		options.FindOneAndUpdate().SetReturnDocument(options.After),
-	).Decode(&role); err != nil {
+	if err = collection.FindOne(ctx, filter).Decode(&role); err != nil {
 		if err == mongo.ErrNoDocuments {
 			err = ErrRoleNotFound
 		} else {
@@ -189,6 +262,16 @@ func SignInRole(
 		}
 		return
 	}
+	// 被否决时不更新登录时间，也没有事件
+	hookEvent := &HookEvent{
+		UserId:    role.UserId,
+		RoleId:    roleId,
+		RoleIndex: role.Index,
+	}
+	if err = runPreHooks(
+		ctx, app, HookEventRoleSignIn, hookEvent); err != nil {
+		return
+	}
 	// update sess data
 	b, _ := msgpack.Marshal(&SessData{
 		RoleId:    roleId,
@@ -203,43 +286,37 @@ func SignInRole(
 			return ErrDatabaseUnavailable
 		}
 	}
+	touchPresence(ctx, appId, role.UserId, roleId, role.Index)
+	// 登录时间和事件在同一个事务中写入
+	if err = runEventTx(ctx, appId, func(ctx context.Context) error {
+		r, err := collection.UpdateOne(
+			ctx, filter, bson.M{"$set": bson.M{"sign_in_at": time.Now()}})
+		if err != nil {
+			log.Warnf("failed to access mongo: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		if r.MatchedCount == 0 {
+			return ErrRoleNotFound
+		}
+		return emitEvent(ctx, appId, EventRoleSignedIn, map[string]interface{}{
+			"user_id":    role.UserId,
+			"role_id":    roleId,
+			"role_index": int64(role.Index),
+		})
+	}); err != nil {
+		return
+	}
+	runPostHooks(app, HookEventRoleSignIn, hookEvent)
 	return
 }
 
 func SetRoleMetadata(
 	ctx context.Context, appId /*, userId*/, roleId string,
 	md map[string]string) (err error) {
-	collection, err := getRoleCollection(ctx, appId)
-	if err != nil {
+	if len(md) == 0 {
 		return
 	}
-	set, unset := bson.M{}, bson.M{}
-	for key, val := range md {
-		if val != "" {
-			set["metadata."+key] = val
-		} else {
-			unset["metadata."+key] = 1
-		}
-	}
-	if len(set) > 0 || len(unset) > 0 {
-		update := bson.M{}
-		if len(set) > 0 {
-			update["$set"] = set
-		}
-		if len(unset) > 0 {
-			update["$unset"] = unset
-		}
-		if r, err := collection.UpdateOne(
-			ctx,
-			bson.M{"_id": roleId /*, "user_id": userId*/},
-			update,
-		); err != nil {
-			log.Warnf("failed to access user: %v", err)
-			return ErrDatabaseUnavailable
-		} else if r.MatchedCount == 0 {
-			return ErrUserNotFound
-		}
-	}
+	_, err = UpdateRoleMetadata(ctx, appId, roleId, toMetadataOps(md))
 	return
 }
 
@@ -251,18 +328,139 @@ func AlterRoleIndex(
 		return
 	}
 	var role Role
+	if err = collection.FindOne(
+		ctx,
+		bson.M{
+			"_id":       roleId,
+			"delete_at": dbRoleAliveFilter["delete_at"],
+		},
+	).Decode(&role); err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = ErrRoleNotFound
+		} else {
+			err = ErrDatabaseUnavailable
+		}
+		return
+	}
+	if role.Index == index {
+		return &role, nil
+	}
+	oldIndex := role.Index
+	// 分区命名时角色名跟随角色到新区服
+	app := FindAppById(appId)
+	moveName := false
+	if app != nil && role.Name != "" {
+		if moveName, err = isRoleNamePerZone(ctx, app, false); err != nil {
+			return
+		}
+	}
+	if moveName {
+		if err = reserveRoleName(
+			ctx, app, &Role{Id: roleId, Index: index}, role.Name); err != nil {
+			return
+		}
+	}
+	// 先占用新区服的名额，成功后归还旧区服的名额
+	if err = acquireZoneSeat(ctx, appId, index); err != nil {
+		if moveName {
+			cancelRoleName(ctx, app, &Role{Id: roleId, Index: index}, role.Name)
+		}
+		return
+	}
 	if err = collection.FindOneAndUpdate(
 		ctx,
-		bson.M{"_id": roleId},
+		bson.M{
+			"_id":       roleId,
+			"index":     role.Index,
+			"delete_at": dbRoleAliveFilter["delete_at"],
+		},
 		bson.M{"$set": bson.M{"index": index}},
 		options.FindOneAndUpdate().SetReturnDocument(options.After),
 	).Decode(&role); err != nil {
+		releaseZoneSeat(ctx, appId, index)
+		if moveName {
+			cancelRoleName(ctx, app, &Role{Id: roleId, Index: index}, role.Name)
+		}
 		if err == mongo.ErrNoDocuments {
 			err = ErrRoleNotFound
+		} else if mongo.IsDuplicateKeyError(err) {
+			err = ErrRoleIndexAlreadyExists
 		} else {
 			err = ErrDatabaseUnavailable
 		}
 		return
 	}
+	releaseZoneSeat(ctx, appId, oldIndex)
+	if moveName {
+		if err = releaseRoleName(
+			ctx, app, &Role{Id: roleId, Index: oldIndex}, role.Name); err != nil {
+			return
+		}
+	}
 	return &role, nil
 }
+
+// 旧版本的唯一索引包含了已删除的角色，删除的角色会一直占用序号，
+// 替换为只约束未删除角色的部分索引。
+// 先给未删除的角色补上alive字段并创建新索引，确认成功后再删除旧索引，
+// 迁移过程中唯一约束始终有效。
+func migrateRoleIndex(ctx context.Context, appId string) (err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return
+	}
+	var legacy, alive bool
+	for _, index := range indexes {
+		switch index.Name {
+		case dbRoleLegacyIndexName:
+			legacy = true
+		case dbRoleAliveIndexName:
+			alive = true
+		}
+	}
+	if !legacy {
+		return
+	}
+	if !alive {
+		return fmt.Errorf("missing index: %s", dbRoleAliveIndexName)
+	}
+	// 旧版本创建的角色没有alive字段
+	filter := bson.M{"alive": bson.M{"$ne": true}}
+	for k, v := range dbRoleAliveFilter {
+		filter[k] = v
+	}
+	if _, err = collection.UpdateMany(
+		ctx, filter, bson.M{"$set": bson.M{"alive": true}}); err != nil {
+		return
+	}
+	if _, err = collection.Indexes().DropOne(
+		ctx, dbRoleLegacyIndexName); err != nil {
+		return
+	}
+	log.Infow("legacy role index dropped", "app_id", appId)
+	return
+}
+
+// 迁移尚未迁移的应用，随应用列表的加载定期调用，失败的应用下次重试
+func migrateRoleIndexes(ctx context.Context, migrated map[string]bool) {
+	for _, app := range ListApps() {
+		if migrated[app.Id] {
+			continue
+		}
+		if err := migrateRoleIndex(ctx, app.Id); err != nil {
+			log.Warnf("failed to migrate role index: %v, %v", app.Id, err)
+			continue
+		}
+		migrated[app.Id] = true
+	}
+}
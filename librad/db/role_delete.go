@@ -0,0 +1,325 @@
+package db
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 角色删除
+// 删除的角色先被隐藏，保留期内可以恢复，过期后由后台任务彻底清除，
+// 同时清除其他服务中属于该角色的数据。
+
+// 单次清除的最大角色数
+const dbRolePurgeBatchSize = 100
+
+var (
+	dbRolePurgerCollection *mongo.Collection
+
+	// 如果会话绑定的是被删除的角色，解除绑定
+	luaClearSessRole = redis.NewScript(`
+local b = redis.call("GET", KEYS[1])
+if not b then return nil end
+local d = cmsgpack.unpack(b)
+if not d.data or d.data.roleId ~= ARGV[1] then return 0 end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl <= 0 then return nil end
+d.data.roleId = ""
+d.data.roleIndex = 0
+redis.call("PSETEX", KEYS[1], ttl, cmsgpack.pack(d))
+return 1`)
+)
+
+// 清除角色在其他服务中的数据，每次传入一批到期的角色
+type RolePurger func(ctx context.Context, appId string, roles []*Role) error
+
+type xRolePurger struct {
+	name  string
+	purge RolePurger
+}
+
+var (
+	xRolePurgersMu sync.Mutex
+	xRolePurgers   []xRolePurger
+)
+
+// 注册角色清除回调，只有与db模块运行在同一进程中的服务才会被回调。
+// 清除方的名字会被记录到数据库中，角色要等所有记录过的清除方都确认后才会被删除，
+// 下线的清除方需要从role_purgers中手动删除。
+func RegisterRolePurger(name string, fn RolePurger) {
+	xRolePurgersMu.Lock()
+	defer xRolePurgersMu.Unlock()
+	xRolePurgers = append(xRolePurgers, xRolePurger{name: name, purge: fn})
+}
+
+func getRolePurgers() []xRolePurger {
+	xRolePurgersMu.Lock()
+	defer xRolePurgersMu.Unlock()
+	return append([]xRolePurger{}, xRolePurgers...)
+}
+
+func getRolePurgerCollection(
+	ctx context.Context) (*mongo.Collection, error) {
+	if dbRolePurgerCollection != nil {
+		return dbRolePurgerCollection, nil
+	}
+	const collectionName = "role_purgers"
+	collection := mdb.Database(cfg.ConfigDBName).Collection(collectionName)
+	dbRolePurgerCollection = collection
+	return collection, nil
+}
+
+// 记录本进程中的清除方，返回所有进程记录过的清除方
+func syncRolePurgers(
+	ctx context.Context, local []xRolePurger) (_ []string, err error) {
+	collection, err := getRolePurgerCollection(ctx)
+	if err != nil {
+		return
+	}
+	for _, x := range local {
+		if _, err = collection.UpdateOne(
+			ctx,
+			bson.M{"_id": x.name},
+			bson.M{"$setOnInsert": bson.M{"register_at": time.Now()}},
+			options.Update().SetUpsert(true),
+		); err != nil {
+			return
+		}
+	}
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return
+	}
+	var docs []struct {
+		Name string `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &docs); err != nil {
+		return
+	}
+	names := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		names = append(names, doc.Name)
+	}
+	return names, nil
+}
+
+func DeleteRole(
+	ctx context.Context, appId, roleId string) (_ *Role, err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	role := &Role{}
+	if err = collection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":       roleId,
+			"delete_at": dbRoleAliveFilter["delete_at"],
+		},
+		bson.M{
+			"$set": bson.M{
+				"delete_at": now,
+				"purge_at":  now.Add(cfg.Role.retention),
+			},
+			// 释放序号
+			"$unset": bson.M{"alive": 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(role); err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = ErrRoleNotFound
+		} else {
+			log.Warnf("failed to access mongo: %v", err)
+			err = ErrDatabaseUnavailable
+		}
+		return
+	}
+	// 删除后归还区服名额，恢复时重新占用
+	releaseZoneSeat(ctx, appId, role.Index)
+	if err = clearSessRole(ctx, role.UserId, role.Id); err != nil {
+		return
+	}
+	return role, nil
+}
+
+func RestoreRole(
+	ctx context.Context, appId, roleId string) (_ *Role, err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	// 已到清除时间的角色随时可能被清除，不允许恢复
+	filter := bson.M{
+		"_id":       roleId,
+		"delete_at": bson.M{"$exists": true},
+		"purge_at":  bson.M{"$gt": time.Now()},
+	}
+	role := &Role{}
+	if err = collection.FindOne(ctx, filter).Decode(role); err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = ErrRoleNotFound
+		} else {
+			log.Warnf("failed to access mongo: %v", err)
+			err = ErrDatabaseUnavailable
+		}
+		return
+	}
+	// 删除期间区服可能已满
+	if err = acquireZoneSeat(ctx, appId, role.Index); err != nil {
+		return
+	}
+	if err = collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{
+			"$set": bson.M{"alive": true},
+			"$unset": bson.M{
+				"delete_at": 1,
+				"purge_at":  1,
+			},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(role); err != nil {
+		releaseZoneSeat(ctx, appId, role.Index)
+		if err == mongo.ErrNoDocuments {
+			err = ErrRoleNotFound
+		} else if mongo.IsDuplicateKeyError(err) {
+			// 删除期间该序号已创建了新的角色
+			err = ErrRoleIndexAlreadyExists
+		} else {
+			log.Warnf("failed to access mongo: %v", err)
+			err = ErrDatabaseUnavailable
+		}
+		return
+	}
+	return role, nil
+}
+
+func clearSessRole(ctx context.Context, userId, roleId string) (err error) {
+	if err = luaClearSessRole.Run(
+		ctx, rdbAuth, []string{userId}, roleId).Err(); err != nil {
+		if err == redis.Nil {
+			return nil // 不在线
+		}
+		log.Warnf("failed to update session: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 清除到期的角色
+// 本进程中的清除方先清除各自的数据并在角色上确认，
+// 所有清除方都确认过的角色才会被删除，其他进程中的清除方未确认前角色会一直保留。
+func purgeRoles(
+	ctx context.Context, appId string,
+	local []xRolePurger, names []string) (err error) {
+	collection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, x := range local {
+		var roles []*Role
+		if roles, err = findPurgeRoles(ctx, collection, bson.M{
+			"purge_at":  bson.M{"$lte": now},
+			"purged_by": bson.M{"$ne": x.name},
+		}); err != nil {
+			return
+		}
+		if len(roles) == 0 {
+			continue
+		}
+		// 清除失败的下次重试
+		if err := x.purge(ctx, appId, roles); err != nil {
+			log.Warnf("failed to purge role data: %v, %v, %v",
+				appId, x.name, err)
+			continue
+		}
+		roleIds := make([]string, 0, len(roles))
+		for _, role := range roles {
+			roleIds = append(roleIds, role.Id)
+		}
+		if _, err = collection.UpdateMany(
+			ctx,
+			bson.M{"_id": bson.M{"$in": roleIds}},
+			bson.M{"$addToSet": bson.M{"purged_by": x.name}},
+		); err != nil {
+			return
+		}
+	}
+	filter := bson.M{"purge_at": bson.M{"$lte": now}}
+	if len(names) > 0 {
+		filter["purged_by"] = bson.M{"$all": names}
+	}
+	roles, err := findPurgeRoles(ctx, collection, filter)
+	if err != nil {
+		return
+	}
+	for _, role := range roles {
+		var res *mongo.DeleteResult
+		if res, err = collection.DeleteOne(
+			ctx,
+			bson.M{
+				"_id":      role.Id,
+				"purge_at": bson.M{"$lte": now},
+			},
+		); err != nil {
+			return
+		}
+		// 已被其他进程删除
+		if res.DeletedCount == 0 {
+			continue
+		}
+		if app := FindAppById(appId); app != nil && role.Name != "" {
+			if err = releaseRoleName(ctx, app, role, role.Name); err != nil {
+				return
+			}
+		}
+		log.Infow("role purged", "app_id", appId, "role_id", role.Id)
+	}
+	return
+}
+
+func findPurgeRoles(
+	ctx context.Context, collection *mongo.Collection, filter bson.M) (
+	_ []*Role, err error) {
+	cursor, err := collection.Find(
+		ctx, filter, options.Find().SetLimit(dbRolePurgeBatchSize))
+	if err != nil {
+		return
+	}
+	var roles []*Role
+	if err = cursor.All(ctx, &roles); err != nil {
+		return
+	}
+	return roles, nil
+}
+
+func serveRolePurge(ctx context.Context) {
+	for {
+		local := getRolePurgers()
+		if names, err := syncRolePurgers(ctx, local); err != nil {
+			log.Warnf("failed to sync role purgers: %v", err)
+		} else {
+			for _, app := range ListApps() {
+				if err := purgeRoles(ctx, app.Id, local, names); err != nil {
+					log.Warnf("failed to purge roles: %v, %v", app.Id, err)
+				}
+			}
+		}
+		jitter := time.Duration(rand.Int63n(int64(time.Minute)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5*time.Minute + jitter): // [5m,6m)
+		}
+	}
+}
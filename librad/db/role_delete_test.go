@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPurgeRoles(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testrolepurge"})
+
+	role := testCreateRole(t, ctx, app.Id, "testuser", 1)
+	if _, err := DeleteRole(ctx, app.Id, role.Id); err != nil {
+		t.Fatalf("failed to delete role: %v", err)
+	}
+	collection, err := getRoleCollection(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to get role collection: %v", err)
+	}
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": role.Id},
+		bson.M{"$set": bson.M{"purge_at": time.Now().Add(-time.Second)}},
+	); err != nil {
+		t.Fatalf("failed to update role: %v", err)
+	}
+	countRoles := func() int64 {
+		n, err := collection.CountDocuments(ctx, bson.M{"_id": role.Id})
+		if err != nil {
+			t.Fatalf("failed to count roles: %v", err)
+		}
+		return n
+	}
+
+	// 其他进程中的清除方未确认，角色保留
+	if err = purgeRoles(ctx, app.Id, nil, []string{"other"}); err != nil {
+		t.Fatalf("failed to purge roles: %v", err)
+	}
+	if countRoles() != 1 {
+		t.Fatalf("role purged before confirmed")
+	}
+
+	var purged []string
+	local := []xRolePurger{{
+		name: "other",
+		purge: func(ctx context.Context, appId string, roles []*Role) error {
+			for _, role := range roles {
+				purged = append(purged, role.Id)
+			}
+			return nil
+		},
+	}}
+	if err = purgeRoles(ctx, app.Id, local, []string{"other"}); err != nil {
+		t.Fatalf("failed to purge roles: %v", err)
+	}
+	if len(purged) != 1 || purged[0] != role.Id {
+		t.Fatalf("unexpected purged roles: %v", purged)
+	}
+	if countRoles() != 0 {
+		t.Fatalf("role not purged")
+	}
+}
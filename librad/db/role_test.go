@@ -0,0 +1,78 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestRoleIndex(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testrole"})
+
+	const userId = "testuser"
+	r1 := testCreateRole(t, ctx, app.Id, userId, 1)
+	if _, err := CreateRole(
+		ctx, app.Id, userId, 1); err != ErrRoleIndexAlreadyExists {
+		t.Fatalf("expect role index already exists, but got: %v", err)
+	}
+	if _, err := DeleteRole(ctx, app.Id, r1.Id); err != nil {
+		t.Fatalf("failed to delete role: %v", err)
+	}
+	// 已删除的角色不再占用序号
+	testCreateRole(t, ctx, app.Id, userId, 1)
+	if _, err := RestoreRole(
+		ctx, app.Id, r1.Id); err != ErrRoleIndexAlreadyExists {
+		t.Fatalf("expect role index already exists, but got: %v", err)
+	}
+}
+
+func TestMigrateRoleIndex(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testrolemigrate"})
+
+	// 模拟旧版本的数据和索引
+	collection := mdb.Database(getAppDBName(app.Id)).Collection("libra.roles")
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "index", Value: 1},
+		},
+		Options: options.Index().
+			SetName(dbRoleLegacyIndexName).
+			SetUnique(true),
+	}); err != nil {
+		t.Fatalf("failed to create legacy index: %v", err)
+	}
+	if _, err := collection.InsertOne(ctx, bson.M{
+		"_id":     "testrole1",
+		"user_id": "testuser",
+		"index":   1,
+	}); err != nil {
+		t.Fatalf("failed to insert role: %v", err)
+	}
+
+	if err := migrateRoleIndex(ctx, app.Id); err != nil {
+		t.Fatalf("failed to migrate role index: %v", err)
+	}
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err = cursor.All(ctx, &indexes); err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	for _, index := range indexes {
+		if index.Name == dbRoleLegacyIndexName {
+			t.Fatalf("legacy index not dropped")
+		}
+	}
+	// 旧角色补上alive后依然占用序号
+	if _, err = CreateRole(
+		ctx, app.Id, "testuser", 1); err != ErrRoleIndexAlreadyExists {
+		t.Fatalf("expect role index already exists, but got: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 角色转移
+// 角色换绑到其他用户，序号保持不变，每次转移都会留下一条审计记录。
+
+var (
+	// 如果会话绑定的是该角色，删除会话
+	luaKickSessRole = redis.NewScript(`
+local b = redis.call("GET", KEYS[1])
+if not b then return 0 end
+local d = cmsgpack.unpack(b)
+if not d.data or d.data.roleId ~= ARGV[1] then return 0 end
+redis.call("DEL", KEYS[1])
+return 1`)
+)
+
+var (
+	dbRoleTransferCollectionMu sync.Mutex
+	dbRoleTransferCollection   = make(map[string]*mongo.Collection)
+)
+
+type RoleTransfer struct {
+	Id primitive.ObjectID `bson:"_id,omitempty"`
+	// 角色ID
+	RoleId string `bson:"role_id"`
+	// 原用户ID
+	FromUserId string `bson:"from_user_id"`
+	// 新用户ID
+	ToUserId string `bson:"to_user_id"`
+	// 角色序号
+	Index uint32 `bson:"index"`
+	// 操作者，来自可信的管理员ID
+	Operator string `bson:"operator,omitempty"`
+	// 转移原因
+	Reason string `bson:"reason,omitempty"`
+	// 转移时间
+	CreateAt time.Time `bson:"create_at"`
+}
+
+func getRoleTransferCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbRoleTransferCollectionMu.Lock()
+	defer dbRoleTransferCollectionMu.Unlock()
+
+	if collection, ok := dbRoleTransferCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.role_transfers"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	if _, err := collection.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "role_id", Value: 1},
+				{Key: "create_at", Value: -1},
+			},
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	dbRoleTransferCollection[appId] = collection
+	return collection, nil
+}
+
+func TransferRole(
+	ctx context.Context, appId, operator, roleId, toUserId string,
+	reason string) (_ *Role, err error) {
+	if toUserId == "" {
+		return nil, newInvalidArgumentError("user id required")
+	}
+	userCollection, err := getUserCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	roleCollection, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	transferCollection, err := getRoleTransferCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+
+	// 事务提交失败时记录日志并返回ErrDatabaseUnavailable
+	from := &Role{}
+	if err = runTx(
+		ctx,
+		func(ctx context.Context) (err error) {
+			if err = userCollection.FindOne(
+				ctx,
+				bson.M{"_id": toUserId},
+				options.FindOne().SetProjection(bson.M{"_id": 1}),
+			).Err(); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return ErrUserNotFound
+				}
+				log.Warnf("failed to access mongo: %v", err)
+				return ErrDatabaseUnavailable
+			}
+			// 返回转移前的角色，用于记录原用户
+			if err = roleCollection.FindOneAndUpdate(
+				ctx,
+				bson.M{
+					"_id":       roleId,
+					"delete_at": dbRoleAliveFilter["delete_at"],
+				},
+				bson.M{"$set": bson.M{"user_id": toUserId}},
+			).Decode(from); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return ErrRoleNotFound
+				} else if mongo.IsDuplicateKeyError(err) {
+					// 新用户已有相同序号的角色
+					return ErrRoleIndexAlreadyExists
+				}
+				log.Warnf("failed to access mongo: %v", err)
+				return ErrDatabaseUnavailable
+			}
+			if from.UserId == toUserId {
+				return newInvalidArgumentError("role already owned by user")
+			}
+			if _, err = transferCollection.InsertOne(ctx, &RoleTransfer{
+				RoleId:     roleId,
+				FromUserId: from.UserId,
+				ToUserId:   toUserId,
+				Index:      from.Index,
+				Operator:   operator,
+				Reason:     reason,
+				CreateAt:   time.Now(),
+			}); err != nil {
+				log.Warnf("failed to access mongo: %v", err)
+				return ErrDatabaseUnavailable
+			}
+			return
+		},
+	); err != nil {
+		return
+	}
+	role := *from
+	role.UserId = toUserId
+
+	// 角色在线时双方都需要重新登录
+	kicked, err := luaKickSessRole.Run(
+		ctx, rdbAuth, []string{from.UserId}, roleId).Int()
+	if err != nil {
+		log.Warnf("failed to kick session: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	if kicked > 0 {
+		if err = LogoutUser(ctx, toUserId); err != nil {
+			return
+		}
+	}
+	return &role, nil
+}
+
+// 角色的转移记录，按转移时间倒序
+func ListRoleTransfers(
+	ctx context.Context, appId, roleId string) (_ []*RoleTransfer, err error) {
+	collection, err := getRoleTransferCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{"role_id": roleId},
+		options.Find().SetSort(bson.D{{Key: "create_at", Value: -1}}),
+	)
+	if err != nil {
+		log.Warnf("failed to find role transfers: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var transfers []*RoleTransfer
+	if err = cursor.All(ctx, &transfers); err != nil {
+		log.Warnf("failed to decode role transfers: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return transfers, nil
+}
@@ -0,0 +1,38 @@
+package db
+
+import "testing"
+
+func TestTransferRole(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testroletransfer"})
+
+	u1 := testLoginUser(t, ctx, app, "acct1")
+	u2 := testLoginUser(t, ctx, app, "acct2")
+	r1 := testCreateRole(t, ctx, app.Id, u1.Id, 1)
+	if _, err := TransferRole(
+		ctx, app.Id, "admin", r1.Id, "nobody", ""); err != ErrUserNotFound {
+		t.Fatalf("expect user not found, but got: %v", err)
+	}
+	role, err := TransferRole(ctx, app.Id, "admin", r1.Id, u2.Id, "test")
+	if err != nil {
+		t.Fatalf("failed to transfer role: %v", err)
+	}
+	if role.UserId != u2.Id || role.Index != 1 {
+		t.Fatalf("unexpected role: %+v", role)
+	}
+	// 原用户可以在同一序号创建新角色，再转回时序号冲突
+	testCreateRole(t, ctx, app.Id, u1.Id, 1)
+	if _, err = TransferRole(
+		ctx, app.Id, "admin", r1.Id, u1.Id, ""); err != ErrRoleIndexAlreadyExists {
+		t.Fatalf("expect role index already exists, but got: %v", err)
+	}
+	transfers, err := ListRoleTransfers(ctx, app.Id, r1.Id)
+	if err != nil {
+		t.Fatalf("failed to list role transfers: %v", err)
+	}
+	if len(transfers) != 1 ||
+		transfers[0].FromUserId != u1.Id ||
+		transfers[0].ToUserId != u2.Id ||
+		transfers[0].Operator != "admin" {
+		t.Fatalf("unexpected role transfers: %+v", transfers)
+	}
+}
@@ -0,0 +1,421 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/ntons/log-go"
+	"github.com/vmihailenco/msgpack/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 处罚记录
+// 每一次封号、解封、通用封禁都会留下一条记录，当前生效的处罚状态
+// 由未解除且未过期的记录推导而来，历史记录不会被覆盖。
+
+const (
+	// 封号，目标为用户ID
+	SanctionKindBan = "ban"
+	// 通用封禁，目标为封禁键
+	SanctionKindBlock = "block"
+)
+
+// 单次查询最多返回的历史记录数
+const dbMaxSanctionHistory = 100
+
+var (
+	dbSanctionCollectionMu sync.Mutex
+	dbSanctionCollection   = make(map[string]*mongo.Collection)
+)
+
+type Sanction struct {
+	Id primitive.ObjectID `bson:"_id,omitempty"`
+	// 处罚类型
+	Kind string `bson:"kind"`
+	// 处罚目标
+	Target string `bson:"target"`
+	// 处罚范围，为空表示完全封禁，否则只限制该范围对应的权限
+	Scope string `bson:"scope,omitempty"`
+	// 操作者，来自可信的管理员ID
+	Operator string `bson:"operator,omitempty"`
+	// 处罚原因
+	Reason string `bson:"reason,omitempty"`
+	// 处罚时长(秒)
+	Seconds int64 `bson:"seconds,omitempty"`
+	// 处罚时间
+	CreateAt time.Time `bson:"create_at"`
+	// 处罚到期时间
+	ExpireAt time.Time `bson:"expire_at"`
+	// 解除时间
+	LiftAt time.Time `bson:"lift_at,omitempty"`
+	// 解除操作者
+	LiftBy string `bson:"lift_by,omitempty"`
+	// 解除原因
+	LiftFor string `bson:"lift_for,omitempty"`
+}
+
+// 处罚是否生效中
+func (x *Sanction) IsActive(now time.Time) bool {
+	return x.LiftAt.IsZero() && x.ExpireAt.After(now)
+}
+
+func getSanctionCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbSanctionCollectionMu.Lock()
+	defer dbSanctionCollectionMu.Unlock()
+
+	if collection, ok := dbSanctionCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.sanctions"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	if _, err := collection.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "kind", Value: 1},
+				{Key: "target", Value: 1},
+				{Key: "create_at", Value: -1},
+			},
+		},
+	); err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
+	}
+	dbSanctionCollection[appId] = collection
+	return collection, nil
+}
+
+// 添加处罚，seconds为请求的处罚时长，导入等没有时长的处罚为0
+func addSanctions(
+	ctx context.Context, appId, kind, scope, operator string, targets []string,
+	seconds int64, expireAt time.Time, reason string) (
+	_ []*Sanction, err error) {
+	if seconds < 0 {
+		seconds = 0
+	}
+	now := time.Now()
+	sanctions := make([]*Sanction, 0, len(targets))
+	for _, target := range targets {
+		sanctions = append(sanctions, &Sanction{
+			Id:       primitive.NewObjectID(),
+			Kind:     kind,
+			Target:   target,
+			Scope:    scope,
+			Operator: operator,
+			Reason:   reason,
+			Seconds:  seconds,
+			CreateAt: now,
+			ExpireAt: expireAt,
+		})
+	}
+	if err = insertSanctions(ctx, appId, sanctions); err != nil {
+		return
+	}
+	return sanctions, nil
+}
+
+// 封号并在同一个事务中写入封号事件，返回新的处罚记录
+func addSanctionsWithEvents(
+	ctx context.Context, appId, scope, operator string, userIds []string,
+	seconds int64, banTo time.Time, banFor string) (
+	sanctions []*Sanction, err error) {
+	// 事务中不能创建索引，先获取集合
+	if _, err = getSanctionCollection(ctx, appId); err != nil {
+		return
+	}
+	if err = runEventTx(ctx, appId, func(ctx context.Context) (err error) {
+		if sanctions, err = addSanctions(
+			ctx, appId, SanctionKindBan, scope, operator, userIds,
+			seconds, banTo, banFor); err != nil {
+			return
+		}
+		return emitUserBannedEvents(
+			ctx, appId, scope, operator, userIds, banTo, banFor)
+	}); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// 批量写入处罚记录
+func insertSanctions(
+	ctx context.Context, appId string, sanctions []*Sanction) (err error) {
+	if len(sanctions) == 0 {
+		return
+	}
+	collection, err := getSanctionCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	docs := make([]interface{}, 0, len(sanctions))
+	for _, x := range sanctions {
+		docs = append(docs, x)
+	}
+	if _, err = collection.InsertMany(ctx, docs); err != nil {
+		log.Warnf("failed to insert sanctions: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+func liftSanctions(
+	ctx context.Context, appId, kind, scope, operator string, targets []string,
+	liftFor string) (err error) {
+	if len(targets) == 0 {
+		return
+	}
+	collection, err := getSanctionCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if _, err = collection.UpdateMany(
+		ctx,
+		bson.M{
+			"kind":      kind,
+			"target":    bson.M{"$in": targets},
+			"scope":     scopeFilter(scope),
+			"expire_at": bson.M{"$gt": now},
+			"lift_at":   bson.M{"$exists": false},
+		},
+		bson.M{"$set": bson.M{
+			"lift_at":  now,
+			"lift_by":  operator,
+			"lift_for": liftFor,
+		}},
+	); err != nil {
+		log.Warnf("failed to lift sanctions: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+// 完全封禁的记录没有scope字段
+func scopeFilter(scope string) interface{} {
+	if scope == "" {
+		return bson.M{"$exists": false}
+	}
+	return scope
+}
+
+// 获取生效中的处罚，同一目标有多条时取到期时间最晚的一条
+func getActiveSanctions(
+	ctx context.Context, appId, kind, scope string, targets []string) (
+	_ map[string]*Sanction, err error) {
+	if len(targets) == 0 {
+		return
+	}
+	collection, err := getSanctionCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{
+			"kind":      kind,
+			"target":    bson.M{"$in": targets},
+			"scope":     scopeFilter(scope),
+			"expire_at": bson.M{"$gt": now},
+			"lift_at":   bson.M{"$exists": false},
+		},
+	)
+	if err != nil {
+		log.Warnf("failed to find sanctions: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var sanctions []*Sanction
+	if err = cursor.All(ctx, &sanctions); err != nil {
+		log.Warnf("failed to decode sanctions: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	r := make(map[string]*Sanction)
+	for _, x := range sanctions {
+		if y, ok := r[x.Target]; !ok || x.ExpireAt.After(y.ExpireAt) {
+			r[x.Target] = x
+		}
+	}
+	return r, nil
+}
+
+// 处罚历史，按处罚时间倒序
+func ListSanctions(
+	ctx context.Context, appId, kind string, targets []string) (
+	_ []*Sanction, err error) {
+	if len(targets) == 0 {
+		return
+	}
+	collection, err := getSanctionCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{
+			"kind":   kind,
+			"target": bson.M{"$in": targets},
+		},
+		options.Find().
+			SetSort(bson.D{{Key: "create_at", Value: -1}}).
+			SetLimit(dbMaxSanctionHistory),
+	)
+	if err != nil {
+		log.Warnf("failed to find sanctions: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var sanctions []*Sanction
+	if err = cursor.All(ctx, &sanctions); err != nil {
+		log.Warnf("failed to decode sanctions: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return sanctions, nil
+}
+
+// 用生效中的封号记录填充用户的封号状态
+// 旧版本直接写在用户文档上的封号字段依然有效，取两者中较晚到期的
+func fillUserBans(ctx context.Context, appId string, users ...*User) (err error) {
+	if len(users) == 0 {
+		return
+	}
+	userIds := make([]string, 0, len(users))
+	for _, user := range users {
+		userIds = append(userIds, user.Id)
+	}
+	bans, err := getActiveSanctions(ctx, appId, SanctionKindBan, "", userIds)
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		if ban, ok := bans[user.Id]; ok && ban.ExpireAt.After(user.BanTo) {
+			user.BanAt = ban.CreateAt
+			user.BanTo = ban.ExpireAt
+			user.BanFor = ban.Reason
+		}
+	}
+	return
+}
+
+// 用户生效中的范围处罚，登录时缓存到会话中
+func getUserScopedSanctions(
+	ctx context.Context, appId, userId string) (
+	_ []*SessSanction, err error) {
+	r, err := getUsersScopedSanctions(ctx, appId, []string{userId})
+	if err != nil {
+		return
+	}
+	return r[userId], nil
+}
+
+// 一次查询多个用户生效中的范围处罚，没有处罚的用户不在结果中
+func getUsersScopedSanctions(
+	ctx context.Context, appId string, userIds []string) (
+	_ map[string][]*SessSanction, err error) {
+	collection, err := getSanctionCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{
+			"kind":      SanctionKindBan,
+			"target":    bson.M{"$in": userIds},
+			"scope":     bson.M{"$exists": true},
+			"expire_at": bson.M{"$gt": time.Now()},
+			"lift_at":   bson.M{"$exists": false},
+		},
+	)
+	if err != nil {
+		log.Warnf("failed to find sanctions: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var sanctions []*Sanction
+	if err = cursor.All(ctx, &sanctions); err != nil {
+		log.Warnf("failed to decode sanctions: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	r := make(map[string][]*SessSanction)
+	for _, x := range sanctions {
+		r[x.Target] = append(r[x.Target], &SessSanction{
+			Scope:  x.Scope,
+			BanTo:  x.ExpireAt.Unix(),
+			BanFor: x.Reason,
+		})
+	}
+	return r, nil
+}
+
+// 范围处罚，被处罚的用户依然可以登录，但不能访问该范围对应的接口
+func SanctionUsers(
+	ctx context.Context, appId, operator, scope string, userIds []string,
+	seconds int64, banFor string) (err error) {
+	if scope == "" {
+		return newInvalidArgumentError("sanction scope required")
+	}
+	banTo := time.Now().Add(time.Duration(seconds) * time.Second)
+	if _, err = addSanctionsWithEvents(
+		ctx, appId, scope, operator, userIds,
+		seconds, banTo, banFor); err != nil {
+		return
+	}
+	return refreshSessSanctions(ctx, appId, userIds)
+}
+
+func UnsanctionUsers(
+	ctx context.Context, appId, operator, scope string, userIds []string,
+	liftFor string) (err error) {
+	if scope == "" {
+		return newInvalidArgumentError("sanction scope required")
+	}
+	if err = liftSanctions(
+		ctx, appId, SanctionKindBan, scope, operator, userIds,
+		liftFor); err != nil {
+		return
+	}
+	return refreshSessSanctions(ctx, appId, userIds)
+}
+
+// 刷新在线用户会话中缓存的范围处罚
+// 单个用户更新失败不影响其他用户，全部尝试后返回错误
+func refreshSessSanctions(
+	ctx context.Context, appId string, userIds []string) (err error) {
+	if len(userIds) == 0 {
+		return
+	}
+	sanctions, err := getUsersScopedSanctions(ctx, appId, userIds)
+	if err != nil {
+		return
+	}
+	cmds, _ := rdbAuth.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, userId := range userIds {
+			// 没有处罚时写入nil，清除会话中的字段
+			b, _ := msgpack.Marshal(sanctions[userId])
+			p.Eval(ctx, luaUpdateSessSanctions.Src(), []string{userId}, b)
+		}
+		return nil
+	})
+	var (
+		failed  []string
+		lastErr error
+	)
+	for i, cmd := range cmds {
+		// 不在线的用户返回nil
+		if e := cmd.Err(); e != nil && e != redis.Nil {
+			failed, lastErr = append(failed, userIds[i]), e
+		}
+	}
+	if len(failed) > 0 {
+		log.Warnw("failed to update session sanctions",
+			"app_id", appId, "user_ids", failed, "error", lastErr)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
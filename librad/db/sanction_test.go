@@ -0,0 +1,111 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSanctions(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testsanction"})
+
+	collection, err := getSanctionCollection(ctx, app.Id)
+	if err != nil {
+		t.Fatalf("failed to get sanction collection: %v", err)
+	}
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err = cursor.All(ctx, &indexes); err != nil {
+		t.Fatalf("failed to list indexes: %v", err)
+	}
+	var found bool
+	for _, index := range indexes {
+		if index.Name == "kind_1_target_1_create_at_-1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("sanction index not created: %+v", indexes)
+	}
+
+	const userId = "testuser"
+	created, err := BanUsers(
+		ctx, app.Id, "admin", []string{userId}, 60, "cheat")
+	if err != nil {
+		t.Fatalf("failed to ban users: %v", err)
+	}
+	if len(created) != 1 || created[0].Id.IsZero() {
+		t.Fatalf("unexpected created sanctions: %+v", created)
+	}
+	// 记录时间精确到毫秒，保证历史顺序
+	time.Sleep(10 * time.Millisecond)
+	if err = SanctionUsers(
+		ctx, app.Id, "admin", "chat", []string{userId}, 60, "spam"); err != nil {
+		t.Fatalf("failed to sanction users: %v", err)
+	}
+	if err = SanctionUsers(
+		ctx, app.Id, "admin", "", []string{userId}, 60, ""); err == nil {
+		t.Fatal("expect sanction scope required")
+	}
+	bans, err := getActiveSanctions(
+		ctx, app.Id, SanctionKindBan, "", []string{userId})
+	if err != nil {
+		t.Fatalf("failed to get active sanctions: %v", err)
+	}
+	if x := bans[userId]; x == nil || x.Reason != "cheat" || x.Scope != "" {
+		t.Fatalf("unexpected ban: %+v", x)
+	}
+	scoped, err := getUserScopedSanctions(ctx, app.Id, userId)
+	if err != nil {
+		t.Fatalf("failed to get scoped sanctions: %v", err)
+	}
+	if len(scoped) != 1 || scoped[0].Scope != "chat" {
+		t.Fatalf("unexpected scoped sanctions: %+v", scoped)
+	}
+
+	// 解封只解除对应范围的处罚
+	if err = UnbanUsers(
+		ctx, app.Id, "admin", []string{userId}, "appeal"); err != nil {
+		t.Fatalf("failed to unban users: %v", err)
+	}
+	if bans, err = getActiveSanctions(
+		ctx, app.Id, SanctionKindBan, "", []string{userId}); err != nil {
+		t.Fatalf("failed to get active sanctions: %v", err)
+	}
+	if len(bans) != 0 {
+		t.Fatalf("unexpected bans: %+v", bans)
+	}
+	if scoped, err = getUserScopedSanctions(
+		ctx, app.Id, userId); err != nil {
+		t.Fatalf("failed to get scoped sanctions: %v", err)
+	}
+	if len(scoped) != 1 {
+		t.Fatalf("unexpected scoped sanctions: %+v", scoped)
+	}
+	if err = UnsanctionUsers(
+		ctx, app.Id, "admin", "chat", []string{userId}, "appeal"); err != nil {
+		t.Fatalf("failed to unsanction users: %v", err)
+	}
+	if scoped, err = getUserScopedSanctions(
+		ctx, app.Id, userId); err != nil {
+		t.Fatalf("failed to get scoped sanctions: %v", err)
+	}
+	if len(scoped) != 0 {
+		t.Fatalf("unexpected scoped sanctions: %+v", scoped)
+	}
+
+	// 历史记录保留，按处罚时间倒序
+	history, err := ListSanctions(
+		ctx, app.Id, SanctionKindBan, []string{userId})
+	if err != nil {
+		t.Fatalf("failed to list sanctions: %v", err)
+	}
+	if len(history) != 2 || history[0].Scope != "chat" ||
+		history[0].LiftFor != "appeal" || history[1].LiftBy != "admin" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// 会话属性
+// 缓存在会话中的少量属性(如平台、版本、公会)，鉴权时作为可信头转发给后端，
+// 避免游戏服务器反复查询。只有应用允许的键可以设置，总大小有上限。
+
+const (
+	// 属性键的最大长度
+	dbMaxSessAttrKeyLen = 32
+	// 属性键值的总大小上限
+	dbMaxSessAttrsSize = 1024
+)
+
+var (
+	// 合并会话属性，值为空时删除，保留原有的过期时间
+	luaUpdateSessAttrs = redis.NewScript(`
+local b = redis.call("GET", KEYS[1])
+if not b then return nil end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl <= 0 then return nil end
+local d = cmsgpack.unpack(b)
+if type(d.data) ~= "table" then d.data = {} end
+local attrs = d.data.attrs
+if type(attrs) ~= "table" then attrs = {} end
+for k, v in pairs(cmsgpack.unpack(ARGV[1])) do
+  if v == "" then attrs[k] = nil else attrs[k] = v end
+end
+local n = 0
+for k, v in pairs(attrs) do n = n + #k + #v end
+if n > tonumber(ARGV[2]) then return -1 end
+if next(attrs) == nil then attrs = nil end
+d.data.attrs = attrs
+redis.call("PSETEX", KEYS[1], ttl, cmsgpack.pack(d))
+return n`)
+)
+
+// 属性键只能是小写字母、数字和"-"，可以直接作为头的一部分
+func isValidSessAttrKey(key string) bool {
+	if key == "" || len(key) > dbMaxSessAttrKeyLen {
+		return false
+	}
+	for _, c := range key {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// 属性值只能是可见ASCII字符和空格，避免注入头
+func isValidSessAttrValue(val string) bool {
+	for i := 0; i < len(val); i++ {
+		if c := val[i]; c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+func getSessAttrsSize(attrs map[string]string) (n int) {
+	for k, v := range attrs {
+		n += len(k) + len(v)
+	}
+	return
+}
+
+// 过滤出应用允许且合法的属性，登录时使用，不合法的属性直接丢弃
+func filterSessAttrs(app *App, attrs map[string]string) map[string]string {
+	var r map[string]string
+	for k, v := range attrs {
+		if v == "" || !app.IsSessAttrAllowed(k) ||
+			!isValidSessAttrKey(k) || !isValidSessAttrValue(v) {
+			continue
+		}
+		if r == nil {
+			r = make(map[string]string)
+		}
+		r[k] = v
+	}
+	if getSessAttrsSize(r) > dbMaxSessAttrsSize {
+		log.Warnf("session attributes too large: %v, %v", app.Id, len(r))
+		return nil
+	}
+	return r
+}
+
+// 设置会话属性，值为空时删除该属性
+func SetSessAttrs(
+	ctx context.Context, app *App, userId string,
+	attrs map[string]string) (err error) {
+	if len(attrs) == 0 {
+		return
+	}
+	for k, v := range attrs {
+		if !app.IsSessAttrAllowed(k) || !isValidSessAttrKey(k) {
+			return newInvalidArgumentError("session attribute not allowed")
+		}
+		if !isValidSessAttrValue(v) {
+			return newInvalidArgumentError("invalid session attribute")
+		}
+	}
+	if getSessAttrsSize(attrs) > dbMaxSessAttrsSize {
+		return ErrSessAttrsTooLarge
+	}
+	b, _ := msgpack.Marshal(attrs)
+	n, err := luaUpdateSessAttrs.Run(
+		ctx, rdbAuth, []string{userId},
+		b, dbMaxSessAttrsSize).Int()
+	if err != nil {
+		if err == redis.Nil {
+			return ErrInvalidToken
+		}
+		log.Warnf("failed to update session: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if n < 0 {
+		return ErrSessAttrsTooLarge
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessAttrs(t *testing.T) {
+	app, ctx := testSetup(t, &App{
+		Id:           "testsessattrs",
+		SessAttrKeys: []string{"platform", "guild"},
+	})
+
+	// 登录时丢弃不允许的属性
+	user, sess, err := LoginUser(
+		ctx, app, "127.0.0.1", "", []string{"acct1"}, true,
+		map[string]string{"platform": "ios", "other": "x"},
+	)
+	if err != nil {
+		t.Fatalf("failed to login user: %v", err)
+	}
+	if len(sess.Data.Attrs) != 1 || sess.Data.Attrs["platform"] != "ios" {
+		t.Fatalf("unexpected attrs: %v", sess.Data.Attrs)
+	}
+	if err = SetSessAttrs(ctx, app, user.Id,
+		map[string]string{"other": "x"}); err == nil {
+		t.Fatal("expect attribute not allowed")
+	}
+	if err = SetSessAttrs(ctx, app, user.Id,
+		map[string]string{"guild": "a\r\nb"}); err == nil {
+		t.Fatal("expect invalid attribute")
+	}
+	if err = SetSessAttrs(ctx, app, user.Id, map[string]string{
+		"guild": strings.Repeat("x", dbMaxSessAttrsSize),
+	}); err != ErrSessAttrsTooLarge {
+		t.Fatalf("expect attributes too large, but got: %v", err)
+	}
+	if err = SetSessAttrs(ctx, app, user.Id, map[string]string{
+		"platform": "",
+		"guild":    "g1",
+	}); err != nil {
+		t.Fatalf("failed to set attrs: %v", err)
+	}
+	if sess, err = CheckToken(ctx, sess.Token); err != nil {
+		t.Fatalf("failed to check token: %v", err)
+	}
+	if len(sess.Data.Attrs) != 1 || sess.Data.Attrs["guild"] != "g1" {
+		t.Fatalf("unexpected attrs: %v", sess.Data.Attrs)
+	}
+	// 没有会话时不能设置
+	if err = LogoutUser(ctx, user.Id); err != nil {
+		t.Fatalf("failed to logout user: %v", err)
+	}
+	if err = SetSessAttrs(ctx, app, user.Id,
+		map[string]string{"guild": "g2"}); err != ErrInvalidToken {
+		t.Fatalf("expect invalid token, but got: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+)
+
+// 会话有效期
+// 会话有最长生命周期和空闲超时，Redis中的过期时间即空闲超时，
+// 使用中的会话在鉴权时续期，但不会超过最长生命周期。
+// 为了避免每次请求都写Redis，同一会话在续期间隔内只续期一次，
+// 续期记录保存在进程内，多个鉴权进程各自续期，续期时同时记录在线状态。
+// 续期间隔必须小于空闲超时，否则使用中的会话可能在两次续期之间过期。
+
+// 会话策略，时长单位为秒，为0时使用默认值
+type SessPolicy struct {
+	// 最长生命周期，到期后必须重新登录
+	MaxLifetime int64 `bson:"max_lifetime,omitempty"`
+	// 空闲超时，超过时长没有请求会话失效，不超过最长生命周期
+	IdleTimeout int64 `bson:"idle_timeout,omitempty"`
+	// 续期间隔，必须小于空闲超时
+	RefreshInterval int64 `bson:"refresh_interval,omitempty"`
+}
+
+const (
+	dbDefaultSessRefreshInterval = time.Minute
+	// 续期记录的清理间隔
+	dbSessRefreshSweepInterval = time.Minute
+)
+
+var (
+	// 令牌一致时设置过期时间，避免延长重新登录后的新会话
+	luaRefreshSess = redis.NewScript(`
+local b = redis.call("GET", KEYS[1])
+if not b then return 0 end
+local d = cmsgpack.unpack(b)
+if d.token ~= ARGV[1] then return 0 end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])`)
+)
+
+func (x *App) getSessMaxLifetime() time.Duration {
+	if p := x.SessPolicy; p != nil && p.MaxLifetime > 0 {
+		return time.Duration(p.MaxLifetime) * time.Second
+	}
+	return dbSessTTL
+}
+
+func (x *App) getSessIdleTimeout() time.Duration {
+	max := x.getSessMaxLifetime()
+	if p := x.SessPolicy; p != nil && p.IdleTimeout > 0 {
+		if d := time.Duration(p.IdleTimeout) * time.Second; d < max {
+			return d
+		}
+	}
+	return max
+}
+
+// 加载应用时检查会话策略，配置的续期间隔不小于空闲超时时拒绝加载
+func (x *App) checkSessPolicy() error {
+	p := x.SessPolicy
+	if p == nil {
+		return nil
+	}
+	if p.MaxLifetime < 0 || p.IdleTimeout < 0 || p.RefreshInterval < 0 {
+		return fmt.Errorf("invalid session policy: %v", x.Id)
+	}
+	if p.RefreshInterval > 0 && time.Duration(p.RefreshInterval)*
+		time.Second >= x.getSessIdleTimeout() {
+		return fmt.Errorf(
+			"session refresh interval must be less than idle timeout: %v", x.Id)
+	}
+	return nil
+}
+
+// 默认续期间隔不小于空闲超时时取空闲超时的一半
+func (x *App) getSessRefreshInterval() time.Duration {
+	if p := x.SessPolicy; p != nil && p.RefreshInterval > 0 {
+		return time.Duration(p.RefreshInterval) * time.Second
+	}
+	if d := x.getSessIdleTimeout(); d <= dbDefaultSessRefreshInterval {
+		return d / 2
+	}
+	return dbDefaultSessRefreshInterval
+}
+
+// 会话的过期时间，不超过最长生命周期，小于等于0表示已到期
+func (x *App) getSessTTL(createAt, now time.Time) time.Duration {
+	ttl := x.getSessIdleTimeout()
+	if left := createAt.Add(x.getSessMaxLifetime()).Sub(now); left < ttl {
+		ttl = left
+	}
+	return ttl
+}
+
+// 进程内的续期记录，令牌到下次可以续期的时间
+type xSessRefreshCache struct {
+	mu      sync.Mutex
+	m       map[string]time.Time
+	sweepAt time.Time
+}
+
+var sessRefreshCache = &xSessRefreshCache{m: make(map[string]time.Time)}
+
+// 到了可以续期的时间返回真，并记录本次续期
+func (c *xSessRefreshCache) check(
+	token string, interval time.Duration, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.sweepAt) > dbSessRefreshSweepInterval {
+		for k, t := range c.m {
+			if !t.After(now) {
+				delete(c.m, k)
+			}
+		}
+		c.sweepAt = now
+	}
+	if t, ok := c.m[token]; ok && t.After(now) {
+		return false
+	}
+	c.m[token] = now.Add(interval)
+	return true
+}
+
+func (c *xSessRefreshCache) remove(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, token)
+}
+
+// 鉴权时续期会话并记录活跃，到期时返回错误
+func refreshSess(ctx context.Context, s *Sess) (err error) {
+	now := time.Now()
+	// 旧版本的会话没有创建时间，保持固定的过期时间
+	var ttl time.Duration
+	if s.CreateAt != 0 {
+		if ttl = s.App.getSessTTL(time.Unix(s.CreateAt, 0), now); ttl <= 0 {
+			sessRefreshCache.remove(s.Token)
+			return ErrInvalidToken
+		}
+	}
+	if !sessRefreshCache.check(s.Token, s.App.getSessRefreshInterval(), now) {
+		return
+	}
+	touchPresence(ctx, s.AppId, s.UserId, s.Data.RoleId, s.Data.RoleIndex)
+	if ttl <= 0 {
+		return
+	}
+	// 续期失败不影响本次鉴权，下次请求重试
+	if err := luaRefreshSess.Run(
+		ctx, rdbAuth, []string{s.UserId}, s.Token, ttl.Milliseconds(),
+	).Err(); err != nil {
+		log.Warnf("failed to refresh session: %v, %v", s.UserId, err)
+		sessRefreshCache.remove(s.Token)
+	}
+	return
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessPolicy(t *testing.T) {
+	for _, c := range []struct {
+		p  *SessPolicy
+		ok bool
+	}{
+		{nil, true},
+		{&SessPolicy{IdleTimeout: 600, RefreshInterval: 60}, true},
+		{&SessPolicy{IdleTimeout: 60, RefreshInterval: 60}, false},
+		{&SessPolicy{MaxLifetime: 30, RefreshInterval: 60}, false},
+		{&SessPolicy{IdleTimeout: -1}, false},
+	} {
+		app := &App{Id: "testsesspolicy", SessPolicy: c.p}
+		if err := app.parse(); (err == nil) != c.ok {
+			t.Errorf("%+v: unexpected result: %v", c.p, err)
+		}
+	}
+	// 默认续期间隔不小于空闲超时时缩短
+	app := &App{SessPolicy: &SessPolicy{IdleTimeout: 30}}
+	if d := app.getSessRefreshInterval(); d != 15*time.Second {
+		t.Fatalf("unexpected refresh interval: %v", d)
+	}
+}
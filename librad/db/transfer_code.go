@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ntons/log-go"
+	"github.com/ntons/redis"
+)
+
+// 账号迁移码
+// 游客更换设备时，在旧设备上为用户签发迁移码，新设备使用迁移码
+// 把自己的账号ID绑定到同一个用户上。迁移码保存在随机数Redis中，
+// 只能使用一次，同一用户再次签发时旧的迁移码失效。
+// 迁移码有60位随机数，同时按IP限制失败次数，防止暴力猜测。
+
+const (
+	// 去掉容易混淆的0/1/I/O
+	dbTransferCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	dbTransferCodeLen      = 12
+	// 展示时的分组长度
+	dbTransferCodeGroupLen = 4
+)
+
+var (
+	luaSetTransferCode = redis.NewScript(`
+redis.call("HSET", KEYS[1], "user_id", ARGV[1], "acct_id", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1`)
+	// 取出并删除迁移码，保证只能使用一次
+	luaTakeTransferCode = redis.NewScript(`
+local r = redis.call("HMGET", KEYS[1], "user_id", "acct_id")
+if not r[1] then return nil end
+redis.call("DEL", KEYS[1])
+return r`)
+)
+
+type TransferCode struct {
+	// 展示用的迁移码，XXXX-XXXX-XXXX
+	Code string
+	// 迁移的用户
+	UserId string
+	// 签发时旧设备的账号ID，可以在迁移后解绑
+	AcctId string
+	// 过期时间
+	ExpireAt time.Time
+}
+
+// 迁移码策略
+type TransferCodePolicy struct {
+	// 有效期
+	Timeout time.Duration
+	// 失败次数的统计窗口
+	Window time.Duration
+	// 窗口内单个IP的最大失败次数
+	MaxFailuresPerIp int
+}
+
+func newTransferCode() (_ string, err error) {
+	b := make([]byte, dbTransferCodeLen)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	for i := range b {
+		b[i] = dbTransferCodeAlphabet[int(b[i])%len(dbTransferCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// 迁移码归一化，忽略大小写、空格和分隔符
+func normalizeTransferCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+func formatTransferCode(code string) string {
+	var parts []string
+	for i := 0; i < len(code); i += dbTransferCodeGroupLen {
+		j := i + dbTransferCodeGroupLen
+		if j > len(code) {
+			j = len(code)
+		}
+		parts = append(parts, code[i:j])
+	}
+	return strings.Join(parts, "-")
+}
+
+func getTransferCodeKey(appId, code string) string {
+	return fmt.Sprintf("xfer$%s$%s", appId, code)
+}
+func getUserTransferCodeKey(appId, userId string) string {
+	return fmt.Sprintf("xfer$%s$u$%s", appId, userId)
+}
+func getTransferFailureKey(appId, clientIp string) string {
+	return fmt.Sprintf("xfer$%s$ip$%s", appId, clientIp)
+}
+
+// 为用户签发迁移码，acctId为旧设备的账号ID，可以为空
+func IssueTransferCode(
+	ctx context.Context, appId, userId, acctId string,
+	p *TransferCodePolicy) (_ *TransferCode, err error) {
+	code, err := newTransferCode()
+	if err != nil {
+		log.Warnf("failed to generate transfer code: %v", err)
+		return nil, newInternalError("failed to generate transfer code")
+	}
+	if err = luaSetTransferCode.Run(
+		ctx, rdbNonce, []string{getTransferCodeKey(appId, code)},
+		userId, acctId, p.Timeout.Milliseconds()).Err(); err != nil {
+		log.Warnf("failed to access redis: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	// 作废之前签发的迁移码
+	old, err := rdbNonce.GetSet(
+		ctx, getUserTransferCodeKey(appId, userId), code).Result()
+	if err != nil && err != redis.Nil {
+		log.Warnf("failed to access redis: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	rdbNonce.PExpire(ctx, getUserTransferCodeKey(appId, userId), p.Timeout)
+	if old != "" && old != code {
+		rdbNonce.Del(ctx, getTransferCodeKey(appId, old))
+	}
+	return &TransferCode{
+		Code:     formatTransferCode(code),
+		UserId:   userId,
+		AcctId:   acctId,
+		ExpireAt: time.Now().Add(p.Timeout),
+	}, nil
+}
+
+// 使用迁移码，成功后迁移码失效
+func RedeemTransferCode(
+	ctx context.Context, appId, code, clientIp string,
+	p *TransferCodePolicy) (_ *TransferCode, err error) {
+	failureKey := getTransferFailureKey(appId, clientIp)
+	if p.MaxFailuresPerIp > 0 && clientIp != "" {
+		n, err := rdbNonce.Get(ctx, failureKey).Int()
+		if err != nil && err != redis.Nil {
+			log.Warnf("failed to access redis: %v", err)
+			return nil, ErrDatabaseUnavailable
+		}
+		if n >= p.MaxFailuresPerIp {
+			return nil, ErrTransferCodeAttemptsExceeded
+		}
+	}
+	var r []string
+	if code = normalizeTransferCode(code); len(code) == dbTransferCodeLen {
+		if r, err = luaTakeTransferCode.Run(
+			ctx, rdbNonce, []string{getTransferCodeKey(appId, code)},
+		).StringSlice(); err != nil && err != redis.Nil {
+			log.Warnf("failed to access redis: %v", err)
+			return nil, ErrDatabaseUnavailable
+		}
+	}
+	if len(r) != 2 {
+		if p.MaxFailuresPerIp > 0 && clientIp != "" {
+			if err = luaIncrOtpCounter.Run(
+				ctx, rdbNonce, []string{failureKey},
+				p.Window.Milliseconds()).Err(); err != nil {
+				log.Warnf("failed to access redis: %v", err)
+			}
+		}
+		return nil, ErrInvalidTransferCode
+	}
+	return &TransferCode{
+		Code:   formatTransferCode(code),
+		UserId: r[0],
+		AcctId: r[1],
+	}, nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferCode(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testtransfercode"})
+
+	p := &TransferCodePolicy{
+		Timeout:          time.Minute,
+		Window:           time.Minute,
+		MaxFailuresPerIp: 2,
+	}
+	const clientIp = "2.2.2.2"
+	if err := rdbNonce.Del(
+		ctx, getTransferFailureKey(app.Id, clientIp)).Err(); err != nil {
+		t.Fatalf("failed to reset failures: %v", err)
+	}
+	old, err := IssueTransferCode(ctx, app.Id, "user1", "acct1", p)
+	if err != nil {
+		t.Fatalf("failed to issue transfer code: %v", err)
+	}
+	// 再次签发后旧的迁移码失效
+	x, err := IssueTransferCode(ctx, app.Id, "user1", "acct1", p)
+	if err != nil {
+		t.Fatalf("failed to issue transfer code: %v", err)
+	}
+	if _, err = RedeemTransferCode(
+		ctx, app.Id, old.Code, "", p); err != ErrInvalidTransferCode {
+		t.Fatalf("expect invalid transfer code, but got: %v", err)
+	}
+	// 不区分大小写和分隔符
+	y, err := RedeemTransferCode(
+		ctx, app.Id, strings.ToLower(strings.ReplaceAll(x.Code, "-", "")),
+		clientIp, p)
+	if err != nil {
+		t.Fatalf("failed to redeem transfer code: %v", err)
+	}
+	if y.UserId != "user1" || y.AcctId != "acct1" {
+		t.Fatalf("unexpected transfer code: %+v", y)
+	}
+	// 只能使用一次，失败次数用尽后正确的迁移码也被拒绝
+	if _, err = RedeemTransferCode(
+		ctx, app.Id, x.Code, clientIp, p); err != ErrInvalidTransferCode {
+		t.Fatalf("expect invalid transfer code, but got: %v", err)
+	}
+	if _, err = RedeemTransferCode(
+		ctx, app.Id, "XXXX", clientIp, p); err != ErrInvalidTransferCode {
+		t.Fatalf("expect invalid transfer code, but got: %v", err)
+	}
+	if x, err = IssueTransferCode(ctx, app.Id, "user2", "", p); err != nil {
+		t.Fatalf("failed to issue transfer code: %v", err)
+	}
+	if _, err = RedeemTransferCode(ctx, app.Id, x.Code, clientIp, p); err !=
+		ErrTransferCodeAttemptsExceeded {
+		t.Fatalf("expect attempts exceeded, but got: %v", err)
+	}
+}
@@ -32,6 +32,12 @@ type User struct {
 	LoginAt time.Time `bson:"login_at,omitempty"`
 	// 上次登录时IP
 	LoginIp string `bson:"login_ip,omitempty"`
+	// 创建时的地理位置
+	CreateGeo *GeoLocation `bson:"create_geo,omitempty"`
+	// 上次登录时的地理位置
+	LoginGeo *GeoLocation `bson:"login_geo,omitempty"`
+	// 封号状态，由生效中的处罚记录推导
+	// 旧版本直接写在用户文档上，只读兼容
 	// 封号时间
 	BanAt time.Time `bson:"ban_at,omitempty"`
 	// 封号时间
@@ -87,6 +93,9 @@ func GetUser(
 		}
 		return
 	}
+	if err = fillUserBans(ctx, appId, user); err != nil {
+		return
+	}
 	return user, nil
 }
 
@@ -107,6 +116,9 @@ func GetUsersByAcctId(
 	if err = cursor.All(ctx, &users); err != nil {
 		return nil, ErrDatabaseUnavailable
 	}
+	if err = fillUserBans(ctx, appId, users...); err != nil {
+		return
+	}
 	return users, nil
 }
 
@@ -154,12 +166,15 @@ func getUsersWithOption(
 	if err = cursor.All(ctx, &users); err != nil {
 		return
 	}
+	if err = fillUserBans(ctx, appId, users...); err != nil {
+		return
+	}
 	return users, nil
 }
 
 func LoginUser(
 	ctx context.Context, app *App, clientIp, deviceId string,
-	acctIds []string, createIfNotFound bool) (
+	acctIds []string, createIfNotFound bool, attrs map[string]string) (
 	_ *User, _ *Sess, err error) {
 	if len(acctIds) > dbMaxAcctPerUser {
 		err = newInvalidArgumentError("too many acct ids")
@@ -170,42 +185,95 @@ func LoginUser(
 	if err != nil {
 		return
 	}
+	// 检查登录地区
+	geo := LookupGeoLocation(clientIp)
+	if err = app.checkRegion(geo); err != nil {
+		return
+	}
+
 	now := time.Now()
 	user := &User{
-		Id:       newUserId(app.Key),
-		CreateAt: now,
-		CreateIp: clientIp,
+		Id:        newUserId(app.Key),
+		CreateAt:  now,
+		CreateIp:  clientIp,
+		CreateGeo: geo,
+	}
+	createdUserId := user.Id
+	// 设备上创建的新用户过多时只允许已有用户登录
+	create := createIfNotFound &&
+		canCreateUserOnDevice(ctx, app, deviceId, now)
+	update := bson.M{
+		"$set": bson.M{
+			"login_at": now,
+			"login_ip": clientIp,
+		},
+		"$addToSet": bson.M{
+			"acct_ids": bson.M{
+				"$each": acctIds,
+			},
+		},
+		"$setOnInsert": user,
+	}
+	// 无法解析时清除，保证地理位置与登录IP一致
+	if geo != nil {
+		update["$set"].(bson.M)["login_geo"] = geo
+	} else {
+		update["$unset"] = bson.M{"login_geo": 1}
+	}
+	eventData := map[string]interface{}{
+		"user_id":   createdUserId,
+		"client_ip": clientIp,
+		"device_id": deviceId,
+	}
+	if geo != nil {
+		eventData["country"] = geo.Country
 	}
 	// 这里正确执行隐含了一个前置条件，acct_ids字段必须是索引。
 	// 当给进来的acct_ids列表可以映射到多个User的时候addToSet必然会失败，
 	// 从而可以保证参数 acct *---1 User 的映射关系成立。
-	if err = collection.FindOneAndUpdate(
-		ctx,
-		bson.M{
-			"acct_ids": bson.M{
-				"$elemMatch": bson.M{
-					"$in": acctIds,
-				},
-			},
-		},
-		bson.M{
-			"$set": bson.M{
-				"login_at": now,
-				"login_ip": clientIp,
-			},
-			"$addToSet": bson.M{
-				"acct_ids": bson.M{
-					"$each": acctIds,
+	// 创建用户的事件与用户在同一个事务中写入，之后登录失败也不影响
+	findAndLogin := func(upsert bool) error {
+		return runEventTx(ctx, app.Id, func(ctx context.Context) error {
+			if err := collection.FindOneAndUpdate(
+				ctx,
+				bson.M{
+					"acct_ids": bson.M{
+						"$elemMatch": bson.M{
+							"$in": acctIds,
+						},
+					},
 				},
-			},
-			"$setOnInsert": user,
-		},
-		options.FindOneAndUpdate().SetUpsert(createIfNotFound),
-		options.FindOneAndUpdate().SetReturnDocument(options.After),
-	).Decode(user); err != nil {
-		if err == mongo.ErrNoDocuments {
+				update,
+				options.FindOneAndUpdate().SetUpsert(upsert),
+				options.FindOneAndUpdate().SetReturnDocument(options.After),
+			).Decode(user); err != nil {
+				return err
+			}
+			if user.Id != createdUserId {
+				return nil
+			}
+			return emitEvent(ctx, app.Id, EventUserCreated, eventData)
+		})
+	}
+	// 有创建用户的前置钩子时，先查找已有用户，不存在时调用钩子后再创建
+	preCreate := create && app.hasHook(HookEventUserCreate, HookPhasePre)
+	err = findAndLogin(create && !preCreate)
+	if err == mongo.ErrNoDocuments && preCreate {
+		if err = runPreHooks(ctx, app, HookEventUserCreate, &HookEvent{
+			UserId:   createdUserId,
+			ClientIp: clientIp,
+			DeviceId: deviceId,
+		}); err != nil {
+			return
+		}
+		err = findAndLogin(true)
+	}
+	if err != nil {
+		if err == mongo.ErrNoDocuments && createIfNotFound && !create {
+			err = ErrDeviceUserLimitExceeded
+		} else if err == mongo.ErrNoDocuments {
 			err = ErrUserNotFound
-		} else {
+		} else if err != ErrDatabaseUnavailable {
 			log.Warnf("failed to access mongo: %v", err)
 			err = ErrDatabaseUnavailable
 		}
@@ -230,7 +298,15 @@ func LoginUser(
 
 	limitUserAcctCount(ctx, collection, user)
 
+	// 记录设备，被封禁的登录也记录
+	recordDeviceLogin(
+		ctx, app, deviceId, user.Id, clientIp, geo,
+		user.Id == createdUserId, now)
+
 	// 检查封禁状态
+	if err = fillUserBans(ctx, app.Id, user); err != nil {
+		return
+	}
 	if user.BanTo.After(now) {
 		return nil, nil, newPermissionDeniedError(newErrorDetail(
 			v1pb.ErrorCode_ErrorCodeBan,
@@ -267,17 +343,53 @@ func LoginUser(
 		}
 	}
 
+	// 检查维护状态，只维护部分区服时不影响登录
+	if err = app.checkMaintenance(user.Id, clientIp, nil); err != nil {
+		return nil, nil, err
+	}
+
+	// 关联发行商身份
+	linkPublisherIdentity(ctx, app, user)
+
+	// 范围处罚缓存在会话中，鉴权时不需要再次查询
+	sanctions, err := getUserScopedSanctions(ctx, app.Id, user.Id)
+	if err != nil {
+		return
+	}
+
+	hookEvent := &HookEvent{
+		UserId:   user.Id,
+		ClientIp: clientIp,
+		DeviceId: deviceId,
+	}
+	if err = runPreHooks(ctx, app, HookEventUserLogin, hookEvent); err != nil {
+		return
+	}
+
 	// 创建会话
-	sess, err := newSess(ctx, app, user.Id)
+	sess, err := newSess(
+		ctx, app, user.Id, sanctions, filterSessAttrs(app, attrs))
 	if err != nil {
 		return
 	}
 
+	// 登录的状态在会话中，事件写入失败时撤销会话，保证成功的登录都有事件
+	eventData["user_id"] = user.Id
+	if err = emitEvent(ctx, app.Id, EventUserLogin, eventData); err != nil {
+		LogoutUser(ctx, user.Id)
+		return nil, nil, err
+	}
+	if user.Id == createdUserId {
+		runPostHooks(app, HookEventUserCreate, hookEvent)
+	}
+	runPostHooks(app, HookEventUserLogin, hookEvent)
+
 	return user, sess, nil
 }
 
 func LogoutUser(ctx context.Context, userIds ...string) (err error) {
 	if len(userIds) > 0 {
+		clearPresence(ctx, userIds)
 		if err = rdbAuth.Del(ctx, userIds...).Err(); err != nil {
 			log.Warnf("failed to revoke token from redis: %v", err)
 			return ErrDatabaseUnavailable
@@ -328,58 +440,49 @@ func BindAcctIdToUser(
 		return
 	}
 
-	if takeOverIfDuplicated {
-		// 账号转移要在会话中执行，保证解绑和绑定操作的原子性
-		if err = func() (err error) {
-			var sess mongo.Session
-			if sess, err = mdb.StartSession(); err != nil {
-				log.Warnf("failed to start db session: %v", err)
-				return ErrDatabaseUnavailable
-			}
-			defer sess.EndSession(ctx)
-			// Transaction不能在Standalone中执行
-			// 4.0 只能使用 replica set
-			// 4.2 replica set 或 cluster
-			if _, err = sess.WithTransaction(
+	bind := func(ctx context.Context) (err error) {
+		if takeOverIfDuplicated {
+			// 解除已被绑定的账号
+			if _, err = collection.UpdateMany(
 				ctx,
-				func(ctx mongo.SessionContext) (_ interface{}, err error) {
-					// 解除已被绑定的账号
-					if _, err = collection.UpdateMany(
-						ctx,
-						bson.M{
-							"acct_ids": bson.M{
-								"$elemMatch": bson.M{
-									"$in": acctIds,
-								},
-							},
-						},
-						bson.M{
-							"$pullAll": bson.M{
-								"acct_ids": acctIds,
-							},
+				bson.M{
+					"acct_ids": bson.M{
+						"$elemMatch": bson.M{
+							"$in": acctIds,
 						},
-					); err != nil {
-						log.Warnf("failed to access mongo: %v", err)
-						return nil, ErrDatabaseUnavailable
-					}
-					// 绑定到当前用户
-					if err = findAndBind(ctx); err != nil {
-						return
-					}
-					return
+					},
+				},
+				bson.M{
+					"$pullAll": bson.M{
+						"acct_ids": acctIds,
+					},
 				},
 			); err != nil {
-				return
+				log.Warnf("failed to access mongo: %v", err)
+				return ErrDatabaseUnavailable
 			}
-			return
-		}(); err != nil {
-			return
 		}
-	} else {
-		// 直接绑定到当前用户
+		// 绑定到当前用户
 		if err = findAndBind(ctx); err != nil {
 			return
 		}
+		return emitEvent(ctx, appId, EventAcctBound, map[string]interface{}{
+			"user_id":  userId,
+			"acct_ids": toInterfaceSlice(acctIds),
+			"takeover": takeOverIfDuplicated,
+		})
+	}
+	if takeOverIfDuplicated {
+		// 账号转移要在事务中执行，保证解绑和绑定操作的原子性
+		// Transaction不能在Standalone中执行
+		// 4.0 只能使用 replica set
+		// 4.2 replica set 或 cluster
+		err = runTx(ctx, bind)
+	} else {
+		err = runEventTx(ctx, appId, bind)
+	}
+	if err != nil {
+		return
 	}
 
 	limitUserAcctCount(ctx, collection, user)
@@ -400,24 +503,32 @@ func UnbindAcctIdFromUser(
 		return
 	}
 	user := &User{}
-	if err = collection.FindOneAndUpdate(
-		ctx,
-		bson.M{
-			"_id": userId,
-		},
-		bson.M{
-			"$pullAll": bson.M{
-				"acct_ids": acctIds,
+	if err = runEventTx(ctx, appId, func(ctx context.Context) (err error) {
+		if err = collection.FindOneAndUpdate(
+			ctx,
+			bson.M{
+				"_id": userId,
 			},
-		},
-		options.FindOneAndUpdate().SetReturnDocument(options.After),
-	).Decode(user); err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, ErrUserNotFound
-		} else {
-			log.Warnf("failed to access mongo: %v", err)
-			return nil, ErrDatabaseUnavailable
+			bson.M{
+				"$pullAll": bson.M{
+					"acct_ids": acctIds,
+				},
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(user); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return ErrUserNotFound
+			} else {
+				log.Warnf("failed to access mongo: %v", err)
+				return ErrDatabaseUnavailable
+			}
 		}
+		return emitEvent(ctx, appId, EventAcctUnbound, map[string]interface{}{
+			"user_id":  userId,
+			"acct_ids": toInterfaceSlice(acctIds),
+		})
+	}); err != nil {
+		return
 	}
 	return user.AcctIds, nil
 }
@@ -450,67 +561,35 @@ func limitUserAcctCount(
 func SetUserMetadata(
 	ctx context.Context, appId, userId string,
 	md map[string]string) (err error) {
-	collection, err := getUserCollection(ctx, appId)
-	if err != nil {
+	if len(md) == 0 {
 		return
 	}
-	set, unset := bson.M{}, bson.M{}
-	for key, val := range md {
-		if val != "" {
-			set["metadata."+key] = val
-		} else {
-			unset["metadata."+key] = 1
-		}
-	}
-	if len(set) > 0 || len(unset) > 0 {
-		update := bson.M{}
-		if len(set) > 0 {
-			update["$set"] = set
-		}
-		if len(unset) > 0 {
-			update["$unset"] = unset
-		}
-		if r, err := collection.UpdateOne(
-			ctx,
-			bson.M{"_id": userId},
-			update,
-		); err != nil {
-			log.Warnf("failed to access user: %v", err)
-			return ErrDatabaseUnavailable
-		} else if r.MatchedCount == 0 {
-			return ErrUserNotFound
-		}
-	}
+	_, err = UpdateUserMetadata(ctx, appId, userId, toMetadataOps(md))
 	return
 }
 
+// 封号seconds秒，每个用户都会留下一条处罚记录，返回新的处罚记录
 func BanUsers(
-	ctx context.Context, appId string, userIds []string,
-	banTo time.Time, banFor string) (err error) {
-	collection, err := getUserCollection(ctx, appId)
-	if err != nil {
-		return
-	}
-	if _, err = collection.UpdateMany(
-		ctx,
-		bson.M{"_id": bson.M{"$in": userIds}},
-		bson.M{"$set": bson.M{
-			"ban_at":  time.Now(),
-			"ban_to":  banTo,
-			"ban_for": banFor,
-		}},
-	); err != nil {
-		return
-	}
-	return
+	ctx context.Context, appId, operator string, userIds []string,
+	seconds int64, banFor string) (_ []*Sanction, err error) {
+	banTo := time.Now().Add(time.Duration(seconds) * time.Second)
+	return addSanctionsWithEvents(
+		ctx, appId, "", operator, userIds, seconds, banTo, banFor)
 }
 
+// 解封，解除所有生效中的封号记录
 func UnbanUsers(
-	ctx context.Context, appId string, userIds []string) (err error) {
+	ctx context.Context, appId, operator string, userIds []string,
+	liftFor string) (err error) {
+	if err = liftSanctions(
+		ctx, appId, SanctionKindBan, "", operator, userIds, liftFor); err != nil {
+		return
+	}
 	collection, err := getUserCollection(ctx, appId)
 	if err != nil {
 		return
 	}
+	// 清除旧版本的封号字段
 	if _, err = collection.UpdateMany(
 		ctx,
 		bson.M{"_id": bson.M{"$in": userIds}},
@@ -520,7 +599,8 @@ func UnbanUsers(
 			"ban_for": 1,
 		}},
 	); err != nil {
-		return
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
 	}
 	return
 }
@@ -535,20 +615,29 @@ func containAcctIdPlaceholder(acctIds []string) bool {
 }
 
 func newSess(
-	ctx context.Context, app *App, userId string) (_ *Sess, err error) {
+	ctx context.Context, app *App, userId string,
+	sanctions []*SessSanction, attrs map[string]string) (_ *Sess, err error) {
 	token, err := newToken(app, userId)
 	if err != nil {
 		return
 	}
+	now := time.Now()
 	s := &Sess{
-		Token:  token,
-		AppId:  app.Id,
-		UserId: userId,
+		Token:     token,
+		AppId:     app.Id,
+		UserId:    userId,
+		CreateAt:  now.Unix(),
+		Data:      SessData{Attrs: attrs},
+		Sanctions: sanctions,
 	}
 	b, _ := msgpack.Marshal(&s)
 	if err = rdbAuth.Set(
-		ctx, userId, util.BytesToString(b), dbSessTTL).Err(); err != nil {
+		ctx, userId, util.BytesToString(b),
+		app.getSessTTL(now, now)).Err(); err != nil {
+		log.Warnf("failed to create session: %v", err)
+		return nil, ErrDatabaseUnavailable
 	}
+	touchPresence(ctx, app.Id, userId, "", 0)
 	return s, nil
 }
 
@@ -579,6 +668,9 @@ func CheckToken(ctx context.Context, token string) (_ *Sess, err error) {
 	if s.Token != token {
 		return nil, ErrInvalidToken
 	}
+	if err = refreshSess(ctx, s); err != nil {
+		return
+	}
 	return s, nil
 }
 
@@ -0,0 +1,349 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 分区分服
+// 区服ID即角色序号，应用没有配置任何区服时不做校验，兼容旧的用法。
+// 区服的角色数只统计未删除的角色，删除时归还名额，恢复时重新占用。
+
+// 区服状态
+const (
+	// 正常
+	ZoneStatusNormal = ""
+	// 维护中，不能创建角色
+	ZoneStatusMaintenance = "maintenance"
+	// 爆满，不能创建角色
+	ZoneStatusFull = "full"
+	// 推荐
+	ZoneStatusRecommended = "recommended"
+)
+
+// 应用是否配置了区服的缓存时长，其他进程修改区服后最多延迟这么久生效
+const dbZonedCacheTTL = 10 * time.Second
+
+var (
+	dbZoneCollectionMu sync.Mutex
+	dbZoneCollection   = make(map[string]*mongo.Collection)
+
+	dbZonedMu sync.Mutex
+	dbZoned   = make(map[string]xZoned)
+)
+
+type xZoned struct {
+	zoned    bool
+	expireAt time.Time
+}
+
+type Zone struct {
+	// 区服ID，对应角色序号
+	Id uint32 `bson:"_id"`
+	// 区服名
+	Name string `bson:"name"`
+	// 开服时间，之前不能创建角色
+	OpenAt time.Time `bson:"open_at,omitempty"`
+	// 状态
+	Status string `bson:"status,omitempty"`
+	// 角色数上限，0表示不限
+	Capacity int64 `bson:"capacity,omitempty"`
+	// 当前角色数
+	RoleCount int64 `bson:"role_count"`
+}
+
+// 区服及玩家在该区服的角色
+type ZoneRoles struct {
+	*Zone
+	Roles []*Role
+}
+
+func getZoneCollection(
+	ctx context.Context, appId string) (*mongo.Collection, error) {
+	dbZoneCollectionMu.Lock()
+	defer dbZoneCollectionMu.Unlock()
+
+	if collection, ok := dbZoneCollection[appId]; ok {
+		return collection, nil
+	}
+
+	const tblName = "libra.zones"
+	dbName := getAppDBName(appId)
+
+	collection := mdb.Database(dbName).Collection(tblName)
+	dbZoneCollection[appId] = collection
+	return collection, nil
+}
+
+func getZoned(appId string) (zoned, ok bool) {
+	dbZonedMu.Lock()
+	defer dbZonedMu.Unlock()
+	x, ok := dbZoned[appId]
+	if !ok || x.expireAt.Before(time.Now()) {
+		return false, false
+	}
+	return x.zoned, true
+}
+
+func setZoned(appId string, zoned bool) {
+	dbZonedMu.Lock()
+	defer dbZonedMu.Unlock()
+	dbZoned[appId] = xZoned{
+		zoned:    zoned,
+		expireAt: time.Now().Add(dbZonedCacheTTL),
+	}
+}
+
+// 应用是否配置了区服
+func isZoned(
+	ctx context.Context, collection *mongo.Collection, appId string) (
+	_ bool, err error) {
+	if zoned, ok := getZoned(appId); ok {
+		return zoned, nil
+	}
+	n, err := collection.CountDocuments(
+		ctx, bson.M{}, options.Count().SetLimit(1))
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return false, ErrDatabaseUnavailable
+	}
+	setZoned(appId, n > 0)
+	return n > 0, nil
+}
+
+// 新建或修改区服，角色数不会被覆盖，新建时从已有的角色统计
+func SetZone(ctx context.Context, appId string, zone *Zone) (err error) {
+	if zone.Name == "" {
+		return newInvalidArgumentError("zone name required")
+	}
+	switch zone.Status {
+	case ZoneStatusNormal, ZoneStatusMaintenance,
+		ZoneStatusFull, ZoneStatusRecommended:
+	default:
+		return newInvalidArgumentError("invalid zone status")
+	}
+	collection, err := getZoneCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	set, unset := bson.M{"name": zone.Name}, bson.M{}
+	if !zone.OpenAt.IsZero() {
+		set["open_at"] = zone.OpenAt
+	} else {
+		unset["open_at"] = 1
+	}
+	if zone.Status != "" {
+		set["status"] = zone.Status
+	} else {
+		unset["status"] = 1
+	}
+	if zone.Capacity > 0 {
+		set["capacity"] = zone.Capacity
+	} else {
+		unset["capacity"] = 1
+	}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"role_count": 0},
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	r, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": zone.Id},
+		update,
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	setZoned(appId, true)
+	if r.UpsertedCount > 0 {
+		return seedZoneRoleCount(ctx, appId, collection, zone.Id)
+	}
+	return
+}
+
+// 配置区服之前该序号可能已经有角色
+func seedZoneRoleCount(
+	ctx context.Context, appId string,
+	collection *mongo.Collection, zoneId uint32) (err error) {
+	roles, err := getRoleCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	n, err := roles.CountDocuments(ctx, bson.M{
+		"index":     zoneId,
+		"delete_at": dbRoleAliveFilter["delete_at"],
+	})
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if n == 0 {
+		return
+	}
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": zoneId},
+		bson.M{"$inc": bson.M{"role_count": n}},
+	); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	return
+}
+
+func DeleteZone(ctx context.Context, appId string, zoneId uint32) (err error) {
+	collection, err := getZoneCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	if r, err := collection.DeleteOne(ctx, bson.M{"_id": zoneId}); err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	} else if r.DeletedCount == 0 {
+		return ErrZoneNotFound
+	}
+	// 可能删除了最后一个区服，下次重新查询
+	dbZonedMu.Lock()
+	delete(dbZoned, appId)
+	dbZonedMu.Unlock()
+	return
+}
+
+func ListZones(ctx context.Context, appId string) (_ []*Zone, err error) {
+	collection, err := getZoneCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		log.Warnf("failed to find zones: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	var zones []*Zone
+	if err = cursor.All(ctx, &zones); err != nil {
+		log.Warnf("failed to decode zones: %v", err)
+		return nil, ErrDatabaseUnavailable
+	}
+	return zones, nil
+}
+
+// 面向玩家的区服列表，推荐的区服排在前面，附带玩家在各区服的角色
+// 未开服的区服不会返回，除非玩家在其中已有角色
+func ListZonesWithRoles(
+	ctx context.Context, appId, userId string) (_ []*ZoneRoles, err error) {
+	zones, err := ListZones(ctx, appId)
+	if err != nil {
+		return
+	}
+	roles, err := ListRoles(ctx, appId, userId)
+	if err != nil {
+		return
+	}
+	rolesByZone := make(map[uint32][]*Role)
+	for _, role := range roles {
+		rolesByZone[role.Index] = append(rolesByZone[role.Index], role)
+	}
+	now := time.Now()
+	var recommended, others []*ZoneRoles
+	for _, zone := range zones {
+		x := &ZoneRoles{Zone: zone, Roles: rolesByZone[zone.Id]}
+		if len(x.Roles) == 0 && zone.OpenAt.After(now) {
+			continue
+		}
+		if zone.Status == ZoneStatusRecommended {
+			recommended = append(recommended, x)
+		} else {
+			others = append(others, x)
+		}
+	}
+	return append(recommended, others...), nil
+}
+
+// 占用区服的一个角色名额
+// 应用没有配置区服时直接返回
+func acquireZoneSeat(ctx context.Context, appId string, zoneId uint32) (
+	err error) {
+	collection, err := getZoneCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	if zoned, err := isZoned(ctx, collection, appId); err != nil || !zoned {
+		return err
+	}
+	now := time.Now()
+	r, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id": zoneId,
+			"status": bson.M{"$nin": bson.A{
+				ZoneStatusMaintenance, ZoneStatusFull}},
+			"$and": bson.A{
+				bson.M{"$or": bson.A{
+					bson.M{"open_at": bson.M{"$exists": false}},
+					bson.M{"open_at": bson.M{"$lte": now}},
+				}},
+				bson.M{"$or": bson.A{
+					bson.M{"capacity": bson.M{"$exists": false}},
+					bson.M{"$expr": bson.M{
+						"$lt": bson.A{"$role_count", "$capacity"}}},
+				}},
+			},
+		},
+		bson.M{"$inc": bson.M{"role_count": 1}},
+	)
+	if err != nil {
+		log.Warnf("failed to access mongo: %v", err)
+		return ErrDatabaseUnavailable
+	}
+	if r.MatchedCount > 0 {
+		return
+	}
+	// 找出失败原因
+	zone := &Zone{}
+	if err = collection.FindOne(ctx, bson.M{"_id": zoneId}).Decode(zone); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Warnf("failed to access mongo: %v", err)
+			return ErrDatabaseUnavailable
+		}
+		return ErrZoneNotFound
+	}
+	switch {
+	case zone.Status == ZoneStatusMaintenance:
+		return ErrZoneMaintenance
+	case zone.OpenAt.After(now):
+		return ErrZoneNotOpen
+	default:
+		return ErrZoneFull
+	}
+}
+
+// 归还区服的一个角色名额
+func releaseZoneSeat(ctx context.Context, appId string, zoneId uint32) {
+	collection, err := getZoneCollection(ctx, appId)
+	if err != nil {
+		return
+	}
+	if _, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": zoneId, "role_count": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"role_count": -1}},
+	); err != nil {
+		log.Warnf("failed to release zone seat: %v, %v, %v",
+			appId, zoneId, err)
+	}
+}
@@ -0,0 +1,56 @@
+package db
+
+import "testing"
+
+func TestZoneSeat(t *testing.T) {
+	app, ctx := testSetup(t, &App{Id: "testzone"})
+
+	// 没有配置区服时不校验，新建区服时统计已有的角色
+	testCreateRole(t, ctx, app.Id, "testuser1", 9)
+	testCreateRole(t, ctx, app.Id, "testuser1", 3)
+	for _, zone := range []*Zone{
+		{Id: 1, Name: "zone1", Capacity: 1},
+		{Id: 2, Name: "zone2", Status: ZoneStatusMaintenance},
+		{Id: 3, Name: "zone3", Status: ZoneStatusRecommended},
+	} {
+		if err := SetZone(ctx, app.Id, zone); err != nil {
+			t.Fatalf("failed to set zone: %v", err)
+		}
+	}
+	role := testCreateRole(t, ctx, app.Id, "testuser1", 1)
+	for _, c := range []struct {
+		index uint32
+		err   error
+	}{
+		{1, ErrZoneFull},
+		{2, ErrZoneMaintenance},
+		{4, ErrZoneNotFound},
+	} {
+		if _, err := CreateRole(
+			ctx, app.Id, "testuser2", c.index); err != c.err {
+			t.Fatalf("zone %d: expect %v, but got: %v", c.index, c.err, err)
+		}
+	}
+	zones, err := ListZonesWithRoles(ctx, app.Id, "testuser1")
+	if err != nil {
+		t.Fatalf("failed to list zones: %v", err)
+	}
+	if len(zones) != 3 || zones[0].Id != 3 {
+		t.Fatalf("unexpected zones: %+v", zones)
+	}
+	for _, zone := range zones {
+		if (zone.Id == 1 || zone.Id == 3) &&
+			(len(zone.Roles) != 1 || zone.RoleCount != 1) {
+			t.Fatalf("unexpected zone: %+v", zone)
+		}
+	}
+
+	// 删除角色归还名额，恢复时区服已满
+	if _, err = DeleteRole(ctx, app.Id, role.Id); err != nil {
+		t.Fatalf("failed to delete role: %v", err)
+	}
+	testCreateRole(t, ctx, app.Id, "testuser2", 1)
+	if _, err = RestoreRole(ctx, app.Id, role.Id); err != ErrZoneFull {
+		t.Fatalf("expect zone full, but got: %v", err)
+	}
+}
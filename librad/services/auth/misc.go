@@ -115,3 +115,9 @@ func httpStatusFromCode(code codes.Code) typepb.StatusCode {
 		return typepb.StatusCode_InternalServerError
 	}
 }
+
+// 下游客户端的IP，由Envoy根据可信跳数从XFF中解析
+func getClientIp(req *authpb.CheckRequest) string {
+	return req.GetAttributes().GetSource().GetAddress().
+		GetSocketAddress().GetAddress()
+}
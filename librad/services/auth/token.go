@@ -3,15 +3,20 @@ package auth
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	L "github.com/ntons/libra-go"
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
 	authpb "github.com/ntons/libra/librad/common/envoy_service_auth_v3"
 	"github.com/ntons/libra/librad/db"
 	log "github.com/ntons/log-go"
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
+// 会话属性转发的可信头前缀，libra-go中尚未定义
+const xLibraTrustedAttrPrefix = L.XLibraTrustedPrefix + "attr-"
+
 func (srv authServer) checkToken(
 	ctx context.Context, req *authpb.CheckRequest) (
 	_ *authpb.CheckResponse, err error) {
@@ -29,6 +34,21 @@ func (srv authServer) checkToken(
 		log.Warnf("auth by token|request path is not permitted|%s|%s",
 			sess.App.Id, req.Attributes.Request.Http.Path)
 		return errResponse(errPermissionDenied)
+	} else if x := sess.IsSanctioned(req.Attributes.Request.Http.Path); x != nil {
+		log.Warnf("auth by token|request path is sanctioned|%s|%s|%s",
+			sess.UserId, x.Scope, req.Attributes.Request.Http.Path)
+		return errResponse(newPermissionDeniedError(newErrorDetail(
+			v1pb.ErrorCode_ErrorCodeBan,
+			&v1pb.BanErrorDetail{
+				UserId: sess.UserId,
+				BanTo:  int32(x.BanTo),
+				BanFor: x.BanFor,
+			},
+		)))
+	} else if err = sess.CheckMaintenance(getClientIp(req)); err != nil {
+		log.Warnf("auth by token|under maintenance|%s|%s",
+			sess.AppId, sess.UserId)
+		return errResponse(err)
 	}
 
 	headers := []*corepb.HeaderValueOption{
@@ -64,6 +84,20 @@ func (srv authServer) checkToken(
 			},
 		})
 	}
+	// 会话属性按键排序，保证头的顺序稳定
+	attrKeys := make([]string, 0, len(sess.Data.Attrs))
+	for k := range sess.Data.Attrs {
+		attrKeys = append(attrKeys, k)
+	}
+	sort.Strings(attrKeys)
+	for _, k := range attrKeys {
+		headers = append(headers, &corepb.HeaderValueOption{
+			Header: &corepb.HeaderValue{
+				Key:   xLibraTrustedAttrPrefix + k,
+				Value: sess.Data.Attrs[k],
+			},
+		})
+	}
 	return &authpb.CheckResponse{
 		Status: &statuspb.Status{},
 		HttpResponse: &authpb.CheckResponse_OkResponse{
@@ -12,6 +12,7 @@ var (
 	errTimeoutTooLong  = status.Errorf(codes.InvalidArgument, "timeout too long")
 	errUnauthenticated = status.Errorf(codes.Unauthenticated, "unauthenticated")
 	errTooLarge        = status.Errorf(codes.Unauthenticated, "too large")
+	errUnavailable     = status.Errorf(codes.Unavailable, "database unavailable")
 )
 
 func fromRedmonError(err error) error {
@@ -7,6 +7,7 @@ import (
 	servermodule "github.com/onemoreteam/httpframework/modularity/server"
 
 	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	"github.com/ntons/libra/librad/db"
 )
 
 func init() {
@@ -27,5 +28,6 @@ func (m *databaseModule) Initialize(jb json.RawMessage) (err error) {
 	servermodule.RegisterGrpcService(&v1pb.Database_ServiceDesc, srv)
 	servermodule.RegisterGrpcService(&v1pb.Distlock_ServiceDesc, srv)
 	servermodule.RegisterGrpcService(&v1pb.Mailbox_ServiceDesc, srv)
+	db.RegisterRolePurger("database", srv.purgeRoles)
 	return
 }
@@ -0,0 +1,289 @@
+package database
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ntons/log-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 清除已删除角色的数据
+// 约定以角色ID为键的数据属于该角色，按照redmon的键映射规则，
+// 数据存放在应用库中以类型命名的集合里，_id为角色ID。
+// 写入角色数据时在libra.entry_kinds中记录ID对应的类型，清除时只需要删除记录过的类型，
+// 索引开始记录之前创建的角色依然需要扫描所有集合。
+// 索引在后台批量写入，不影响数据读写；队列满或写入失败时把开始时间推迟到当前，
+// 之前创建的角色清除时扫描所有集合，保证不会遗漏。
+
+const (
+	entryKindsCollectionName = "libra.entry_kinds"
+	// 记录索引开始时间的文档，数据ID不能包含$，不会冲突
+	entryKindsSinceId = "$since"
+	// 已记录索引的缓存上限，超过后淘汰最久未使用的
+	maxEntryKindsCache = 100000
+	// 等待写入的索引上限
+	maxPendingEntryKinds = 10000
+	// 每批写入的索引上限和最长等待时间
+	entryKindsBatchSize     = 500
+	entryKindsBatchInterval = time.Second
+)
+
+type entryKind struct {
+	appId, kind, id string
+}
+
+// 已记录索引的LRU缓存
+type entryKindsCache struct {
+	mu sync.Mutex
+	// appId:kind:id
+	keys map[string]*list.Element
+	lru  *list.List
+	// 已确认记录了开始时间的应用
+	apps map[string]struct{}
+	// 有索引被丢弃，需要推迟开始时间的应用
+	lost map[string]struct{}
+}
+
+func newEntryKindsCache() *entryKindsCache {
+	return &entryKindsCache{
+		keys: make(map[string]*list.Element),
+		lru:  list.New(),
+		apps: make(map[string]struct{}),
+		lost: make(map[string]struct{}),
+	}
+}
+
+// 缓存中没有时加入并返回true
+func (c *entryKindsCache) add(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.keys[key]; ok {
+		c.lru.MoveToFront(e)
+		return false
+	}
+	c.keys[key] = c.lru.PushFront(key)
+	if c.lru.Len() > maxEntryKindsCache {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.keys, e.Value.(string))
+	}
+	return true
+}
+
+func (c *entryKindsCache) hasApp(appId string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.apps[appId]
+	return ok
+}
+
+func (c *entryKindsCache) addApp(appId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apps[appId] = struct{}{}
+}
+
+func (c *entryKindsCache) addLost(appId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lost[appId] = struct{}{}
+}
+
+func (c *entryKindsCache) takeLost() (appIds []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for appId := range c.lost {
+		appIds = append(appIds, appId)
+	}
+	c.lost = make(map[string]struct{})
+	return
+}
+
+// 记录角色数据的类型，只加入队列，不阻塞也不影响数据写入
+func (srv *server) indexEntry(appId, kind, id string) {
+	if _, tag, err := db.DecId(id); err != nil || tag != db.RoleIdTag {
+		return
+	}
+	if !srv.kinds.add(fmt.Sprintf("%s:%s:%s", appId, kind, id)) {
+		return
+	}
+	select {
+	case srv.pendingKinds <- &entryKind{appId: appId, kind: kind, id: id}:
+	default:
+		log.Warnw("too many pending entry kinds", "app_id", appId)
+		srv.kinds.addLost(appId)
+	}
+}
+
+// 后台批量写入索引
+func (srv *server) serveEntryKinds() {
+	ticker := time.NewTicker(entryKindsBatchInterval)
+	defer ticker.Stop()
+	batch := make([]*entryKind, 0, entryKindsBatchSize)
+	for {
+		select {
+		case x := <-srv.pendingKinds:
+			if batch = append(batch, x); len(batch) < entryKindsBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			for _, appId := range srv.kinds.takeLost() {
+				srv.resetEntryKindsSince(appId)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		srv.writeEntryKinds(batch)
+		batch = batch[:0]
+	}
+}
+
+func (srv *server) writeEntryKinds(batch []*entryKind) {
+	// 按应用和ID合并
+	kinds := make(map[string]map[string][]interface{})
+	for _, x := range batch {
+		ids, ok := kinds[x.appId]
+		if !ok {
+			ids = make(map[string][]interface{})
+			kinds[x.appId] = ids
+		}
+		ids[x.id] = append(ids[x.id], x.kind)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for appId, ids := range kinds {
+		collection := srv.mdb.Database(appId).Collection(entryKindsCollectionName)
+		if !srv.kinds.hasApp(appId) {
+			if _, err := collection.UpdateOne(
+				ctx,
+				bson.M{"_id": entryKindsSinceId},
+				bson.M{"$setOnInsert": bson.M{"at": time.Now()}},
+				options.Update().SetUpsert(true),
+			); err != nil {
+				log.Warnw("failed to index entry kinds",
+					"app_id", appId, "error", err)
+				continue
+			}
+			srv.kinds.addApp(appId)
+		}
+		models := make([]mongo.WriteModel, 0, len(ids))
+		for id, a := range ids {
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": id}).
+				SetUpdate(bson.M{"$addToSet": bson.M{
+					"kinds": bson.M{"$each": a},
+				}}).
+				SetUpsert(true))
+		}
+		if _, err := collection.BulkWrite(
+			ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			log.Warnw("failed to index entry kinds",
+				"app_id", appId, "error", err)
+			srv.resetEntryKindsSince(appId)
+		}
+	}
+}
+
+// 索引丢失时推迟开始时间，之前创建的角色清除时扫描所有集合
+func (srv *server) resetEntryKindsSince(appId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collection := srv.mdb.Database(appId).Collection(entryKindsCollectionName)
+	if _, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": entryKindsSinceId},
+		bson.M{"$max": bson.M{"at": time.Now()}},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		log.Warnw("failed to reset entry kinds since",
+			"app_id", appId, "error", err)
+	}
+}
+
+func (srv *server) purgeRoles(
+	ctx context.Context, appId string, roles []*db.Role) (err error) {
+	database := srv.mdb.Database(appId)
+	collection := database.Collection(entryKindsCollectionName)
+	var since struct {
+		At time.Time `bson:"at"`
+	}
+	if err = collection.FindOne(
+		ctx, bson.M{"_id": entryKindsSinceId}).Decode(&since); err != nil &&
+		err != mongo.ErrNoDocuments {
+		return
+	}
+	// 所有集合，只在需要扫描时获取
+	var allKinds []string
+	for _, role := range roles {
+		var kinds []string
+		if since.At.IsZero() || role.CreateAt.Before(since.At) {
+			if allKinds == nil {
+				if allKinds, err = listEntryKinds(ctx, database); err != nil {
+					return
+				}
+			}
+			kinds = allKinds
+		} else {
+			var index struct {
+				Kinds []string `bson:"kinds"`
+			}
+			if err = collection.FindOne(
+				ctx, bson.M{"_id": role.Id}).Decode(&index); err != nil &&
+				err != mongo.ErrNoDocuments {
+				return
+			}
+			kinds = index.Kinds
+		}
+		if err = srv.purgeEntries(ctx, appId, role.Id, kinds); err != nil {
+			return
+		}
+		if _, err = collection.DeleteOne(
+			ctx, bson.M{"_id": role.Id}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (srv *server) purgeEntries(
+	ctx context.Context, appId, id string, kinds []string) (err error) {
+	database := srv.mdb.Database(appId)
+	for _, kind := range kinds {
+		// 先删缓存，避免脏数据再次同步回数据库
+		if err = srv.rdb.Del(
+			ctx, fmt.Sprintf("%s:%s:%s", appId, kind, id)).Err(); err != nil {
+			return
+		}
+		if _, err = database.Collection(kind).DeleteOne(
+			ctx, bson.M{"_id": id}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func listEntryKinds(
+	ctx context.Context, database *mongo.Database) (_ []string, err error) {
+	names, err := database.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return
+	}
+	kinds := make([]string, 0, len(names))
+	for _, name := range names {
+		// 应用库中可能还有其他模块的集合，如libra.roles
+		if !isValidStr(name, 1, 32) {
+			continue
+		}
+		kinds = append(kinds, name)
+	}
+	return kinds, nil
+}
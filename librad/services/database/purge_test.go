@@ -0,0 +1,45 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEntryKindsCache(t *testing.T) {
+	c := newEntryKindsCache()
+	for i := 0; i < maxEntryKindsCache; i++ {
+		if !c.add(fmt.Sprint(i)) {
+			t.Fatal("expect added: ", i)
+		}
+	}
+	// 访问过的键不会被淘汰
+	if c.add("0") {
+		t.Fatal("expect cached")
+	}
+	c.add("new")
+	if c.lru.Len() != maxEntryKindsCache {
+		t.Fatal("unexpected cache size: ", c.lru.Len())
+	}
+	if c.add("0") {
+		t.Fatal("expect 0 cached")
+	}
+	if !c.add("1") {
+		t.Fatal("expect 1 evicted")
+	}
+}
+
+func TestIndexEntry(t *testing.T) {
+	srv := &server{
+		kinds:        newEntryKindsCache(),
+		pendingKinds: make(chan *entryKind, 10),
+	}
+	// 只记录角色数据，已记录的不再写入
+	srv.indexEntry("app", "kind", "not-a-role")
+	srv.indexEntry("app", "kind", "AAAAAAAAAAAAAAAB")
+	srv.indexEntry("app", "kind", "AAAAAAAAAAAAAAAC")
+	srv.indexEntry("app", "kind", "AAAAAAAAAAAAAAAC")
+	srv.indexEntry("app", "kind2", "AAAAAAAAAAAAAAAC")
+	if len(srv.pendingKinds) != 2 {
+		t.Fatal("unexpected pending: ", len(srv.pendingKinds))
+	}
+}
@@ -30,6 +30,14 @@ type server struct {
 	db *redmon.Client  // database
 	mb *redmon.Client  // mailbox
 	dl *redlock.Client // distlock
+
+	// 数据库的底层连接，用于清除角色数据
+	rdb redis.Client
+	mdb *mongo.Client
+	// 已记录的数据类型索引
+	kinds *entryKindsCache
+	// 等待写入的数据类型索引
+	pendingKinds chan *entryKind
 }
 
 func createServer(jb json.RawMessage) (*server, error) {
@@ -56,7 +64,10 @@ func createServer(jb json.RawMessage) (*server, error) {
 
 	log.Debugf("database.cfg: %#v", cfg)
 
-	srv := &server{}
+	srv := &server{
+		kinds:        newEntryKindsCache(),
+		pendingKinds: make(chan *entryKind, maxPendingEntryKinds),
+	}
 
 	if rdb, err := redis.Dial(
 		ctx, cfg.Database.Redis, redis.WithPingTest()); err != nil {
@@ -65,6 +76,8 @@ func createServer(jb json.RawMessage) (*server, error) {
 		return nil, err
 	} else {
 		srv.db = redmon.NewClient(rdb, mdb)
+		srv.rdb, srv.mdb = rdb, mdb
+		go srv.serveEntryKinds()
 	}
 
 	if rdb, err := redis.Dial(
@@ -249,7 +262,7 @@ func (srv *server) Unlock(
 func (srv *server) Get(
 	ctx context.Context, req *v1pb.DatabaseGetRequest) (
 	_ *v1pb.DatabaseGetResponse, err error) {
-	_, key, err := getAppIdAndUniqKey(ctx, req.Key)
+	appId, key, err := getAppIdAndUniqKey(ctx, req.Key)
 	if err != nil {
 		return
 	}
@@ -270,6 +283,7 @@ func (srv *server) Get(
 	// get data
 	var opts []redmon.GetOption
 	if req.AddIfNotFound != nil {
+		srv.indexEntry(appId, req.Key.Kind, req.Key.Id)
 		if buf, err := encodeMessage(req.AddIfNotFound); err != nil {
 			return nil, fromProtoError(err)
 		} else {
@@ -291,7 +305,7 @@ func (srv *server) Set(
 	_ *v1pb.DatabaseSetResponse, err error) {
 	// 在处理解锁之前检查请求参数，如果请求参数错误，就很难去猜测
 	// 这个请求的真正意图要不要处理锁，所以还是不要动的好
-	_, key, err := getAppIdAndUniqKey(ctx, req.Key)
+	appId, key, err := getAppIdAndUniqKey(ctx, req.Key)
 	if err != nil {
 		return
 	}
@@ -324,6 +338,7 @@ func (srv *server) Set(
 		log.Warnf("set: failed to encode message: %s", err)
 		return nil, fromProtoError(err)
 	}
+	srv.indexEntry(appId, req.Key.Kind, req.Key.Id)
 	resp := &v1pb.DatabaseSetResponse{}
 	if resp.Revision, err = srv.db.Set(ctx, key, buf); err != nil {
 		log.Warnf("set: failed set to db: %s", err)
@@ -14,10 +14,11 @@ import (
 type leaderboardServer struct {
 	v1.UnimplementedLeaderboardServer
 	cli redchart.Client
+	rdb redis.Client
 }
 
 func newLeaderboardServer(cli redis.Client) *leaderboardServer {
-	return &leaderboardServer{cli: redchart.New(cli)}
+	return &leaderboardServer{cli: redchart.New(cli), rdb: cli}
 }
 
 func (lb *leaderboardServer) Touch(
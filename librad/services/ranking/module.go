@@ -7,6 +7,7 @@ import (
 	servermodule "github.com/onemoreteam/httpframework/modularity/server"
 
 	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	"github.com/ntons/libra/librad/db"
 )
 
 func init() {
@@ -29,5 +30,6 @@ func (m *rankingModule) Initialize(jb json.RawMessage) (err error) {
 	}
 	servermodule.RegisterGrpcService(&v1pb.BubbleChart_ServiceDesc, srv.bubblechart)
 	servermodule.RegisterGrpcService(&v1pb.Leaderboard_ServiceDesc, srv.leaderboard)
+	db.RegisterRolePurger("ranking", srv.leaderboard.purgeRoles)
 	return
 }
@@ -0,0 +1,41 @@
+package ranking
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 清除已删除角色在本应用所有排行榜中的条目，一次扫描清除一批角色
+func (lb *leaderboardServer) purgeRoles(
+	ctx context.Context, appId string, roles []*db.Role) (err error) {
+	roleIds := make([]string, 0, len(roles))
+	for _, role := range roles {
+		roleIds = append(roleIds, role.Id)
+	}
+	// 与fromChartKey保持一致，有序集合的键以":z"结尾
+	match := fmt.Sprintf("chart:{%s:*:z", appId)
+	scan := func(ctx context.Context, cli redis.Cmdable) (err error) {
+		iter := cli.Scan(ctx, 0, match, 1000).Iterator()
+		for iter.Next(ctx) {
+			name := strings.TrimSuffix(iter.Val(), ":z")
+			if err = lb.cli.GetLeaderboard(name).RemoveById(
+				ctx, roleIds); err != nil {
+				return
+			}
+		}
+		return iter.Err()
+	}
+	// 集群需要逐个分片扫描
+	if cluster, ok := lb.rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(
+			ctx, func(ctx context.Context, cli *redis.Client) error {
+				return scan(ctx, cli)
+			})
+	}
+	return scan(ctx, lb.rdb)
+}
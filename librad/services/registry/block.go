@@ -0,0 +1,183 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	log "github.com/ntons/log-go"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 封禁列表的查询、导出和导入
+
+// 导出时每条消息包含的封禁数
+const blockExportBatchSize = 500
+
+func init() {
+	registerExtMethods(
+		newExtMethod("ListBlocks", listBlocks),
+	)
+	registerExtStreams(
+		newExtServerStream("ExportBlocks", exportBlocks),
+		newExtClientStream("ImportBlocks", importBlocks),
+	)
+}
+
+type xBlockData struct {
+	Key    string `json:"key"`
+	Type   string `json:"type,omitempty"`
+	BanAt  int64  `json:"ban_at,omitempty"`
+	BanTo  int64  `json:"ban_to"`
+	BanFor string `json:"ban_for,omitempty"`
+	BanBy  string `json:"ban_by,omitempty"`
+}
+
+func fromDbBlock(x *db.BlockData) *xBlockData {
+	r := &xBlockData{
+		Key:    x.Key,
+		Type:   x.Type,
+		BanTo:  x.BanTo.Unix(),
+		BanFor: x.BanFor,
+		BanBy:  x.BanBy,
+	}
+	if !x.BanAt.IsZero() {
+		r.BanAt = x.BanAt.Unix()
+	}
+	return r
+}
+
+func toDbBlock(x *xBlockData) *db.BlockData {
+	r := &db.BlockData{
+		Key:    x.Key,
+		BanTo:  time.Unix(x.BanTo, 0),
+		BanFor: x.BanFor,
+	}
+	if x.BanAt > 0 {
+		r.BanAt = time.Unix(x.BanAt, 0)
+	}
+	return r
+}
+
+type xBlockFilter struct {
+	Type      string `json:"type,omitempty"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	BanBy     string `json:"ban_by,omitempty"`
+}
+
+func (x *xBlockFilter) toDb() *db.BlockFilter {
+	if x == nil {
+		return nil
+	}
+	return &db.BlockFilter{
+		Type:      x.Type,
+		KeyPrefix: x.KeyPrefix,
+		BanBy:     x.BanBy,
+	}
+}
+
+type xListBlocksRequest struct {
+	Filter *xBlockFilter `json:"filter,omitempty"`
+	// 上一页返回的next
+	After string `json:"after,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type xListBlocksResponse struct {
+	Blocks []*xBlockData `json:"blocks"`
+	// 为空表示没有更多了
+	Next string `json:"next,omitempty"`
+}
+
+// 分页列出生效中的封禁
+func listBlocks(
+	ctx context.Context, req *xListBlocksRequest) (
+	_ *xListBlocksResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	blocks, next, err := db.ListBlocks(
+		ctx, appId, req.Filter.toDb(), req.After, req.Limit)
+	if err != nil {
+		return
+	}
+	resp := &xListBlocksResponse{Next: next}
+	for _, x := range blocks {
+		resp.Blocks = append(resp.Blocks, fromDbBlock(x))
+	}
+	return resp, nil
+}
+
+type xExportBlocksRequest struct {
+	Filter *xBlockFilter `json:"filter,omitempty"`
+}
+
+type xBlocksBatch struct {
+	Blocks []*xBlockData `json:"blocks"`
+}
+
+// 导出生效中的封禁，分批返回
+func exportBlocks(
+	req *xExportBlocksRequest,
+	stream *xExtServerStream[xBlocksBatch]) (err error) {
+	ctx := stream.Context()
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	batch := &xBlocksBatch{}
+	if err = db.ExportBlocks(
+		ctx, appId, req.Filter.toDb(),
+		func(x *db.BlockData) error {
+			batch.Blocks = append(batch.Blocks, fromDbBlock(x))
+			if len(batch.Blocks) < blockExportBatchSize {
+				return nil
+			}
+			err := stream.Send(batch)
+			batch.Blocks = batch.Blocks[:0]
+			return err
+		},
+	); err != nil {
+		return
+	}
+	if len(batch.Blocks) > 0 {
+		return stream.Send(batch)
+	}
+	return
+}
+
+type xImportBlocksResponse struct {
+	// 导入的封禁数，已过期的封禁被忽略
+	Imported int `json:"imported"`
+}
+
+// 导入封禁，客户端分批发送导出的封禁
+func importBlocks(
+	stream *xExtClientStream[xBlocksBatch]) (
+	_ *xImportBlocksResponse, err error) {
+	ctx := stream.Context()
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	var pending []*xBlockData
+	next := func() (*db.BlockData, error) {
+		for len(pending) == 0 {
+			batch, err := stream.Recv()
+			if err != nil {
+				return nil, err
+			}
+			pending = batch.Blocks
+		}
+		x := pending[0]
+		pending = pending[1:]
+		return toDbBlock(x), nil
+	}
+	n, err := db.ImportBlocks(ctx, appId, getTrustedAdminId(ctx), next)
+	if err != nil {
+		log.Warnf("failed to import blocks: %v, %v", n, err)
+		return
+	}
+	return &xImportBlocksResponse{Imported: n}, nil
+}
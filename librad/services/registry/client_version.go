@@ -0,0 +1,214 @@
+package registry
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/ntons/libra/librad/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// 客户端版本要求
+// 登录时按设备系统找到应用的版本规则，低于最低版本拒绝登录，
+// 低于推荐版本允许登录，并在trailer中返回推荐版本和下载地址。
+// 版本号是点分隔的数字，忽略"-"或"+"之后的部分，
+// 没有上报版本的客户端视为最低版本。
+
+const (
+	// 推荐升级时返回的trailer
+	xLibraRecommendedVersion = "x-libra-recommended-version"
+	xLibraDownloadUrl        = "x-libra-download-url"
+)
+
+func init() {
+	registerExtMethods(
+		newExtMethod("GetClientVersionRules", getClientVersionRules),
+		newExtMethod("SetClientVersionRules", setClientVersionRules),
+	)
+}
+
+// 解析版本号，格式不正确时返回假
+func parseClientVersion(v string) (_ []int, ok bool) {
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "v"), "V")
+	if v == "" {
+		return nil, false
+	}
+	parts := strings.Split(v, ".")
+	r := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		r = append(r, n)
+	}
+	return r, true
+}
+
+// 比较版本号，缺少的部分视为0，无法解析的版本最小
+func compareClientVersion(a, b string) int {
+	x, okx := parseClientVersion(a)
+	y, oky := parseClientVersion(b)
+	switch {
+	case !okx && !oky:
+		return 0
+	case !okx:
+		return -1
+	case !oky:
+		return 1
+	}
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var m, n int
+		if i < len(x) {
+			m = x[i]
+		}
+		if i < len(y) {
+			n = y[i]
+		}
+		if m != n {
+			if m < n {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func newUpgradeRequiredError(
+	rule *db.ClientVersionRule, platform string) error {
+	detail, _ := structpb.NewStruct(map[string]interface{}{
+		"platform":            platform,
+		"min_version":         rule.MinVersion,
+		"recommended_version": rule.RecommendedVersion,
+		"download_url":        rule.DownloadUrl,
+		"message":             rule.Message,
+	})
+	return newFailedPreconditionError(
+		newErrorDetail(db.ErrorCodeUpgradeRequired, detail))
+}
+
+// 检查客户端版本，低于最低版本时返回错误，低于推荐版本时返回规则
+func checkClientVersion(
+	app *db.App, platform, version string) (
+	recommended *db.ClientVersionRule, err error) {
+	rule := app.FindClientVersionRule(platform)
+	if rule == nil {
+		return
+	}
+	if rule.MinVersion != "" &&
+		compareClientVersion(version, rule.MinVersion) < 0 {
+		return nil, newUpgradeRequiredError(rule, platform)
+	}
+	if rule.RecommendedVersion != "" &&
+		compareClientVersion(version, rule.RecommendedVersion) < 0 {
+		return rule, nil
+	}
+	return
+}
+
+// 登录时检查客户端版本，推荐升级时设置trailer
+func checkLoginClientVersion(
+	ctx context.Context, app *db.App, platform, version string) (err error) {
+	rule, err := checkClientVersion(app, platform, version)
+	if err != nil || rule == nil {
+		return
+	}
+	md := metadata.Pairs(xLibraRecommendedVersion, rule.RecommendedVersion)
+	if rule.DownloadUrl != "" {
+		md.Append(xLibraDownloadUrl, rule.DownloadUrl)
+	}
+	grpc.SetTrailer(ctx, md)
+	return
+}
+
+// 设置应用的客户端版本要求，立即生效，rules为空时清除
+func SetClientVersionRules(
+	ctx context.Context, appId string, rules []*db.ClientVersionRule) error {
+	platforms := make(map[string]bool)
+	for _, rule := range rules {
+		for _, v := range []string{rule.MinVersion, rule.RecommendedVersion} {
+			if _, ok := parseClientVersion(v); v != "" && !ok {
+				return newInvalidArgumentError("invalid client version")
+			}
+		}
+		if rule.MinVersion != "" && rule.RecommendedVersion != "" &&
+			compareClientVersion(
+				rule.RecommendedVersion, rule.MinVersion) < 0 {
+			return newInvalidArgumentError(
+				"recommended version lower than min version")
+		}
+		platform := strings.ToLower(rule.Platform)
+		if platforms[platform] {
+			return newInvalidArgumentError("duplicated platform")
+		}
+		platforms[platform] = true
+	}
+	return db.SetAppClientVersionRules(ctx, appId, rules)
+}
+
+type xClientVersionRuleData struct {
+	Platform           string `json:"platform,omitempty"`
+	MinVersion         string `json:"min_version,omitempty"`
+	RecommendedVersion string `json:"recommended_version,omitempty"`
+	DownloadUrl        string `json:"download_url,omitempty"`
+	Message            string `json:"message,omitempty"`
+}
+
+type xClientVersionRulesData struct {
+	Rules []*xClientVersionRuleData `json:"rules"`
+}
+
+func getClientVersionRules(
+	ctx context.Context, req *xEmpty) (_ *xClientVersionRulesData, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	resp := &xClientVersionRulesData{}
+	for _, x := range app.ClientVersionRules {
+		resp.Rules = append(resp.Rules, &xClientVersionRuleData{
+			Platform:           x.Platform,
+			MinVersion:         x.MinVersion,
+			RecommendedVersion: x.RecommendedVersion,
+			DownloadUrl:        x.DownloadUrl,
+			Message:            x.Message,
+		})
+	}
+	return resp, nil
+}
+
+func setClientVersionRules(
+	ctx context.Context, req *xClientVersionRulesData) (_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	rules := make([]*db.ClientVersionRule, 0, len(req.Rules))
+	for _, x := range req.Rules {
+		if x == nil {
+			return nil, newInvalidArgumentError("invalid client version rule")
+		}
+		rules = append(rules, &db.ClientVersionRule{
+			Platform:           x.Platform,
+			MinVersion:         x.MinVersion,
+			RecommendedVersion: x.RecommendedVersion,
+			DownloadUrl:        x.DownloadUrl,
+			Message:            x.Message,
+		})
+	}
+	if err = SetClientVersionRules(ctx, appId, rules); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+func TestCompareClientVersion(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		r    int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"v1.10.0", "1.9.9", 1},
+		{"1.2.3-beta", "1.2.3", 0},
+		{"1.2.3+42", "1.2.4", -1},
+		{"", "0.0.1", -1},
+		{"abc", "1.0", -1},
+		{"2", "abc", 1},
+	} {
+		if r := compareClientVersion(c.a, c.b); r != c.r {
+			t.Errorf("%q vs %q: unexpected result: %d", c.a, c.b, r)
+		}
+	}
+}
+
+func TestCheckClientVersion(t *testing.T) {
+	app := &db.App{
+		ClientVersionRules: []*db.ClientVersionRule{
+			{MinVersion: "1.0", RecommendedVersion: "1.5"},
+			{Platform: "iOS", MinVersion: "2.0", DownloadUrl: "https://x"},
+		},
+	}
+	for _, c := range []struct {
+		platform, version string
+		recommended, fail bool
+	}{
+		{"android", "0.9", false, true},
+		{"android", "1.2", true, false},
+		{"android", "1.5", false, false},
+		{"ios", "1.9", false, true},
+		{"IOS", "2.0.0", false, false},
+		{"", "", false, true},
+	} {
+		rule, err := checkClientVersion(app, c.platform, c.version)
+		if (err != nil) != c.fail || (rule != nil) != c.recommended {
+			t.Errorf("%s %s: unexpected result: %v, %v",
+				c.platform, c.version, rule, err)
+		}
+	}
+	if _, err := checkClientVersion(&db.App{}, "ios", ""); err != nil {
+		t.Errorf("unexpected error without rules: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+var cfg = &xConfig{}
+
+type xConfig struct {
+	// 邮箱密码登录
+	Email struct {
+		// 邮件输出文件，没有接入邮件服务时使用，
+		// 为空且未调用SetEmailSender时无法发送邮件
+		Outbox string
+		// 邮箱验证码有效期
+		VerifyTimeout string
+		// 重置密码验证码有效期
+		ResetTimeout string
+		// 登录失败和邮件发送次数的统计窗口
+		Window string
+		// 窗口内单个邮箱的最大登录失败次数
+		MaxFailuresPerEmail int
+		// 窗口内单个IP的最大登录失败次数
+		MaxFailuresPerIp int
+		// 窗口内单个邮箱的最大发送次数
+		MaxSendsPerEmail int
+		// 窗口内单个IP的最大发送次数
+		MaxSendsPerIp int
+		// parsed to
+		verifyTimeout time.Duration
+		resetTimeout  time.Duration
+		loginPolicy   db.AttemptPolicy
+		sendPolicy    db.AttemptPolicy
+	}
+	// 手机验证码登录
+	Sms struct {
+		// 验证码有效期
+		Timeout string
+		// 重发间隔
+		Cooldown string
+		// 单个验证码的最大尝试次数
+		MaxAttempts int
+		// 发送次数的统计窗口
+		Window string
+		// 窗口内单个号码的最大发送次数
+		MaxPerNumber int
+		// 窗口内单个IP的最大发送次数
+		MaxPerIp int
+		// parsed to
+		policy db.OtpPolicy
+	}
+	// 账号迁移码
+	Transfer struct {
+		// 迁移码有效期
+		Timeout string
+		// 失败次数的统计窗口
+		Window string
+		// 窗口内单个IP的最大失败次数
+		MaxFailuresPerIp int
+		// parsed to
+		policy db.TransferCodePolicy
+	}
+}
+
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (cfg *xConfig) parse() (err error) {
+	if cfg.Email.verifyTimeout, err = parseDuration(
+		cfg.Email.VerifyTimeout, 24*time.Hour); err != nil {
+		return
+	}
+	if cfg.Email.resetTimeout, err = parseDuration(
+		cfg.Email.ResetTimeout, 30*time.Minute); err != nil {
+		return
+	}
+	window, err := parseDuration(cfg.Email.Window, 15*time.Minute)
+	if err != nil {
+		return
+	}
+	cfg.Email.loginPolicy = db.AttemptPolicy{
+		Window:       window,
+		MaxPerTarget: cfg.Email.MaxFailuresPerEmail,
+		MaxPerIp:     cfg.Email.MaxFailuresPerIp,
+	}
+	if cfg.Email.loginPolicy.MaxPerTarget <= 0 {
+		cfg.Email.loginPolicy.MaxPerTarget = 10
+	}
+	if cfg.Email.loginPolicy.MaxPerIp <= 0 {
+		cfg.Email.loginPolicy.MaxPerIp = 100
+	}
+	cfg.Email.sendPolicy = db.AttemptPolicy{
+		Window:       window,
+		MaxPerTarget: cfg.Email.MaxSendsPerEmail,
+		MaxPerIp:     cfg.Email.MaxSendsPerIp,
+	}
+	if cfg.Email.sendPolicy.MaxPerTarget <= 0 {
+		cfg.Email.sendPolicy.MaxPerTarget = 5
+	}
+	if cfg.Email.sendPolicy.MaxPerIp <= 0 {
+		cfg.Email.sendPolicy.MaxPerIp = 50
+	}
+	p := &cfg.Sms.policy
+	if p.Timeout, err = parseDuration(cfg.Sms.Timeout, 5*time.Minute); err != nil {
+		return
+	}
+	if p.Cooldown, err = parseDuration(cfg.Sms.Cooldown, time.Minute); err != nil {
+		return
+	}
+	if p.Window, err = parseDuration(cfg.Sms.Window, 24*time.Hour); err != nil {
+		return
+	}
+	if p.MaxAttempts = cfg.Sms.MaxAttempts; p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.MaxPerTarget = cfg.Sms.MaxPerNumber; p.MaxPerTarget <= 0 {
+		p.MaxPerTarget = 10
+	}
+	if p.MaxPerIp = cfg.Sms.MaxPerIp; p.MaxPerIp <= 0 {
+		p.MaxPerIp = 50
+	}
+	q := &cfg.Transfer.policy
+	if q.Timeout, err = parseDuration(
+		cfg.Transfer.Timeout, 24*time.Hour); err != nil {
+		return
+	}
+	if q.Window, err = parseDuration(cfg.Transfer.Window, time.Hour); err != nil {
+		return
+	}
+	if q.MaxFailuresPerIp = cfg.Transfer.MaxFailuresPerIp; q.MaxFailuresPerIp <= 0 {
+		q.MaxFailuresPerIp = 10
+	}
+	return
+}
+
+func loadConfig(jb json.RawMessage) (err error) {
+	if len(jb) > 0 {
+		if err = json.Unmarshal(jb, cfg); err != nil {
+			return
+		}
+	}
+	return cfg.parse()
+}
@@ -0,0 +1,544 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	log "github.com/ntons/log-go"
+	"github.com/ntons/tongo/httputil"
+	"golang.org/x/crypto/argon2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 邮箱密码登录
+// 没有账号服务的应用可以直接使用邮箱密码注册，账号ID为"email:<邮箱>"。
+// 密码使用argon2id哈希保存，注册后需要验证邮箱才能登录。
+// 验证码是签名的一次性令牌，签名内容包含当前的密码哈希，
+// 验证邮箱或修改密码后哈希变化，之前签发的验证码随之失效。
+// 登录失败和邮件发送按邮箱和IP限制次数，密码哈希之前先检查失败次数。
+//
+// 登录态消息定义如下，libra-go中尚未生成，这里直接按线格式解码：
+//
+//	message PasswordLoginState {
+//	  string email = 1;
+//	  string password = 2;
+//	}
+const passwordLoginStateName = "libra.v1.PasswordLoginState"
+
+const emailAcctIdPrefix = "email:"
+
+// 次数限制的用途
+const (
+	passwordLoginAttemptKind = "pwd"
+	emailSendAttemptKind     = "email"
+)
+
+const (
+	// 邮箱最大长度
+	maxEmailLen = 254
+	// 密码长度限制(字节)
+	minPasswordLen = 8
+	maxPasswordLen = 128
+)
+
+// argon2id参数
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// 邮箱归一化，只接受不带显示名的地址，统一小写
+func normalizeEmail(s string) (_ string, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s) > maxEmailLen {
+		return "", errInvalidEmail
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || addr.Name != "" {
+		return "", errInvalidEmail
+	}
+	return strings.ToLower(s), nil
+}
+
+func checkPasswordPolicy(password string) error {
+	if len(password) < minPasswordLen || len(password) > maxPasswordLen {
+		return errWeakPassword
+	}
+	return nil
+}
+
+func getEmailAcctId(email string) string {
+	return emailAcctIdPrefix + email
+}
+
+// 以PHC格式输出: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func hashPassword(password string) (_ string, err error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	key := argon2.IDKey([]byte(password), salt,
+		argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	enc := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		enc(salt), enc(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil ||
+		version != argon2.Version {
+		return false
+	}
+	var (
+		memory     uint32
+		iterations uint32
+		threads    uint8
+	)
+	if _, err := fmt.Sscanf(
+		parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	dec := base64.RawStdEncoding.DecodeString
+	salt, err := dec(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := dec(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	other := argon2.IDKey(
+		[]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     string
+)
+
+// 邮箱不存在时也计算一次哈希，避免通过耗时判断邮箱是否注册
+func checkDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = hashPassword("")
+	})
+	checkPassword(dummyPasswordHash, password)
+}
+
+// 验证码: base64url(kind \0 email \0 expire_at) "." base64url(mac)
+func getCredentialCodeMac(
+	app *db.App, payload, passwordHash string) []byte {
+	h := hmac.New(sha256.New, []byte(app.Id+"\x00"+app.Secret))
+	h.Write([]byte(payload))
+	h.Write([]byte{0})
+	h.Write([]byte(passwordHash))
+	return h.Sum(nil)
+}
+
+func signCredentialCode(
+	app *db.App, kind, email, passwordHash string, expireAt time.Time) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	payload := enc([]byte(
+		kind + "\x00" + email + "\x00" + strconv.FormatInt(expireAt.Unix(), 10)))
+	return payload + "." + enc(getCredentialCodeMac(app, payload, passwordHash))
+}
+
+// 解析验证码，签名需要取到凭证后再验证
+func parseCredentialCode(code string) (
+	payload, kind, email string, expireAt time.Time, mac []byte, err error) {
+	i := strings.IndexByte(code, '.')
+	if i < 0 {
+		err = fmt.Errorf("malformed code")
+		return
+	}
+	dec := base64.RawURLEncoding.DecodeString
+	payload = code[:i]
+	b, err := dec(payload)
+	if err != nil {
+		return
+	}
+	if mac, err = dec(code[i+1:]); err != nil {
+		return
+	}
+	parts := bytes.Split(b, []byte{0})
+	if len(parts) != 3 {
+		err = fmt.Errorf("malformed code")
+		return
+	}
+	ts, err := strconv.ParseInt(string(parts[2]), 10, 64)
+	if err != nil {
+		return
+	}
+	return payload, string(parts[0]), string(parts[1]), time.Unix(ts, 0), mac, nil
+}
+
+// 验证一次性验证码，返回签发时的凭证
+func checkCredentialCode(
+	ctx context.Context, app *db.App, kind, code string, now time.Time) (
+	_ *db.Credential, err error) {
+	payload, k, email, expireAt, mac, err := parseCredentialCode(code)
+	if err != nil || k != kind || now.After(expireAt) {
+		return nil, errInvalidCode
+	}
+	x, err := db.GetCredential(ctx, app.Id, email)
+	if err != nil {
+		if err == db.ErrCredentialNotFound {
+			return nil, errInvalidCode
+		}
+		return
+	}
+	if !hmac.Equal(mac, getCredentialCodeMac(app, payload, x.PasswordHash)) {
+		return nil, errInvalidCode
+	}
+	return x, nil
+}
+
+func sendCredentialCode(
+	ctx context.Context, app *db.App, kind string, x *db.Credential,
+	timeout time.Duration) (err error) {
+	expireAt := time.Now().Add(timeout)
+	if err = sendEmail(ctx, &EmailMessage{
+		AppId:    app.Id,
+		To:       x.Email,
+		Kind:     kind,
+		Code:     signCredentialCode(app, kind, x.Email, x.PasswordHash, expireAt),
+		ExpireAt: expireAt,
+	}); err != nil {
+		log.Warnf("failed to send email: %v, %v, %v", app.Id, kind, err)
+		return errEmailUnavailable
+	}
+	return
+}
+
+// 邮件发送计数，邮箱未注册时同样计数，不暴露注册状态
+func addEmailSendAttempt(
+	ctx context.Context, app *db.App, email, clientIp string) error {
+	return db.AddAttempt(ctx, app.Id, emailSendAttemptKind,
+		email, clientIp, &cfg.Email.sendPolicy)
+}
+
+// 注册邮箱密码，并发送邮箱验证码
+// 邮箱已验证时同样返回成功，不暴露注册状态；
+// 待验证期间只能使用相同的密码重新发送验证码，过期后才能使用其他密码注册
+func RegisterEmail(
+	ctx context.Context, app *db.App, email, password, clientIp string) (
+	err error) {
+	if email, err = normalizeEmail(email); err != nil {
+		return
+	}
+	if err = checkPasswordPolicy(password); err != nil {
+		return
+	}
+	if err = addEmailSendAttempt(ctx, app, email, clientIp); err != nil {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Warnf("failed to hash password: %v", err)
+		return errInternal
+	}
+	x, err := db.CreateCredential(
+		ctx, app.Id, email, hash, cfg.Email.verifyTimeout)
+	if err == db.ErrCredentialAlreadyExists {
+		if x, err = db.GetCredential(ctx, app.Id, email); err != nil {
+			return
+		}
+		if x.IsVerified() {
+			return nil
+		}
+		if !checkPassword(x.PasswordHash, password) {
+			return errEmailPending
+		}
+	}
+	if err != nil {
+		return
+	}
+	return sendCredentialCode(
+		ctx, app, EmailKindVerify, x, cfg.Email.verifyTimeout)
+}
+
+// 重新发送邮箱验证码
+func ResendEmailVerification(
+	ctx context.Context, app *db.App, email, clientIp string) (err error) {
+	if email, err = normalizeEmail(email); err != nil {
+		return
+	}
+	if err = addEmailSendAttempt(ctx, app, email, clientIp); err != nil {
+		return
+	}
+	x, err := db.GetCredential(ctx, app.Id, email)
+	if err != nil {
+		if err == db.ErrCredentialNotFound {
+			return nil
+		}
+		return
+	}
+	if x.IsVerified() {
+		return nil
+	}
+	return sendCredentialCode(
+		ctx, app, EmailKindVerify, x, cfg.Email.verifyTimeout)
+}
+
+// 使用验证码验证邮箱，返回账号ID
+func VerifyEmail(
+	ctx context.Context, app *db.App, code string) (_ string, err error) {
+	x, err := checkCredentialCode(ctx, app, EmailKindVerify, code, time.Now())
+	if err != nil {
+		return
+	}
+	if err = db.VerifyCredential(
+		ctx, app.Id, x.Email, x.PasswordHash); err != nil {
+		if err == db.ErrCredentialNotFound {
+			return "", errInvalidCode
+		}
+		return
+	}
+	return getEmailAcctId(x.Email), nil
+}
+
+// 申请重置密码，邮箱未注册时同样返回成功，不暴露注册状态
+func RequestPasswordReset(
+	ctx context.Context, app *db.App, email, clientIp string) (err error) {
+	if email, err = normalizeEmail(email); err != nil {
+		return
+	}
+	if err = addEmailSendAttempt(ctx, app, email, clientIp); err != nil {
+		return
+	}
+	x, err := db.GetCredential(ctx, app.Id, email)
+	if err != nil {
+		if err == db.ErrCredentialNotFound {
+			return nil
+		}
+		return
+	}
+	return sendCredentialCode(
+		ctx, app, EmailKindReset, x, cfg.Email.resetTimeout)
+}
+
+// 使用验证码重置密码，并登出已有的会话
+func ResetPassword(
+	ctx context.Context, app *db.App, code, password string) (err error) {
+	if err = checkPasswordPolicy(password); err != nil {
+		return
+	}
+	x, err := checkCredentialCode(ctx, app, EmailKindReset, code, time.Now())
+	if err != nil {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Warnf("failed to hash password: %v", err)
+		return errInternal
+	}
+	if err = db.UpdateCredentialPassword(
+		ctx, app.Id, x.Email, x.PasswordHash, hash); err != nil {
+		if err == db.ErrCredentialNotFound {
+			return errInvalidCode
+		}
+		return
+	}
+	users, err := db.GetUsersByAcctId(ctx, app.Id, getEmailAcctId(x.Email))
+	if err != nil {
+		log.Warnf("failed to get users: %v", err)
+		return nil
+	}
+	for _, user := range users {
+		if err := db.LogoutUser(ctx, user.Id); err != nil {
+			log.Warnf("failed to logout user: %v, %v", user.Id, err)
+		}
+	}
+	return nil
+}
+
+type passwordLoginState struct {
+	Email    string
+	Password string
+}
+
+func (x *passwordLoginState) unmarshal(b []byte) error {
+	return unmarshalStringFields(b, map[protowire.Number]*string{
+		1: &x.Email,
+		2: &x.Password,
+	})
+}
+
+func verifyPasswordLoginState(
+	ctx context.Context, app *db.App, anyState *anypb.Any) (
+	_ *v1pb.UniformLoginState, err error) {
+	state := &passwordLoginState{}
+	if err = state.unmarshal(anyState.GetValue()); err != nil {
+		return nil, errInvalidState
+	}
+	email, err := normalizeEmail(state.Email)
+	if err != nil {
+		return nil, errInvalidPassword
+	}
+	// 失败次数用尽时不再计算哈希
+	clientIp := httputil.GetRemoteIpFromContext(ctx)
+	p := &cfg.Email.loginPolicy
+	if err = db.CheckAttempts(ctx, app.Id,
+		passwordLoginAttemptKind, email, clientIp, p); err != nil {
+		return
+	}
+	x, err := db.GetCredential(ctx, app.Id, email)
+	if err != nil {
+		if err == db.ErrCredentialNotFound {
+			checkDummyPassword(state.Password)
+			addPasswordLoginFailure(ctx, app, email, clientIp)
+			return nil, errInvalidPassword
+		}
+		return
+	}
+	if !checkPassword(x.PasswordHash, state.Password) {
+		addPasswordLoginFailure(ctx, app, email, clientIp)
+		return nil, errInvalidPassword
+	}
+	if err := db.ResetAttempts(
+		ctx, app.Id, passwordLoginAttemptKind, email); err != nil {
+		log.Warnf("failed to reset login attempts: %v, %v", app.Id, err)
+	}
+	if !x.IsVerified() {
+		return nil, errEmailNotVerified
+	}
+	return &v1pb.UniformLoginState{
+		AcctIds: []string{getEmailAcctId(email)},
+	}, nil
+}
+
+// 记录登录失败，超过次数的错误在下次尝试时返回
+func addPasswordLoginFailure(
+	ctx context.Context, app *db.App, email, clientIp string) {
+	if err := db.AddAttempt(ctx, app.Id, passwordLoginAttemptKind,
+		email, clientIp, &cfg.Email.loginPolicy); err != nil &&
+		err != db.ErrTooManyAttempts {
+		log.Warnf("failed to add login attempt: %v, %v", app.Id, err)
+	}
+}
+
+func init() {
+	RegisterLoginStateVerifier(passwordLoginStateName, verifyPasswordLoginState)
+	registerExtMethods(
+		newExtMethod("RegisterEmail", registerEmail),
+		newExtMethod("ResendEmailVerification", resendEmailVerification),
+		newExtMethod("VerifyEmail", verifyEmail),
+		newExtMethod("RequestPasswordReset", requestPasswordReset),
+		newExtMethod("ResetPassword", resetPassword),
+	)
+}
+
+type xRegisterEmailRequest struct {
+	AppId    string `json:"app_id"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func registerEmail(
+	ctx context.Context, req *xRegisterEmailRequest) (_ *xEmpty, err error) {
+	app, err := requireExtLoginApp(ctx, req.AppId)
+	if err != nil {
+		return
+	}
+	if err = RegisterEmail(ctx, app, req.Email, req.Password,
+		httputil.GetRemoteIpFromContext(ctx)); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xEmailRequest struct {
+	AppId string `json:"app_id"`
+	Email string `json:"email"`
+}
+
+func resendEmailVerification(
+	ctx context.Context, req *xEmailRequest) (_ *xEmpty, err error) {
+	app, err := requireExtLoginApp(ctx, req.AppId)
+	if err != nil {
+		return
+	}
+	if err = ResendEmailVerification(ctx, app, req.Email,
+		httputil.GetRemoteIpFromContext(ctx)); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xVerifyEmailRequest struct {
+	AppId string `json:"app_id"`
+	Code  string `json:"code"`
+}
+
+type xVerifyEmailResponse struct {
+	AcctId string `json:"acct_id"`
+}
+
+func verifyEmail(
+	ctx context.Context, req *xVerifyEmailRequest) (
+	_ *xVerifyEmailResponse, err error) {
+	app, err := requireExtLoginApp(ctx, req.AppId)
+	if err != nil {
+		return
+	}
+	acctId, err := VerifyEmail(ctx, app, req.Code)
+	if err != nil {
+		return
+	}
+	return &xVerifyEmailResponse{AcctId: acctId}, nil
+}
+
+func requestPasswordReset(
+	ctx context.Context, req *xEmailRequest) (_ *xEmpty, err error) {
+	app, err := requireExtLoginApp(ctx, req.AppId)
+	if err != nil {
+		return
+	}
+	if err = RequestPasswordReset(ctx, app, req.Email,
+		httputil.GetRemoteIpFromContext(ctx)); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xResetPasswordRequest struct {
+	AppId    string `json:"app_id"`
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+func resetPassword(
+	ctx context.Context, req *xResetPasswordRequest) (_ *xEmpty, err error) {
+	app, err := requireExtLoginApp(ctx, req.AppId)
+	if err != nil {
+		return
+	}
+	if err = ResetPassword(ctx, app, req.Code, req.Password); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	logcfg "github.com/ntons/log-go/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "correct horse") {
+		t.Fatal("expect password match")
+	}
+	if checkPassword(hash, "correct horsf") {
+		t.Fatal("expect password mismatch")
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Fatal("expect different salt")
+	}
+	if checkPassword("$argon2id$v=19$m=1,t=1,p=1$$", "") {
+		t.Fatal("expect malformed hash mismatch")
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+		ok      bool
+	}{
+		{"Foo@Example.com", "foo@example.com", true},
+		{"  foo@example.com ", "foo@example.com", true},
+		{"Foo <foo@example.com>", "", false},
+		{"foo", "", false},
+		{"", "", false},
+	} {
+		out, err := normalizeEmail(c.in)
+		if (err == nil) != c.ok || out != c.out {
+			t.Errorf("%q: unexpected result: %q, %v", c.in, out, err)
+		}
+	}
+}
+
+func TestCredentialCode(t *testing.T) {
+	app := &db.App{Id: "app", Secret: "s3cret"}
+	const hash = "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA"
+	now := time.Now()
+	code := signCredentialCode(
+		app, EmailKindReset, "foo@example.com", hash, now.Add(time.Minute))
+
+	payload, kind, email, expireAt, mac, err := parseCredentialCode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != EmailKindReset || email != "foo@example.com" ||
+		expireAt.Unix() != now.Add(time.Minute).Unix() {
+		t.Fatalf("unexpected code: %v, %v, %v", kind, email, expireAt)
+	}
+	if string(mac) != string(getCredentialCodeMac(app, payload, hash)) {
+		t.Fatal("expect mac match")
+	}
+	// 密码修改后验证码失效
+	if string(mac) == string(getCredentialCodeMac(app, payload, hash+"x")) {
+		t.Fatal("expect mac mismatch after password changed")
+	}
+	if string(mac) == string(getCredentialCodeMac(
+		&db.App{Id: "app2", Secret: "s3cret"}, payload, hash)) {
+		t.Fatal("expect mac mismatch across apps")
+	}
+	for _, s := range []string{"", "abc", "abc.", "!!.!!"} {
+		if _, _, _, _, _, err := parseCredentialCode(s); err == nil {
+			t.Errorf("%q: expect malformed code", s)
+		}
+	}
+}
+
+func TestPasswordLoginStateUnmarshal(t *testing.T) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "foo@example.com")
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, "p@ssw0rd")
+	x := &passwordLoginState{}
+	if err := x.unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if x.Email != "foo@example.com" || x.Password != "p@ssw0rd" {
+		t.Fatalf("unexpected state: %+v", x)
+	}
+}
+
+// 测试用的邮件发送器，记录发送的邮件
+type xFakeEmailSender struct {
+	mu   sync.Mutex
+	sent []*EmailMessage
+}
+
+func (s *xFakeEmailSender) Send(ctx context.Context, msg *EmailMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func TestSendCredentialCode(t *testing.T) {
+	logcfg.DefaultZapJsonConfig.Use()
+	defer SetEmailSender(nil)
+	ctx := context.Background()
+	app := &db.App{Id: "app", Secret: "s3cret"}
+	x := &db.Credential{
+		Email:        "foo@example.com",
+		PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA",
+	}
+	// 没有设置发送器时不能发送，验证码不会输出到任何地方
+	SetEmailSender(nil)
+	if err := sendCredentialCode(
+		ctx, app, EmailKindVerify, x, time.Minute); err != errEmailUnavailable {
+		t.Fatalf("expect email unavailable, but got: %v", err)
+	}
+	sender := &xFakeEmailSender{}
+	SetEmailSender(sender)
+	if err := sendCredentialCode(
+		ctx, app, EmailKindVerify, x, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("unexpected sent: %v", len(sender.sent))
+	}
+	msg := sender.sent[0]
+	_, kind, email, _, _, err := parseCredentialCode(msg.Code)
+	if err != nil || kind != EmailKindVerify || email != x.Email {
+		t.Fatalf("unexpected code: %v, %v, %v", kind, email, err)
+	}
+}
+
+func TestExtLoginAppAuth(t *testing.T) {
+	for _, name := range []string{
+		"RegisterEmail", "ResendEmailVerification", "VerifyEmail",
+		"RequestPasswordReset", "ResetPassword",
+	} {
+		call := findExtMethod(t, name)
+		if _, err := call(context.Background(), map[string]interface{}{
+			"app_id": "unknown",
+			"email":  "foo@example.com",
+		}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expect invalid argument, but got: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 设备记录的查询和设备策略，玩家只能查看自己的设备
+
+func init() {
+	registerExtMethods(
+		newExtMethod("ListDeviceUsers", listDeviceUsers),
+		newExtMethod("ListUserDevices", listUserDevices),
+		newExtMethod("SetDevicePolicy", setDevicePolicy),
+	)
+}
+
+type xGeoLocationData struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+}
+
+func fromDbGeoLocation(x *db.GeoLocation) *xGeoLocationData {
+	if x == nil {
+		return nil
+	}
+	return &xGeoLocationData{Country: x.Country, Region: x.Region}
+}
+
+type xDeviceLoginData struct {
+	DeviceId     string            `json:"device_id"`
+	UserId       string            `json:"user_id"`
+	NewUser      bool              `json:"new_user,omitempty"`
+	FirstLoginAt int64             `json:"first_login_at"`
+	LastLoginAt  int64             `json:"last_login_at"`
+	LastLoginIp  string            `json:"last_login_ip,omitempty"`
+	LastLoginGeo *xGeoLocationData `json:"last_login_geo,omitempty"`
+	LoginCount   int64             `json:"login_count"`
+}
+
+func fromDbDeviceLogin(x *db.DeviceLogin) *xDeviceLoginData {
+	return &xDeviceLoginData{
+		DeviceId:     x.DeviceId,
+		UserId:       x.UserId,
+		NewUser:      x.NewUser,
+		FirstLoginAt: x.FirstLoginAt.Unix(),
+		LastLoginAt:  x.LastLoginAt.Unix(),
+		LastLoginIp:  x.LastLoginIp,
+		LastLoginGeo: fromDbGeoLocation(x.LastLoginGeo),
+		LoginCount:   x.LoginCount,
+	}
+}
+
+type xDeviceLoginsResponse struct {
+	Logins []*xDeviceLoginData `json:"logins"`
+}
+
+func fromDbDeviceLogins(logins []*db.DeviceLogin) *xDeviceLoginsResponse {
+	resp := &xDeviceLoginsResponse{}
+	for _, x := range logins {
+		resp.Logins = append(resp.Logins, fromDbDeviceLogin(x))
+	}
+	return resp
+}
+
+type xListDeviceUsersRequest struct {
+	DeviceId string `json:"device_id"`
+}
+
+// 设备上登录过的用户，用于排查小号
+func listDeviceUsers(
+	ctx context.Context, req *xListDeviceUsersRequest) (
+	_ *xDeviceLoginsResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if req.DeviceId == "" {
+		return nil, newInvalidArgumentError("device id required")
+	}
+	logins, err := db.ListDeviceUsers(ctx, appId, req.DeviceId)
+	if err != nil {
+		return
+	}
+	return fromDbDeviceLogins(logins), nil
+}
+
+type xListUserDevicesRequest struct {
+	UserId string `json:"user_id,omitempty"`
+}
+
+// 用户登录过的设备
+func listUserDevices(
+	ctx context.Context, req *xListUserDevicesRequest) (
+	_ *xDeviceLoginsResponse, err error) {
+	appId, userId, err := requireExtUser(ctx, req.UserId)
+	if err != nil {
+		return
+	}
+	logins, err := db.ListUserDevices(ctx, appId, userId)
+	if err != nil {
+		return
+	}
+	return fromDbDeviceLogins(logins), nil
+}
+
+type xDevicePolicyData struct {
+	MaxNewUsersPerDay   int64 `json:"max_new_users_per_day,omitempty"`
+	AlertNewUsersPerDay int64 `json:"alert_new_users_per_day,omitempty"`
+	AlertUsers          int64 `json:"alert_users,omitempty"`
+}
+
+type xSetDevicePolicyRequest struct {
+	// 为空时清除
+	Policy *xDevicePolicyData `json:"policy,omitempty"`
+}
+
+func setDevicePolicy(
+	ctx context.Context, req *xSetDevicePolicyRequest) (_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	var p *db.DevicePolicy
+	if x := req.Policy; x != nil {
+		p = &db.DevicePolicy{
+			MaxNewUsersPerDay:   x.MaxNewUsersPerDay,
+			AlertNewUsersPerDay: x.AlertNewUsersPerDay,
+			AlertUsers:          x.AlertUsers,
+		}
+	}
+	if err = db.SetAppDevicePolicy(ctx, appId, p); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
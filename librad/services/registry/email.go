@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// 邮件发送
+// 注册服务只生成邮件内容，由接入方实现EmailSender投递。
+// 没有接入邮件服务时可以配置写入文件，都没有配置时无法发送邮件。
+
+// 邮件类型
+const (
+	EmailKindVerify = "verify"
+	EmailKindReset  = "reset"
+)
+
+type EmailMessage struct {
+	AppId string `json:"app_id"`
+	To    string `json:"to"`
+	// 邮件类型，按类型选择模板
+	Kind string `json:"kind"`
+	// 一次性验证码
+	Code string `json:"code"`
+	// 验证码过期时间
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+type EmailSender interface {
+	Send(ctx context.Context, msg *EmailMessage) error
+}
+
+var (
+	xEmailSenderMu sync.RWMutex
+	xEmailSender   EmailSender
+)
+
+// 设置邮件发送器
+func SetEmailSender(sender EmailSender) {
+	xEmailSenderMu.Lock()
+	defer xEmailSenderMu.Unlock()
+	xEmailSender = sender
+}
+
+func sendEmail(ctx context.Context, msg *EmailMessage) error {
+	xEmailSenderMu.RLock()
+	sender := xEmailSender
+	xEmailSenderMu.RUnlock()
+	if sender == nil {
+		return errors.New("email sender not set")
+	}
+	return sender.Send(ctx, msg)
+}
+
+// 每封邮件一行JSON追加到文件
+type fileEmailSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newFileEmailSender(path string) *fileEmailSender {
+	return &fileEmailSender{path: path}
+}
+
+func (s *fileEmailSender) Send(ctx context.Context, msg *EmailMessage) (err error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return
+}
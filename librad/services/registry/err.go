@@ -50,6 +50,9 @@ func newInternalError(msg interface{}) error {
 func newUnavailableError(msg interface{}) error {
 	return newError(codes.Unavailable, msg)
 }
+func newFailedPreconditionError(msg interface{}) error {
+	return newError(codes.FailedPrecondition, msg)
+}
 
 func newErrorDetail(code v1pb.ErrorCode, data proto.Message) *v1pb.ErrorDetail {
 	r := &v1pb.ErrorDetail{Code: code}
@@ -64,12 +67,29 @@ var (
 	errInvalidAppSecret            = newUnauthenticatedError("invalid app secret")
 	errInvalidAdminSecret          = newUnauthenticatedError("invalid admin secret")
 	errMismatchedAppSecretAndToken = newUnauthenticatedError("mismatched app secret and token")
+	errInvalidIdToken              = newUnauthenticatedError("invalid id token")
+	errInvalidPassword             = newUnauthenticatedError("invalid email or password")
 
 	// InvalidArgument
 	errInvalidTimestamp = newInvalidArgumentError("invalid timestamp")
 	errInvalidState     = newInvalidArgumentError("invalid state")
 	errInvalidSignature = newInvalidArgumentError("invalid signature")
 	errInvalidMetadata  = newInvalidArgumentError("invalid metadata")
+	errInvalidEmail     = newInvalidArgumentError("invalid email")
+	errInvalidCode      = newInvalidArgumentError("invalid code")
+	errWeakPassword     = newInvalidArgumentError("weak password")
+	errInvalidPhone     = newInvalidArgumentError("invalid phone")
 
 	errMetadataTooLarge = newInvalidArgumentError("metadata too large")
+
+	// FailedPrecondition
+	errEmailNotVerified = newFailedPreconditionError("email not verified")
+	errEmailPending     = newFailedPreconditionError("email verification pending")
+
+	// Internal
+	errInternal = newInternalError("internal error")
+
+	// Unavailable
+	errEmailUnavailable = newUnavailableError("email unavailable")
+	errSMSUnavailable   = newUnavailableError("sms unavailable")
 )
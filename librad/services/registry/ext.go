@@ -0,0 +1,231 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+
+	L "github.com/ntons/libra-go"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 扩展接口
+// libra-go中尚未定义消息的接口先通过扩展服务提供，
+// 请求和响应都是google.protobuf.Struct，字段与下面各接口的请求和响应结构的JSON一致，
+// 时间均为Unix秒。libra-go定义正式的消息后迁移到对应的服务中。
+
+const extServiceName = "libra.ext.v1.Registry"
+
+var (
+	extMethods []grpc.MethodDesc
+	extStreams []grpc.StreamDesc
+)
+
+type xEmpty struct{}
+
+// 各功能在init中注册自己的扩展接口
+func registerExtMethods(methods ...grpc.MethodDesc) {
+	extMethods = append(extMethods, methods...)
+}
+
+func registerExtStreams(streams ...grpc.StreamDesc) {
+	extStreams = append(extStreams, streams...)
+}
+
+func newExtServiceDesc() *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: extServiceName,
+		HandlerType: (*interface{})(nil),
+		Methods:     extMethods,
+		Streams:     extStreams,
+		Metadata:    "libra/ext/v1/registry.proto",
+	}
+}
+
+func fromExtStruct(in *structpb.Struct, v interface{}) (err error) {
+	b, err := protojson.Marshal(in)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(b, v)
+}
+
+func toExtStruct(v interface{}) (_ *structpb.Struct, err error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	r := &structpb.Struct{}
+	if err = protojson.Unmarshal(b, r); err != nil {
+		return
+	}
+	return r, nil
+}
+
+func newExtMethod[Req, Resp any](
+	name string, fn func(context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	handler := func(ctx context.Context, in interface{}) (interface{}, error) {
+		req := new(Req)
+		if err := fromExtStruct(in.(*structpb.Struct), req); err != nil {
+			return nil, newInvalidArgumentError(err.Error())
+		}
+		resp, err := fn(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		r, err := toExtStruct(resp)
+		if err != nil {
+			return nil, errInternal
+		}
+		return r, nil
+	}
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(
+			srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := &structpb.Struct{}
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + extServiceName + "/" + name,
+			}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
+
+// 服务端流，用于批量导出
+type xExtServerStream[Resp any] struct {
+	grpc.ServerStream
+}
+
+func (s *xExtServerStream[Resp]) Send(v *Resp) error {
+	r, err := toExtStruct(v)
+	if err != nil {
+		return errInternal
+	}
+	return s.SendMsg(r)
+}
+
+func newExtServerStream[Req, Resp any](
+	name string, fn func(*Req, *xExtServerStream[Resp]) error) grpc.StreamDesc {
+	return grpc.StreamDesc{
+		StreamName:    name,
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			in := &structpb.Struct{}
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+			req := new(Req)
+			if err := fromExtStruct(in, req); err != nil {
+				return newInvalidArgumentError(err.Error())
+			}
+			return fn(req, &xExtServerStream[Resp]{stream})
+		},
+	}
+}
+
+// 客户端流，用于批量导入
+type xExtClientStream[Req any] struct {
+	grpc.ServerStream
+}
+
+func (s *xExtClientStream[Req]) Recv() (*Req, error) {
+	in := &structpb.Struct{}
+	if err := s.RecvMsg(in); err != nil {
+		return nil, err
+	}
+	req := new(Req)
+	if err := fromExtStruct(in, req); err != nil {
+		return nil, newInvalidArgumentError(err.Error())
+	}
+	return req, nil
+}
+
+func newExtClientStream[Req, Resp any](
+	name string, fn func(*xExtClientStream[Req]) (*Resp, error)) grpc.StreamDesc {
+	return grpc.StreamDesc{
+		StreamName:    name,
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			resp, err := fn(&xExtClientStream[Req]{stream})
+			if err != nil {
+				return err
+			}
+			r, err := toExtStruct(resp)
+			if err != nil {
+				return errInternal
+			}
+			return stream.SendMsg(r)
+		},
+	}
+}
+
+// 应用后台调用的接口，只接受应用密钥
+func requireExtApp(ctx context.Context) (appId string, err error) {
+	trusted := L.RequireAuthBySecret(ctx)
+	if trusted == nil {
+		return "", errUnauthenticated
+	}
+	return trusted.AppId, nil
+}
+
+// 用户相关的接口，用户使用令牌，应用后台使用密钥并指定用户
+func requireExtUser(
+	ctx context.Context, reqUserId string) (appId, userId string, err error) {
+	if trusted := L.RequireAuthByToken(ctx); trusted != nil {
+		return trusted.AppId, trusted.UserId, nil
+	} else if trusted := L.RequireAuthBySecret(ctx); trusted != nil {
+		if !db.IdBelongToAppId(trusted.AppId, reqUserId) {
+			return "", "", errUnauthenticated
+		}
+		return trusted.AppId, reqUserId, nil
+	}
+	return "", "", errLoginRequired
+}
+
+// 角色相关的接口，用户只能操作自己的角色，应用后台可以操作任意角色
+func requireExtRole(
+	ctx context.Context, roleId string) (appId string, err error) {
+	if trusted := L.RequireAuthByToken(ctx); trusted != nil {
+		roles, err := db.GetRoles(ctx, trusted.AppId, []string{roleId})
+		if err != nil {
+			return "", db.ErrDatabaseUnavailable
+		}
+		if len(roles) == 0 {
+			return "", db.ErrRoleNotFound
+		}
+		if roles[0].UserId != trusted.UserId {
+			return "", errUnauthenticated
+		}
+		return trusted.AppId, nil
+	} else if trusted := L.RequireAuthBySecret(ctx); trusted != nil {
+		return trusted.AppId, nil
+	}
+	return "", errLoginRequired
+}
+
+// 登录之前的接口，如注册和找回密码，与登录一样由请求指定应用，
+// 应用后台使用密钥代为调用时以密钥的应用为准
+func requireExtLoginApp(
+	ctx context.Context, reqAppId string) (_ *db.App, err error) {
+	appId := reqAppId
+	if trusted := L.RequireAuthBySecret(ctx); trusted != nil {
+		appId = trusted.AppId
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	return app, nil
+}
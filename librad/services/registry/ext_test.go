@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	L "github.com/ntons/libra-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func findExtMethod(t *testing.T, name string) func(
+	context.Context, map[string]interface{}) (*structpb.Struct, error) {
+	for _, m := range newExtServiceDesc().Methods {
+		if m.MethodName != name {
+			continue
+		}
+		return func(ctx context.Context, req map[string]interface{}) (
+			*structpb.Struct, error) {
+			in, err := structpb.NewStruct(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := m.Handler(nil, ctx, func(v interface{}) error {
+				proto.Merge(v.(*structpb.Struct), in)
+				return nil
+			}, nil)
+			if err != nil {
+				return nil, err
+			}
+			return r.(*structpb.Struct), nil
+		}
+	}
+	t.Fatalf("ext method not found: %s", name)
+	return nil
+}
+
+// 模拟auth服务注入的可信元数据
+func withTrustedApp(ctx context.Context, appId string) context.Context {
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(
+		L.XLibraTrustedAuthBy, L.XLibraAuthBySecret,
+		L.XLibraTrustedAppId, appId,
+	))
+}
+
+func TestExtStruct(t *testing.T) {
+	in, err := toExtStruct(&xListSanctionsRequest{
+		Kind:    "block",
+		Targets: []string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := in.Fields["kind"].GetStringValue(); v != "block" {
+		t.Fatalf("unexpected kind: %q", v)
+	}
+	out := &xListSanctionsRequest{}
+	if err = fromExtStruct(in, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Kind != "block" || len(out.Targets) != 2 || out.Targets[1] != "b" {
+		t.Fatalf("unexpected request: %+v", out)
+	}
+}
+
+func TestExtMethodAuth(t *testing.T) {
+	call := findExtMethod(t, "ListSanctions")
+	if _, err := call(context.Background(), map[string]interface{}{
+		"kind": "block",
+	}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expect unauthenticated, but got: %v", err)
+	}
+	ctx := withTrustedApp(context.Background(), "app")
+	if _, err := call(ctx, map[string]interface{}{
+		"kind": "unknown",
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect invalid argument, but got: %v", err)
+	}
+	if _, err := call(ctx, map[string]interface{}{
+		"kind": 1,
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect invalid argument, but got: %v", err)
+	}
+}
+
+type xFakeServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	in   []*structpb.Struct
+	sent []*structpb.Struct
+}
+
+func (s *xFakeServerStream) Context() context.Context { return s.ctx }
+
+func (s *xFakeServerStream) RecvMsg(m interface{}) error {
+	if len(s.in) == 0 {
+		return io.EOF
+	}
+	proto.Merge(m.(*structpb.Struct), s.in[0])
+	s.in = s.in[1:]
+	return nil
+}
+
+func (s *xFakeServerStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m.(*structpb.Struct))
+	return nil
+}
+
+func TestExtStreamAuth(t *testing.T) {
+	for _, name := range []string{"ExportBlocks", "ImportBlocks"} {
+		var found bool
+		for _, d := range newExtServiceDesc().Streams {
+			if d.StreamName != name {
+				continue
+			}
+			found = true
+			stream := &xFakeServerStream{
+				ctx: context.Background(),
+				in:  []*structpb.Struct{{}},
+			}
+			if err := d.Handler(nil, stream); status.Code(err) !=
+				codes.Unauthenticated {
+				t.Errorf("%s: expect unauthenticated, but got: %v", name, err)
+			}
+			if len(stream.sent) > 0 {
+				t.Errorf("%s: unexpected response", name)
+			}
+		}
+		if !found {
+			t.Errorf("ext stream not found: %s", name)
+		}
+	}
+}
+
+func TestExtRoleAuth(t *testing.T) {
+	for _, name := range []string{
+		"DeleteRole", "RestoreRole", "ReserveRoleName", "ReleaseRoleName",
+	} {
+		call := findExtMethod(t, name)
+		if _, err := call(context.Background(), map[string]interface{}{
+			"role_id": "role",
+		}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s: expect unauthenticated, but got: %v", name, err)
+		}
+	}
+}
+
+func TestExtAppAuth(t *testing.T) {
+	for _, name := range []string{
+		"TransferRole", "ListRoleTransfers",
+		"SetZone", "DeleteZone", "ListZones",
+		"QueryUsersByMetadata", "QueryRolesByMetadata",
+		"SetSessionAttributes",
+		"GetUserPresence", "GetRolePresence", "CountOnline", "ListCcuSamples",
+		"GetMaintenance", "SetMaintenance",
+		"ListDeviceUsers", "SetDevicePolicy",
+		"GetRegionPolicy", "SetRegionPolicy", "CountUsersByCountry",
+		"GetHooks", "SetHooks",
+		"GetClientVersionRules", "SetClientVersionRules",
+	} {
+		call := findExtMethod(t, name)
+		if _, err := call(context.Background(), map[string]interface{}{
+			"role_id": "role",
+		}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s: expect unauthenticated, but got: %v", name, err)
+		}
+	}
+}
+
+func TestExtUserAuth(t *testing.T) {
+	for _, name := range []string{
+		"ListUserZones", "UpdateUserMetadata",
+		"IssueTransferCode", "RedeemTransferCode",
+		"ListPublisherLinkedApps", "SetPublisherLinkConsent",
+		"ListUserDevices",
+	} {
+		call := findExtMethod(t, name)
+		if _, err := call(context.Background(), map[string]interface{}{
+			"user_id": "user",
+		}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s: expect unauthenticated, but got: %v", name, err)
+		}
+	}
+}
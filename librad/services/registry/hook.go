@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"context"
+
+	log "github.com/ntons/log-go"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 生命周期钩子由应用后台配置，整体替换，回调地址必须在配置的白名单中
+
+func init() {
+	registerExtMethods(
+		newExtMethod("GetHooks", getHooks),
+		newExtMethod("SetHooks", setHooks),
+	)
+}
+
+type xHookData struct {
+	Event    string `json:"event"`
+	Phase    string `json:"phase"`
+	Url      string `json:"url"`
+	Timeout  int64  `json:"timeout,omitempty"`
+	Retries  int    `json:"retries,omitempty"`
+	FailOpen bool   `json:"fail_open,omitempty"`
+}
+
+type xHooksResponse struct {
+	Hooks []*xHookData `json:"hooks"`
+}
+
+func getHooks(
+	ctx context.Context, req *xEmpty) (_ *xHooksResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	resp := &xHooksResponse{}
+	for _, h := range app.Hooks {
+		resp.Hooks = append(resp.Hooks, &xHookData{
+			Event:    h.Event,
+			Phase:    h.Phase,
+			Url:      h.Url,
+			Timeout:  h.Timeout,
+			Retries:  h.Retries,
+			FailOpen: h.FailOpen,
+		})
+	}
+	return resp, nil
+}
+
+type xSetHooksRequest struct {
+	// 为空时清除所有钩子
+	Hooks []*xHookData `json:"hooks"`
+}
+
+func setHooks(
+	ctx context.Context, req *xSetHooksRequest) (_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	hooks := make([]*db.Hook, 0, len(req.Hooks))
+	for _, x := range req.Hooks {
+		if x == nil {
+			return nil, newInvalidArgumentError("hook required")
+		}
+		hooks = append(hooks, &db.Hook{
+			Event:    x.Event,
+			Phase:    x.Phase,
+			Url:      x.Url,
+			Timeout:  x.Timeout,
+			Retries:  x.Retries,
+			FailOpen: x.FailOpen,
+		})
+	}
+	if err = db.SetAppHooks(ctx, appId, hooks); err != nil {
+		return
+	}
+	log.Infow("hooks updated",
+		"app_id", appId,
+		"by", getTrustedAdminId(ctx),
+		"hooks", len(hooks),
+	)
+	return &xEmpty{}, nil
+}
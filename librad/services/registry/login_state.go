@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 登录态验证
+// 按照Any的类型选择验证器，验证通过后统一转换为UniformLoginState。
+
+type LoginStateVerifier func(
+	ctx context.Context, app *db.App, state *anypb.Any) (
+	*v1pb.UniformLoginState, error)
+
+var (
+	xLoginStateVerifiersMu sync.RWMutex
+	xLoginStateVerifiers   = make(map[string]LoginStateVerifier)
+)
+
+// 注册登录态验证器，name为消息全名，即Any的TypeUrl最后一个"/"之后的部分
+func RegisterLoginStateVerifier(name string, fn LoginStateVerifier) {
+	xLoginStateVerifiersMu.Lock()
+	defer xLoginStateVerifiersMu.Unlock()
+	xLoginStateVerifiers[name] = fn
+}
+
+func getLoginStateVerifier(state *anypb.Any) LoginStateVerifier {
+	name := state.GetTypeUrl()
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	xLoginStateVerifiersMu.RLock()
+	defer xLoginStateVerifiersMu.RUnlock()
+	return xLoginStateVerifiers[name]
+}
+
+// 按线格式解码只有字符串字段的登录态，libra-go中尚未生成的消息使用
+func unmarshalStringFields(
+	b []byte, fields map[protowire.Number]*string) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if p, ok := fields[num]; ok && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*p = v
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func init() {
+	RegisterLoginStateVerifier(
+		string(proto.MessageName(&v1pb.UniformLoginState{})),
+		func(ctx context.Context, app *db.App, anyState *anypb.Any) (
+			_ *v1pb.UniformLoginState, err error) {
+			state := &v1pb.UniformLoginState{}
+			if err = anyState.UnmarshalTo(state); err != nil {
+				return nil, errInvalidState
+			}
+			return checkUniformLoginState(ctx, app, state)
+		},
+	)
+}
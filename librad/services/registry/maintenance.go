@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	log "github.com/ntons/log-go"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 维护模式由应用后台开启和关闭
+
+func init() {
+	registerExtMethods(
+		newExtMethod("GetMaintenance", getMaintenance),
+		newExtMethod("SetMaintenance", setMaintenance),
+	)
+}
+
+type xMaintenanceData struct {
+	StartAt      int64    `json:"start_at,omitempty"`
+	EndAt        int64    `json:"end_at,omitempty"`
+	Message      string   `json:"message,omitempty"`
+	RoleIndexes  []uint32 `json:"role_indexes,omitempty"`
+	AllowUserIds []string `json:"allow_user_ids,omitempty"`
+	AllowIps     []string `json:"allow_ips,omitempty"`
+}
+
+func fromDbMaintenance(x *db.Maintenance) *xMaintenanceData {
+	if x == nil {
+		return nil
+	}
+	r := &xMaintenanceData{
+		Message:      x.Message,
+		RoleIndexes:  x.RoleIndexes,
+		AllowUserIds: x.AllowUserIds,
+		AllowIps:     x.AllowIps,
+	}
+	if !x.StartAt.IsZero() {
+		r.StartAt = x.StartAt.Unix()
+	}
+	if !x.EndAt.IsZero() {
+		r.EndAt = x.EndAt.Unix()
+	}
+	return r
+}
+
+func toDbMaintenance(x *xMaintenanceData) *db.Maintenance {
+	if x == nil {
+		return nil
+	}
+	r := &db.Maintenance{
+		Message:      x.Message,
+		RoleIndexes:  x.RoleIndexes,
+		AllowUserIds: x.AllowUserIds,
+		AllowIps:     x.AllowIps,
+	}
+	if x.StartAt > 0 {
+		r.StartAt = time.Unix(x.StartAt, 0)
+	}
+	if x.EndAt > 0 {
+		r.EndAt = time.Unix(x.EndAt, 0)
+	}
+	return r
+}
+
+type xGetMaintenanceResponse struct {
+	// 没有维护时为空
+	Maintenance *xMaintenanceData `json:"maintenance,omitempty"`
+	// 维护是否正在生效
+	Active bool `json:"active,omitempty"`
+}
+
+func getMaintenance(
+	ctx context.Context, req *xEmpty) (_ *xGetMaintenanceResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	resp := &xGetMaintenanceResponse{
+		Maintenance: fromDbMaintenance(app.Maintenance),
+	}
+	if app.Maintenance != nil {
+		resp.Active = app.Maintenance.IsActive(time.Now())
+	}
+	return resp, nil
+}
+
+type xSetMaintenanceRequest struct {
+	// 为空时关闭维护
+	Maintenance *xMaintenanceData `json:"maintenance,omitempty"`
+	// 维护已经开始时踢出受影响的在线会话
+	Kick bool `json:"kick,omitempty"`
+}
+
+type xSetMaintenanceResponse struct {
+	Kicked int `json:"kicked"`
+}
+
+// 开启、修改或关闭维护
+func setMaintenance(
+	ctx context.Context, req *xSetMaintenanceRequest) (
+	_ *xSetMaintenanceResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	n, err := db.SetAppMaintenance(
+		ctx, appId, toDbMaintenance(req.Maintenance), req.Kick)
+	if err != nil {
+		return
+	}
+	log.Infow("maintenance updated",
+		"app_id", appId,
+		"by", getTrustedAdminId(ctx),
+		"on", req.Maintenance != nil,
+		"kicked", n,
+	)
+	return &xSetMaintenanceResponse{Kicked: n}, nil
+}
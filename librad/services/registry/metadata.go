@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 元数据查询和条件更新
+// 查询只能按照应用声明的索引键，libra-go的User.Query只支持账号详情，
+// 元数据条件和游标通过扩展接口提供。SetMetadata只能直接覆盖，
+// 带期望值和增量的更新通过扩展接口提供。
+
+func init() {
+	registerExtMethods(
+		newExtMethod("QueryUsersByMetadata", queryUsersByMetadata),
+		newExtMethod("QueryRolesByMetadata", queryRolesByMetadata),
+		newExtMethod("UpdateUserMetadata", updateUserMetadata),
+		newExtMethod("UpdateRoleMetadata", updateRoleMetadata),
+	)
+}
+
+type xUserData struct {
+	Id       string            `json:"id"`
+	AcctIds  []string          `json:"acct_ids,omitempty"`
+	CreateAt int64             `json:"create_at"`
+	LoginAt  int64             `json:"login_at,omitempty"`
+	LoginIp  string            `json:"login_ip,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	BanAt    int64             `json:"ban_at,omitempty"`
+	BanTo    int64             `json:"ban_to,omitempty"`
+	BanFor   string            `json:"ban_for,omitempty"`
+}
+
+func fromDbUserData(x *db.User) *xUserData {
+	r := &xUserData{
+		Id:       x.Id,
+		AcctIds:  x.AcctIds,
+		CreateAt: x.CreateAt.Unix(),
+		LoginIp:  x.LoginIp,
+		Metadata: x.Metadata,
+	}
+	if !x.LoginAt.IsZero() {
+		r.LoginAt = x.LoginAt.Unix()
+	}
+	if x.BanTo.After(time.Now()) {
+		r.BanAt = x.BanAt.Unix()
+		r.BanTo = x.BanTo.Unix()
+		r.BanFor = x.BanFor
+	}
+	return r
+}
+
+// Eq、Prefix、范围三选一，范围为左闭右开区间，
+// 值都是字符串，范围按字节序比较，数值需要补齐到相同长度
+type xMetadataFilter struct {
+	Key    string `json:"key"`
+	Eq     string `json:"eq,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Min    string `json:"min,omitempty"`
+	Max    string `json:"max,omitempty"`
+}
+
+func (x *xMetadataFilter) toDb() *db.MetadataFilter {
+	if x == nil {
+		return nil
+	}
+	return &db.MetadataFilter{
+		Key:    x.Key,
+		Eq:     x.Eq,
+		Prefix: x.Prefix,
+		Min:    x.Min,
+		Max:    x.Max,
+	}
+}
+
+type xQueryByMetadataRequest struct {
+	Filter *xMetadataFilter `json:"filter"`
+	// 上一页返回的next
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type xQueryUsersByMetadataResponse struct {
+	Users []*xUserData `json:"users"`
+	// 为空表示没有更多了
+	Next string `json:"next,omitempty"`
+}
+
+func queryUsersByMetadata(
+	ctx context.Context, req *xQueryByMetadataRequest) (
+	_ *xQueryUsersByMetadataResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	users, next, err := db.QueryUsersByMetadata(
+		ctx, appId, req.Filter.toDb(), req.Cursor, req.Limit)
+	if err != nil {
+		return
+	}
+	resp := &xQueryUsersByMetadataResponse{Next: next}
+	for _, x := range users {
+		resp.Users = append(resp.Users, fromDbUserData(x))
+	}
+	return resp, nil
+}
+
+type xQueryRolesByMetadataResponse struct {
+	Roles []*xRoleData `json:"roles"`
+	Next  string       `json:"next,omitempty"`
+}
+
+// 不包括已删除的角色
+func queryRolesByMetadata(
+	ctx context.Context, req *xQueryByMetadataRequest) (
+	_ *xQueryRolesByMetadataResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	roles, next, err := db.QueryRolesByMetadata(
+		ctx, appId, req.Filter.toDb(), req.Cursor, req.Limit)
+	if err != nil {
+		return
+	}
+	resp := &xQueryRolesByMetadataResponse{Next: next}
+	for _, x := range roles {
+		resp.Roles = append(resp.Roles, fromDbRoleData(x))
+	}
+	return resp, nil
+}
+
+type xMetadataOp struct {
+	Key string `json:"key"`
+	// 期望的当前值，不给时不检查，空串要求键不存在
+	Expect *string `json:"expect,omitempty"`
+	// 新值，为空时删除
+	Value string `json:"value,omitempty"`
+	// 数值增量，非0时忽略value
+	Incr int64 `json:"incr,omitempty"`
+}
+
+func toDbMetadataOps(a []*xMetadataOp) (_ []*db.MetadataOp, err error) {
+	if len(a) == 0 {
+		return nil, newInvalidArgumentError("metadata ops required")
+	}
+	r := make([]*db.MetadataOp, 0, len(a))
+	for _, x := range a {
+		if x == nil {
+			return nil, errInvalidMetadata
+		}
+		if len(x.Key)+len(x.Value) > 1024 {
+			return nil, errMetadataTooLarge
+		}
+		r = append(r, &db.MetadataOp{
+			Key:    x.Key,
+			Expect: x.Expect,
+			Value:  x.Value,
+			Incr:   x.Incr,
+		})
+	}
+	return r, nil
+}
+
+type xUpdateUserMetadataRequest struct {
+	// 使用应用密钥时指定
+	UserId string         `json:"user_id,omitempty"`
+	Ops    []*xMetadataOp `json:"ops"`
+}
+
+type xUpdateMetadataResponse struct {
+	// 更新后的全部元数据
+	Metadata map[string]string `json:"metadata"`
+}
+
+// 原子地执行一组操作，任意一个期望值不符时都不会写入
+func updateUserMetadata(
+	ctx context.Context, req *xUpdateUserMetadataRequest) (
+	_ *xUpdateMetadataResponse, err error) {
+	appId, userId, err := requireExtUser(ctx, req.UserId)
+	if err != nil {
+		return
+	}
+	ops, err := toDbMetadataOps(req.Ops)
+	if err != nil {
+		return
+	}
+	md, err := db.UpdateUserMetadata(ctx, appId, userId, ops)
+	if err != nil {
+		return
+	}
+	return &xUpdateMetadataResponse{Metadata: md}, nil
+}
+
+type xUpdateRoleMetadataRequest struct {
+	RoleId string         `json:"role_id"`
+	Ops    []*xMetadataOp `json:"ops"`
+}
+
+func updateRoleMetadata(
+	ctx context.Context, req *xUpdateRoleMetadataRequest) (
+	_ *xUpdateMetadataResponse, err error) {
+	appId, err := requireExtRole(ctx, req.RoleId)
+	if err != nil {
+		return
+	}
+	ops, err := toDbMetadataOps(req.Ops)
+	if err != nil {
+		return
+	}
+	md, err := db.UpdateRoleMetadata(ctx, appId, req.RoleId, ops)
+	if err != nil {
+		return
+	}
+	return &xUpdateMetadataResponse{Metadata: md}, nil
+}
@@ -0,0 +1,38 @@
+package registry
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMetadataOps(t *testing.T) {
+	in, err := structpb.NewStruct(map[string]interface{}{
+		"role_id": "role",
+		"ops": []interface{}{
+			map[string]interface{}{"key": "a", "expect": "", "value": "1"},
+			map[string]interface{}{"key": "b", "incr": 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &xUpdateRoleMetadataRequest{}
+	if err = fromExtStruct(in, req); err != nil {
+		t.Fatal(err)
+	}
+	ops, err := toDbMetadataOps(req.Ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 空串的期望值要求键不存在，不能和不检查混淆
+	if ops[0].Expect == nil || *ops[0].Expect != "" {
+		t.Fatalf("unexpected expect: %v", ops[0].Expect)
+	}
+	if ops[1].Expect != nil || ops[1].Incr != 2 {
+		t.Fatalf("unexpected op: %+v", ops[1])
+	}
+	if _, err = toDbMetadataOps(nil); err == nil {
+		t.Fatalf("expect error on empty ops")
+	}
+}
@@ -21,6 +21,12 @@ type module struct {
 func (module) Name() string { return "registry" }
 
 func (m *module) Initialize(jb json.RawMessage) (err error) {
+	if err = loadConfig(jb); err != nil {
+		return
+	}
+	if cfg.Email.Outbox != "" {
+		SetEmailSender(newFileEmailSender(cfg.Email.Outbox))
+	}
 	var (
 		appAdmin = newAppServer()
 		user     = newUserServer()
@@ -29,5 +35,6 @@ func (m *module) Initialize(jb json.RawMessage) (err error) {
 	sm.RegisterGrpcService(&admv1pb.AppAdmin_ServiceDesc, appAdmin)
 	sm.RegisterGrpcService(&v1pb.User_ServiceDesc, user)
 	sm.RegisterGrpcService(&v1pb.Role_ServiceDesc, role)
+	sm.RegisterGrpcService(newExtServiceDesc(), &struct{}{})
 	return
 }
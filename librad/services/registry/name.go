@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"context"
+
+	L "github.com/ntons/libra-go"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 角色名
+
+func init() {
+	registerExtMethods(
+		newExtMethod("ReserveRoleName", reserveRoleName),
+		newExtMethod("ReleaseRoleName", releaseRoleName),
+		newExtMethod("LookupRoleName", lookupRoleName),
+	)
+}
+
+type xReserveRoleNameRequest struct {
+	RoleId string `json:"role_id"`
+	Name   string `json:"name"`
+}
+
+// 占用名字，角色已有名字时视为改名
+func reserveRoleName(
+	ctx context.Context, req *xReserveRoleNameRequest) (
+	_ *xEmpty, err error) {
+	appId, err := requireExtRole(ctx, req.RoleId)
+	if err != nil {
+		return
+	}
+	if err = db.ReserveRoleName(ctx, appId, req.RoleId, req.Name); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+// 释放角色名，释放后在冷却期内不能被其他角色占用
+func releaseRoleName(
+	ctx context.Context, req *xRoleRequest) (_ *xEmpty, err error) {
+	appId, err := requireExtRole(ctx, req.RoleId)
+	if err != nil {
+		return
+	}
+	if err = db.ReleaseRoleName(ctx, appId, req.RoleId); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xLookupRoleNameRequest struct {
+	// 未开启分区命名时忽略
+	Zone uint32 `json:"zone,omitempty"`
+	Name string `json:"name"`
+}
+
+type xLookupRoleNameResponse struct {
+	RoleId string `json:"role_id"`
+}
+
+func lookupRoleName(
+	ctx context.Context, req *xLookupRoleNameRequest) (
+	_ *xLookupRoleNameResponse, err error) {
+	var appId string
+	if trusted := L.RequireAuthByToken(ctx); trusted != nil {
+		appId = trusted.AppId
+	} else if trusted := L.RequireAuthBySecret(ctx); trusted != nil {
+		appId = trusted.AppId
+	} else {
+		return nil, errLoginRequired
+	}
+	roleId, err := db.LookupRoleName(ctx, appId, req.Zone, req.Name)
+	if err != nil {
+		return
+	}
+	return &xLookupRoleNameResponse{RoleId: roleId}, nil
+}
@@ -0,0 +1,441 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	log "github.com/ntons/log-go"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// OIDC登录
+// 客户端直接提交身份提供方签发的id_token，使用提供方的公钥集合(JWKS)验证，
+// sub加上提供方前缀作为账号ID。
+//
+// 登录态消息定义如下，libra-go中尚未生成，这里直接按线格式解码：
+//
+//	message OidcLoginState {
+//	  string provider = 1;
+//	  string id_token = 2;
+//	}
+const oidcLoginStateName = "libra.v1.OidcLoginState"
+
+const (
+	// 公钥集合缓存时长
+	oidcJwksTTL = time.Hour
+	// 遇到未知kid时强制刷新的最小间隔
+	oidcJwksMinRefresh = time.Minute
+	// 容忍的系统时间误差
+	oidcClockSkew = time.Minute
+)
+
+type oidcLoginState struct {
+	Provider string
+	IdToken  string
+}
+
+func (x *oidcLoginState) unmarshal(b []byte) error {
+	return unmarshalStringFields(b, map[protowire.Number]*string{
+		1: &x.Provider,
+		2: &x.IdToken,
+	})
+}
+
+type oidcClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	IssuedAt  int64           `json:"iat"`
+	NotBefore int64           `json:"nbf"`
+	Email     string          `json:"email"`
+}
+
+// aud可以是字符串或字符串数组
+func (x *oidcClaims) audiences() []string {
+	var s string
+	if err := json.Unmarshal(x.Audience, &s); err == nil {
+		return []string{s}
+	}
+	var a []string
+	json.Unmarshal(x.Audience, &a)
+	return a
+}
+
+type xJwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (x *xJwk) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch x.Kty {
+	case "RSA":
+		n, err := dec(x.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(x.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if x.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve: %s", x.Crv)
+		}
+		bx, err := dec(x.X)
+		if err != nil {
+			return nil, err
+		}
+		by, err := dec(x.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(bx),
+			Y:     new(big.Int).SetBytes(by),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("invalid ec point")
+		}
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", x.Kty)
+	}
+}
+
+// kid -> 公钥
+type xJwks map[string]crypto.PublicKey
+
+func parseJwks(b []byte) (_ xJwks, err error) {
+	var doc struct {
+		Keys []*xJwk `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return
+	}
+	keys := make(xJwks)
+	for _, k := range doc.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Warnf("skip malformed jwk: %v, %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+type xJwksCacheEntry struct {
+	keys    xJwks
+	fetchAt time.Time
+	// 上次尝试拉取的时间，拉取失败时也会更新，避免频繁重试
+	tryAt time.Time
+}
+
+// 内联公钥集合的解析缓存上限，配置变化后旧的解析结果会残留
+const maxInlineJwksCache = 64
+
+// 按地址缓存的公钥集合
+// 拉取在锁外进行，同一地址的并发拉取合并为一次
+type xJwksCache struct {
+	mu      sync.Mutex
+	entries map[string]*xJwksCacheEntry
+	// 内联公钥集合 -> 解析结果
+	inline map[string]xJwks
+	sf     singleflight.Group
+	client *http.Client
+}
+
+func newJwksCache() *xJwksCache {
+	return &xJwksCache{
+		entries: make(map[string]*xJwksCacheEntry),
+		inline:  make(map[string]xJwks),
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+var jwksCache = newJwksCache()
+
+func (c *xJwksCache) fetch(ctx context.Context, url string) (_ xJwks, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return
+	}
+	return parseJwks(b)
+}
+
+// 拉取并更新缓存，失败时保留旧的公钥
+func (c *xJwksCache) refresh(url string) (xJwks, error) {
+	// 合并的拉取不能因为其中一个请求取消而失败，超时由client控制
+	keys, err := c.fetch(context.Background(), url)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	if err != nil {
+		if !ok {
+			return nil, err
+		}
+		log.Warnf("failed to refresh jwks: %v, %v", url, err)
+		e.tryAt = now
+		return e.keys, nil
+	}
+	c.entries[url] = &xJwksCacheEntry{keys: keys, fetchAt: now, tryAt: now}
+	return keys, nil
+}
+
+// 获取公钥，缓存过期或找不到kid时重新拉取
+func (c *xJwksCache) get(
+	ctx context.Context, url, kid string) (_ crypto.PublicKey, err error) {
+	c.mu.Lock()
+	now := time.Now()
+	e, ok := c.entries[url]
+	if ok {
+		pub, found := e.keys[kid]
+		fresh := now.Sub(e.fetchAt) < oidcJwksTTL
+		if found && fresh {
+			c.mu.Unlock()
+			return pub, nil
+		}
+		if now.Sub(e.tryAt) < oidcJwksMinRefresh {
+			c.mu.Unlock()
+			if found {
+				return pub, nil
+			}
+			return nil, fmt.Errorf("unknown kid: %s", kid)
+		}
+	}
+	c.mu.Unlock()
+
+	ch := c.sf.DoChan(url, func() (interface{}, error) {
+		return c.refresh(url)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		if pub, ok := r.Val.(xJwks)[kid]; ok {
+			return pub, nil
+		}
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+}
+
+// 解析内联的公钥集合，按内容缓存
+func (c *xJwksCache) getInline(
+	jwks, kid string) (_ crypto.PublicKey, err error) {
+	c.mu.Lock()
+	keys, ok := c.inline[jwks]
+	c.mu.Unlock()
+	if !ok {
+		if keys, err = parseJwks([]byte(jwks)); err != nil {
+			return
+		}
+		c.mu.Lock()
+		if len(c.inline) >= maxInlineJwksCache {
+			c.inline = make(map[string]xJwks)
+		}
+		c.inline[jwks] = keys
+		c.mu.Unlock()
+	}
+	if pub, ok := keys[kid]; ok {
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unknown kid: %s", kid)
+}
+
+func getOidcPublicKey(
+	ctx context.Context, p *db.OidcProvider, kid string) (
+	crypto.PublicKey, error) {
+	if p.Jwks != "" {
+		return jwksCache.getInline(p.Jwks, kid)
+	}
+	if p.JwksUrl != "" {
+		return jwksCache.get(ctx, p.JwksUrl, kid)
+	}
+	return nil, fmt.Errorf("no jwks configured")
+}
+
+func verifyJwtSignature(alg string, pub crypto.PublicKey, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		pub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type mismatch")
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	case "ES256":
+		pub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type mismatch")
+		}
+		if len(sig) != 64 {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported alg: %s", alg)
+	}
+}
+
+// 验证id_token，返回其中的声明
+func verifyIdToken(
+	ctx context.Context, p *db.OidcProvider, token string, now time.Time) (
+	_ *oidcClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	dec := base64.RawURLEncoding.DecodeString
+	hb, err := dec(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = json.Unmarshal(hb, &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	sig, err := dec(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	pub, err := getOidcPublicKey(ctx, p, header.Kid)
+	if err != nil {
+		return
+	}
+	if err = verifyJwtSignature(
+		header.Alg, pub, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return
+	}
+	cb, err := dec(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	claims := &oidcClaims{}
+	if err = json.Unmarshal(cb, claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", claims.Issuer)
+	}
+	if !containsAny(p.Audiences, claims.audiences()) {
+		return nil, fmt.Errorf("audience mismatch")
+	}
+	ts := now.Unix()
+	skew := int64(oidcClockSkew / time.Second)
+	if claims.ExpiresAt == 0 || claims.ExpiresAt < ts-skew {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore > ts+skew || claims.IssuedAt > ts+skew {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("missing subject")
+	}
+	return claims, nil
+}
+
+func containsAny(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getOidcAcctId(p *db.OidcProvider, sub string) string {
+	prefix := p.AcctIdPrefix
+	if prefix == "" {
+		prefix = p.Name
+	}
+	return prefix + ":" + sub
+}
+
+func verifyOidcLoginState(
+	ctx context.Context, app *db.App, anyState *anypb.Any) (
+	_ *v1pb.UniformLoginState, err error) {
+	state := &oidcLoginState{}
+	if err = state.unmarshal(anyState.GetValue()); err != nil {
+		return nil, errInvalidState
+	}
+	p := app.FindOidcProvider(state.Provider)
+	if p == nil {
+		return nil, errInvalidState
+	}
+	claims, err := verifyIdToken(ctx, p, state.IdToken, time.Now())
+	if err != nil {
+		log.Warnf("failed to verify id token: %v, %v, %v",
+			app.Id, p.Name, err)
+		return nil, errInvalidIdToken
+	}
+	acctId := getOidcAcctId(p, claims.Subject)
+	r := &v1pb.UniformLoginState{AcctIds: []string{acctId}}
+	if claims.Email != "" {
+		b, _ := json.Marshal(map[string]string{"email": claims.Email})
+		r.AcctDetails = map[string]string{acctId: string(b)}
+	}
+	return r, nil
+}
+
+func init() {
+	RegisterLoginStateVerifier(oidcLoginStateName, verifyOidcLoginState)
+}
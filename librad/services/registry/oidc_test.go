@@ -0,0 +1,249 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+var b64 = base64.RawURLEncoding.EncodeToString
+
+func signTestJwt(
+	t *testing.T, alg, kid string, key crypto.Signer,
+	claims map[string]interface{}) string {
+	hb, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	cb, _ := json.Marshal(claims)
+	signed := b64(hb) + "." + b64(cb)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(
+			rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func testJwks(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa1",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec1",
+				"crv": "P-256",
+				"x":   b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+	return string(b)
+}
+
+func TestVerifyIdToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := testJwks(rsaKey, ecKey)
+
+	var fetched int
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fetched++
+			w.Write([]byte(jwks))
+		}))
+	defer srv.Close()
+
+	now := time.Now()
+	claims := func(m map[string]interface{}) map[string]interface{} {
+		r := map[string]interface{}{
+			"iss": "https://idp.example.com",
+			"aud": "client-1",
+			"sub": "u123",
+			"iat": now.Unix(),
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range m {
+			r[k] = v
+		}
+		return r
+	}
+	byUrl := &db.OidcProvider{
+		Name:      "idp",
+		Issuer:    "https://idp.example.com",
+		Audiences: []string{"client-1"},
+		JwksUrl:   srv.URL,
+	}
+	inline := &db.OidcProvider{
+		Name:      "idp",
+		Issuer:    "https://idp.example.com",
+		Audiences: []string{"client-0", "client-1"},
+		Jwks:      jwks,
+	}
+
+	for _, c := range []struct {
+		name  string
+		p     *db.OidcProvider
+		token string
+		ok    bool
+	}{
+		{"rs256 by url", byUrl,
+			signTestJwt(t, "RS256", "rsa1", rsaKey, claims(nil)), true},
+		{"es256 inline", inline,
+			signTestJwt(t, "ES256", "ec1", ecKey, claims(nil)), true},
+		{"aud array", inline,
+			signTestJwt(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{
+				"aud": []string{"x", "client-1"}})), true},
+		{"wrong aud", inline,
+			signTestJwt(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{
+				"aud": "client-2"})), false},
+		{"wrong iss", inline,
+			signTestJwt(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{
+				"iss": "https://evil.example.com"})), false},
+		{"expired", inline,
+			signTestJwt(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{
+				"exp": now.Add(-time.Hour).Unix()})), false},
+		{"no sub", inline,
+			signTestJwt(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{
+				"sub": ""})), false},
+		{"wrong key", inline,
+			signTestJwt(t, "RS256", "rsa1", otherKey, claims(nil)), false},
+		{"alg mismatch", inline,
+			signTestJwt(t, "ES256", "rsa1", ecKey, claims(nil)), false},
+		{"unknown kid", byUrl,
+			signTestJwt(t, "RS256", "rsa2", rsaKey, claims(nil)), false},
+		{"malformed", inline, "a.b", false},
+	} {
+		_, err := verifyIdToken(context.Background(), c.p, c.token, now)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: unexpected result: %v", c.name, err)
+		}
+	}
+	// 缓存有效期内未知kid也不会频繁拉取
+	if fetched != 1 {
+		t.Errorf("unexpected jwks fetch count: %d", fetched)
+	}
+}
+
+func TestOidcLoginStateUnmarshal(t *testing.T) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "idp")
+	b = protowire.AppendTag(b, 9, protowire.VarintType)
+	b = protowire.AppendVarint(b, 42)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, "a.b.c")
+	x := &oidcLoginState{}
+	if err := x.unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if x.Provider != "idp" || x.IdToken != "a.b.c" {
+		t.Fatalf("unexpected state: %+v", x)
+	}
+	if err := x.unmarshal(b[:len(b)-1]); err == nil {
+		t.Fatal("expect error on truncated input")
+	}
+	p := &db.OidcProvider{Name: "idp"}
+	if s := getOidcAcctId(p, "u1"); s != "idp:u1" {
+		t.Fatalf("unexpected acct id: %s", s)
+	}
+}
+
+func TestJwksCacheConcurrentFetch(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := testJwks(rsaKey, ecKey)
+
+	var fetched int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetched, 1)
+			<-release
+			w.Write([]byte(jwks))
+		}))
+	defer srv.Close()
+
+	c := newJwksCache()
+
+	// 拉取期间其他请求不会被锁阻塞，取消的请求立即返回
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.get(ctx, srv.URL, "rsa1"); err != context.Canceled {
+		t.Fatalf("expect canceled, but got: %v", err)
+	}
+	if _, err := c.getInline(jwks, "ec1"); err != nil {
+		t.Fatalf("failed to get inline jwk: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.get(context.Background(), srv.URL, "rsa1")
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to get jwk: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Fatalf("unexpected jwks fetch count: %d", n)
+	}
+}
@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 在线状态和在线人数由应用后台查询
+
+func init() {
+	registerExtMethods(
+		newExtMethod("GetUserPresence", getUserPresence),
+		newExtMethod("GetRolePresence", getRolePresence),
+		newExtMethod("CountOnline", countOnline),
+		newExtMethod("ListCcuSamples", listCcuSamples),
+	)
+}
+
+const (
+	// 单次查询的最大数量
+	maxPresenceQuerySize = 1000
+	// 单次查询采样的最大时间范围
+	maxCcuSampleRange = 31 * 24 * 60 * 60
+)
+
+type xPresenceData struct {
+	Id       string `json:"id"`
+	Online   bool   `json:"online,omitempty"`
+	LastSeen int64  `json:"last_seen,omitempty"`
+}
+
+func fromDbPresence(x *db.Presence) *xPresenceData {
+	r := &xPresenceData{Id: x.Id, Online: x.Online}
+	if !x.LastSeen.IsZero() {
+		r.LastSeen = x.LastSeen.Unix()
+	}
+	return r
+}
+
+type xCcuSampleData struct {
+	Time    int64            `json:"time"`
+	Users   int64            `json:"users"`
+	Roles   int64            `json:"roles"`
+	Indexes map[string]int64 `json:"indexes,omitempty"`
+}
+
+func fromDbCcuSample(x *db.CcuSample) *xCcuSampleData {
+	return &xCcuSampleData{
+		Time:    x.Time.Unix(),
+		Users:   x.Users,
+		Roles:   x.Roles,
+		Indexes: x.Indexes,
+	}
+}
+
+type xGetPresenceRequest struct {
+	Ids []string `json:"ids"`
+}
+
+type xGetPresenceResponse struct {
+	Presences []*xPresenceData `json:"presences"`
+}
+
+func getPresence(
+	ctx context.Context, req *xGetPresenceRequest,
+	get func(context.Context, string, []string) ([]*db.Presence, error)) (
+	_ *xGetPresenceResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if len(req.Ids) > maxPresenceQuerySize {
+		return nil, newInvalidArgumentError("too many ids")
+	}
+	presences, err := get(ctx, appId, req.Ids)
+	if err != nil {
+		return
+	}
+	resp := &xGetPresenceResponse{}
+	for _, x := range presences {
+		resp.Presences = append(resp.Presences, fromDbPresence(x))
+	}
+	return resp, nil
+}
+
+// 批量查询用户的在线状态
+func getUserPresence(
+	ctx context.Context, req *xGetPresenceRequest) (
+	*xGetPresenceResponse, error) {
+	return getPresence(ctx, req, db.GetUserPresence)
+}
+
+// 批量查询角色的在线状态
+func getRolePresence(
+	ctx context.Context, req *xGetPresenceRequest) (
+	*xGetPresenceResponse, error) {
+	return getPresence(ctx, req, db.GetRolePresence)
+}
+
+type xCountOnlineResponse struct {
+	Sample *xCcuSampleData `json:"sample"`
+}
+
+// 当前在线人数
+func countOnline(
+	ctx context.Context, req *xEmpty) (_ *xCountOnlineResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	x, err := db.CountOnline(ctx, appId)
+	if err != nil {
+		return
+	}
+	return &xCountOnlineResponse{Sample: fromDbCcuSample(x)}, nil
+}
+
+type xListCcuSamplesRequest struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+type xListCcuSamplesResponse struct {
+	Samples []*xCcuSampleData `json:"samples"`
+}
+
+// 时间范围内的在线人数采样
+func listCcuSamples(
+	ctx context.Context, req *xListCcuSamplesRequest) (
+	_ *xListCcuSamplesResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if req.From <= 0 || req.To <= req.From ||
+		req.To-req.From > maxCcuSampleRange {
+		return nil, newInvalidArgumentError("invalid time range")
+	}
+	samples, err := db.ListCcuSamples(
+		ctx, appId, time.Unix(req.From, 0), time.Unix(req.To, 0))
+	if err != nil {
+		return
+	}
+	resp := &xListCcuSamplesResponse{}
+	for _, x := range samples {
+		resp.Samples = append(resp.Samples, fromDbCcuSample(x))
+	}
+	return resp, nil
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 发行商关联，玩家查看关联的应用，以及撤回或恢复本应用的关联授权
+
+func init() {
+	registerExtMethods(
+		newExtMethod("ListPublisherLinkedApps", listPublisherLinkedApps),
+		newExtMethod("SetPublisherLinkConsent", setPublisherLinkConsent),
+	)
+}
+
+type xPublisherAppLinkData struct {
+	AppId  string `json:"app_id"`
+	LinkAt int64  `json:"link_at"`
+}
+
+type xListPublisherLinkedAppsRequest struct {
+	UserId string `json:"user_id,omitempty"`
+}
+
+type xListPublisherLinkedAppsResponse struct {
+	Apps []*xPublisherAppLinkData `json:"apps"`
+}
+
+func listPublisherLinkedApps(
+	ctx context.Context, req *xListPublisherLinkedAppsRequest) (
+	_ *xListPublisherLinkedAppsResponse, err error) {
+	appId, userId, err := requireExtUser(ctx, req.UserId)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	links, err := db.ListPublisherLinkedApps(ctx, app, userId)
+	if err != nil {
+		return
+	}
+	resp := &xListPublisherLinkedAppsResponse{}
+	for _, x := range links {
+		resp.Apps = append(resp.Apps, &xPublisherAppLinkData{
+			AppId:  x.AppId,
+			LinkAt: x.LinkAt.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+type xSetPublisherLinkConsentRequest struct {
+	UserId  string `json:"user_id,omitempty"`
+	Consent bool   `json:"consent"`
+}
+
+func setPublisherLinkConsent(
+	ctx context.Context, req *xSetPublisherLinkConsentRequest) (
+	_ *xEmpty, err error) {
+	appId, userId, err := requireExtUser(ctx, req.UserId)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	if err = db.SetPublisherLinkConsent(
+		ctx, app, userId, req.Consent); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
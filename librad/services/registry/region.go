@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 地区限制由应用后台设置，按国家统计用户数
+
+func init() {
+	registerExtMethods(
+		newExtMethod("GetRegionPolicy", getRegionPolicy),
+		newExtMethod("SetRegionPolicy", setRegionPolicy),
+		newExtMethod("CountUsersByCountry", countUsersByCountry),
+	)
+}
+
+type xRegionPolicyData struct {
+	Allow       []string `json:"allow,omitempty"`
+	Deny        []string `json:"deny,omitempty"`
+	DenyUnknown bool     `json:"deny_unknown,omitempty"`
+	Message     string   `json:"message,omitempty"`
+}
+
+type xRegionPolicyResponse struct {
+	// 没有限制时为空
+	Policy *xRegionPolicyData `json:"policy,omitempty"`
+}
+
+func getRegionPolicy(
+	ctx context.Context, req *xEmpty) (_ *xRegionPolicyResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	resp := &xRegionPolicyResponse{}
+	if p := app.RegionPolicy; p != nil {
+		resp.Policy = &xRegionPolicyData{
+			Allow:       p.Allow,
+			Deny:        p.Deny,
+			DenyUnknown: p.DenyUnknown,
+			Message:     p.Message,
+		}
+	}
+	return resp, nil
+}
+
+type xSetRegionPolicyRequest struct {
+	// 为空时清除
+	Policy *xRegionPolicyData `json:"policy,omitempty"`
+}
+
+func setRegionPolicy(
+	ctx context.Context, req *xSetRegionPolicyRequest) (_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	var p *db.RegionPolicy
+	if x := req.Policy; x != nil {
+		p = &db.RegionPolicy{
+			Allow:       x.Allow,
+			Deny:        x.Deny,
+			DenyUnknown: x.DenyUnknown,
+			Message:     x.Message,
+		}
+	}
+	if err = db.SetAppRegionPolicy(ctx, appId, p); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xCountryUsersData struct {
+	// 无法解析的国家为空
+	Country string `json:"country"`
+	Users   int64  `json:"users"`
+}
+
+type xCountUsersByCountryResponse struct {
+	Countries []*xCountryUsersData `json:"countries"`
+}
+
+func countUsersByCountry(
+	ctx context.Context, req *xEmpty) (
+	_ *xCountUsersByCountryResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	r, err := db.CountUsersByCountry(ctx, appId)
+	if err != nil {
+		return
+	}
+	resp := &xCountUsersByCountryResponse{}
+	for _, x := range r {
+		resp.Countries = append(resp.Countries, &xCountryUsersData{
+			Country: x.Country,
+			Users:   x.Users,
+		})
+	}
+	return resp, nil
+}
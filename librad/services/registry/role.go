@@ -110,6 +110,7 @@ func (srv *roleServer) SignIn(
 	return &v1pb.RoleSignInResponse{}, nil
 }
 
+// 直接覆盖，条件更新和增量见扩展接口UpdateRoleMetadata
 func (srv *roleServer) SetMetadata(
 	ctx context.Context, req *v1pb.RoleSetMetadataRequest) (
 	resp *v1pb.RoleSetMetadataResponse, err error) {
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 角色删除和恢复
+
+func init() {
+	registerExtMethods(
+		newExtMethod("DeleteRole", deleteRole),
+		newExtMethod("RestoreRole", restoreRole),
+	)
+}
+
+type xRoleData struct {
+	Id       string            `json:"id"`
+	Index    uint32            `json:"index"`
+	UserId   string            `json:"user_id"`
+	Name     string            `json:"name,omitempty"`
+	CreateAt int64             `json:"create_at"`
+	SignInAt int64             `json:"sign_in_at,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	DeleteAt int64             `json:"delete_at,omitempty"`
+	PurgeAt  int64             `json:"purge_at,omitempty"`
+}
+
+func fromDbRoleData(x *db.Role) *xRoleData {
+	r := &xRoleData{
+		Id:       x.Id,
+		Index:    x.Index,
+		UserId:   x.UserId,
+		Name:     x.Name,
+		CreateAt: x.CreateAt.Unix(),
+		Metadata: x.Metadata,
+	}
+	if !x.SignInAt.IsZero() {
+		r.SignInAt = x.SignInAt.Unix()
+	}
+	if !x.DeleteAt.IsZero() {
+		r.DeleteAt = x.DeleteAt.Unix()
+	}
+	if !x.PurgeAt.IsZero() {
+		r.PurgeAt = x.PurgeAt.Unix()
+	}
+	return r
+}
+
+type xRoleRequest struct {
+	RoleId string `json:"role_id"`
+}
+
+type xRoleResponse struct {
+	Role *xRoleData `json:"role"`
+}
+
+// 删除角色，保留期内可以恢复
+func deleteRole(
+	ctx context.Context, req *xRoleRequest) (_ *xRoleResponse, err error) {
+	appId, err := requireExtRole(ctx, req.RoleId)
+	if err != nil {
+		return
+	}
+	role, err := db.DeleteRole(ctx, appId, req.RoleId)
+	if err != nil {
+		return
+	}
+	return &xRoleResponse{Role: fromDbRoleData(role)}, nil
+}
+
+func restoreRole(
+	ctx context.Context, req *xRoleRequest) (_ *xRoleResponse, err error) {
+	appId, err := requireExtRole(ctx, req.RoleId)
+	if err != nil {
+		return
+	}
+	role, err := db.RestoreRole(ctx, appId, req.RoleId)
+	if err != nil {
+		return
+	}
+	return &xRoleResponse{Role: fromDbRoleData(role)}, nil
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"context"
+
+	log "github.com/ntons/log-go"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 角色转移，只能由应用后台发起
+
+func init() {
+	registerExtMethods(
+		newExtMethod("TransferRole", transferRole),
+		newExtMethod("ListRoleTransfers", listRoleTransfers),
+	)
+}
+
+type xRoleTransferData struct {
+	Id         string `json:"id"`
+	RoleId     string `json:"role_id"`
+	FromUserId string `json:"from_user_id"`
+	ToUserId   string `json:"to_user_id"`
+	Index      uint32 `json:"index"`
+	Operator   string `json:"operator,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	CreateAt   int64  `json:"create_at"`
+}
+
+func fromDbRoleTransfer(x *db.RoleTransfer) *xRoleTransferData {
+	return &xRoleTransferData{
+		Id:         x.Id.Hex(),
+		RoleId:     x.RoleId,
+		FromUserId: x.FromUserId,
+		ToUserId:   x.ToUserId,
+		Index:      x.Index,
+		Operator:   x.Operator,
+		Reason:     x.Reason,
+		CreateAt:   x.CreateAt.Unix(),
+	}
+}
+
+type xTransferRoleRequest struct {
+	RoleId   string `json:"role_id"`
+	ToUserId string `json:"to_user_id"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func transferRole(
+	ctx context.Context, req *xTransferRoleRequest) (
+	_ *xRoleResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if !db.IdBelongToAppId(appId, req.ToUserId) {
+		return nil, errUnauthenticated
+	}
+	role, err := db.TransferRole(
+		ctx, appId, getTrustedAdminId(ctx), req.RoleId, req.ToUserId,
+		req.Reason)
+	if err != nil {
+		log.Warnf("failed to transfer role: %v", err)
+		return
+	}
+	return &xRoleResponse{Role: fromDbRoleData(role)}, nil
+}
+
+type xListRoleTransfersResponse struct {
+	Transfers []*xRoleTransferData `json:"transfers"`
+}
+
+// 角色的转移记录，按转移时间倒序
+func listRoleTransfers(
+	ctx context.Context, req *xRoleRequest) (
+	_ *xListRoleTransfersResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	transfers, err := db.ListRoleTransfers(ctx, appId, req.RoleId)
+	if err != nil {
+		return
+	}
+	resp := &xListRoleTransfersResponse{}
+	for _, x := range transfers {
+		resp.Transfers = append(resp.Transfers, fromDbRoleTransfer(x))
+	}
+	return resp, nil
+}
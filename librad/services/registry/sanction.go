@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"context"
+
+	log "github.com/ntons/log-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 处罚历史和范围处罚
+
+// libra-go的Ban和Block响应中没有处罚记录，新记录的ID通过trailer返回，
+// 详情可以通过ListSanctions查询
+const xLibraSanctionIds = "x-libra-sanction-ids"
+
+func init() {
+	registerExtMethods(
+		newExtMethod("ListSanctions", listSanctions),
+		newExtMethod("SanctionUsers", sanctionUsers),
+		newExtMethod("UnsanctionUsers", unsanctionUsers),
+	)
+}
+
+func setSanctionIdsTrailer(ctx context.Context, sanctions []*db.Sanction) {
+	if len(sanctions) == 0 {
+		return
+	}
+	md := metadata.MD{}
+	for _, x := range sanctions {
+		md.Append(xLibraSanctionIds, x.Id.Hex())
+	}
+	grpc.SetTrailer(ctx, md)
+}
+
+type xSanctionData struct {
+	Id       string `json:"id"`
+	Kind     string `json:"kind"`
+	Target   string `json:"target"`
+	Scope    string `json:"scope,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Seconds  int64  `json:"seconds,omitempty"`
+	CreateAt int64  `json:"create_at"`
+	ExpireAt int64  `json:"expire_at"`
+	LiftAt   int64  `json:"lift_at,omitempty"`
+	LiftBy   string `json:"lift_by,omitempty"`
+	LiftFor  string `json:"lift_for,omitempty"`
+}
+
+func fromDbSanction(x *db.Sanction) *xSanctionData {
+	r := &xSanctionData{
+		Id:       x.Id.Hex(),
+		Kind:     x.Kind,
+		Target:   x.Target,
+		Scope:    x.Scope,
+		Operator: x.Operator,
+		Reason:   x.Reason,
+		Seconds:  x.Seconds,
+		CreateAt: x.CreateAt.Unix(),
+		ExpireAt: x.ExpireAt.Unix(),
+		LiftBy:   x.LiftBy,
+		LiftFor:  x.LiftFor,
+	}
+	if !x.LiftAt.IsZero() {
+		r.LiftAt = x.LiftAt.Unix()
+	}
+	return r
+}
+
+type xListSanctionsRequest struct {
+	// 处罚类型，ban或block
+	Kind string `json:"kind"`
+	// 用户ID或封禁键
+	Targets []string `json:"targets"`
+}
+
+type xListSanctionsResponse struct {
+	Sanctions []*xSanctionData `json:"sanctions"`
+}
+
+// 处罚历史，按处罚时间倒序
+func listSanctions(
+	ctx context.Context, req *xListSanctionsRequest) (
+	_ *xListSanctionsResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	switch req.Kind {
+	case db.SanctionKindBan:
+		if !db.IdBelongToAppId(appId, req.Targets...) {
+			return nil, errUnauthenticated
+		}
+	case db.SanctionKindBlock:
+	default:
+		return nil, newInvalidArgumentError("invalid sanction kind")
+	}
+	sanctions, err := db.ListSanctions(ctx, appId, req.Kind, req.Targets)
+	if err != nil {
+		return
+	}
+	resp := &xListSanctionsResponse{}
+	for _, x := range sanctions {
+		resp.Sanctions = append(resp.Sanctions, fromDbSanction(x))
+	}
+	return resp, nil
+}
+
+type xSanctionUsersRequest struct {
+	UserIds []string `json:"user_ids"`
+	// 处罚范围，需要在应用或全局配置中定义
+	Scope string `json:"scope"`
+	// 处罚时长(秒)
+	Seconds int64  `json:"seconds"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func checkSanctionUsersRequest(
+	appId string, userIds []string, scope string) error {
+	if !db.IdBelongToAppId(appId, userIds...) {
+		return errUnauthenticated
+	}
+	if app := db.FindAppById(appId); app == nil ||
+		!app.HasSanctionScope(scope) {
+		return newInvalidArgumentError("invalid sanction scope")
+	}
+	return nil
+}
+
+// 范围处罚，被处罚的用户依然可以登录，但不能访问该范围对应的接口
+func sanctionUsers(
+	ctx context.Context, req *xSanctionUsersRequest) (
+	_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if err = checkSanctionUsersRequest(
+		appId, req.UserIds, req.Scope); err != nil {
+		return
+	}
+	if req.Seconds <= 0 {
+		return nil, newInvalidArgumentError("invalid seconds")
+	}
+	if err = db.SanctionUsers(
+		ctx, appId, getTrustedAdminId(ctx), req.Scope, req.UserIds,
+		req.Seconds, req.Reason); err != nil {
+		log.Warnf("failed to sanction users: %v", err)
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xUnsanctionUsersRequest struct {
+	UserIds []string `json:"user_ids"`
+	Scope   string   `json:"scope"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// 解除范围处罚
+func unsanctionUsers(
+	ctx context.Context, req *xUnsanctionUsersRequest) (
+	_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	// 范围已从配置中移除时依然可以解除
+	if !db.IdBelongToAppId(appId, req.UserIds...) {
+		return nil, errUnauthenticated
+	}
+	if err = db.UnsanctionUsers(
+		ctx, appId, getTrustedAdminId(ctx), req.Scope, req.UserIds,
+		req.Reason); err != nil {
+		log.Warnf("failed to unsanction users: %v", err)
+		return
+	}
+	return &xEmpty{}, nil
+}
@@ -0,0 +1,41 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 会话属性由应用后台设置，鉴权时作为可信头转发，客户端不能自己设置
+
+func init() {
+	registerExtMethods(
+		newExtMethod("SetSessionAttributes", setSessionAttributes),
+	)
+}
+
+type xSetSessionAttributesRequest struct {
+	UserId string `json:"user_id"`
+	// 值为空时删除该属性
+	Attrs map[string]string `json:"attrs"`
+}
+
+func setSessionAttributes(
+	ctx context.Context, req *xSetSessionAttributesRequest) (
+	_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if !db.IdBelongToAppId(appId, req.UserId) {
+		return nil, errUnauthenticated
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	if err = db.SetSessAttrs(ctx, app, req.UserId, req.Attrs); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	"github.com/ntons/tongo/sign"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 登录态签名
+// 签名以"算法:"为前缀，没有前缀的是旧版本的HMAC-SHA1签名。
+// HMAC签名使用应用密钥，Ed25519签名使用应用登录服务器的私钥，
+// 服务端只保存公钥，持有应用密钥也无法伪造登录态。
+
+// 签名算法
+const (
+	SignAlgHMACWithSHA1   = "hmac-sha1"
+	SignAlgHMACWithSHA256 = "hmac-sha256"
+	SignAlgEd25519        = "ed25519"
+)
+
+// 拆分签名中的算法
+func splitSignature(signature string) (alg, sig string) {
+	if i := strings.IndexByte(signature, ':'); i >= 0 {
+		return strings.ToLower(signature[:i]), signature[i+1:]
+	}
+	return SignAlgHMACWithSHA1, signature
+}
+
+// 与HMAC签名相同的待签名内容，按键排序的 k=v&k=v
+func getLoginStateSignBytes(state *v1pb.UniformLoginState) []byte {
+	vals := sign.ProtoToValues(state)
+	sort.SliceStable(vals, func(i, j int) bool { return vals[i].K < vals[j].K })
+	buf := bytes.NewBuffer(nil)
+	for i, kv := range vals {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(kv.K)
+		buf.WriteByte('=')
+		buf.WriteString(kv.V)
+	}
+	return buf.Bytes()
+}
+
+// 验证登录态签名，state中的签名字段必须已经清空
+func verifyLoginStateSignature(
+	app *db.App, state *v1pb.UniformLoginState, signature string) (
+	alg string, err error) {
+	alg, sig := splitSignature(signature)
+	if !app.IsSignatureAlgorithmAllowed(alg) {
+		return alg, fmt.Errorf("algorithm not allowed")
+	}
+	switch alg {
+	case SignAlgHMACWithSHA1, SignAlgHMACWithSHA256:
+		// 空密钥的HMAC可以被任何人计算
+		if app.Secret == "" {
+			return alg, fmt.Errorf("no app secret")
+		}
+		expected := sign.ProtoHMACWithSHA1(state, app.Secret)
+		if alg == SignAlgHMACWithSHA256 {
+			// sign.ProtoHMACWithSHA256实际算的是SHA1，不能使用
+			expected = sign.HMACWithSHA256(
+				sign.ProtoToValues(state), app.Secret)
+		}
+		return alg, verifyHMAC(sig, expected)
+	case SignAlgEd25519:
+		pub, err := base64.StdEncoding.DecodeString(app.SignPublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return alg, fmt.Errorf("no valid public key")
+		}
+		b, err := hex.DecodeString(sig)
+		if err != nil {
+			return alg, fmt.Errorf("malformed signature")
+		}
+		if !ed25519.Verify(pub, getLoginStateSignBytes(state), b) {
+			return alg, fmt.Errorf("signature mismatch")
+		}
+		return alg, nil
+	default:
+		return alg, fmt.Errorf("unknown algorithm")
+	}
+}
+
+func verifyHMAC(sig, expected string) error {
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(expected)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
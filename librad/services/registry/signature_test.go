@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	"github.com/ntons/tongo/sign"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+func TestVerifyLoginStateSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &v1pb.UniformLoginState{
+		AcctIds:     []string{"guest:1", "wx:2"},
+		AcctDetails: map[string]string{"wx:2": "nick=foo"},
+		Timestamp:   1700000000,
+		Nonce:       "n1",
+	}
+	const secret = "s3cret"
+	var (
+		sha1Sig    = sign.ProtoHMACWithSHA1(state, secret)
+		sha256Sig  = "hmac-sha256:" + sign.HMACWithSHA256(sign.ProtoToValues(state), secret)
+		ed25519Sig = "ed25519:" + hex.EncodeToString(
+			ed25519.Sign(priv, getLoginStateSignBytes(state)))
+	)
+	// 签名内容必须与HMAC签名的内容一致
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(getLoginStateSignBytes(state))
+	if hex.EncodeToString(h.Sum(nil)) != sign.HMACWithSHA256(sign.ProtoToValues(state), secret) {
+		t.Fatal("sign bytes mismatch")
+	}
+	legacy := &db.App{
+		Secret:        secret,
+		SignPublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+	strict := &db.App{
+		Secret:              secret,
+		SignPublicKey:       base64.StdEncoding.EncodeToString(pub),
+		SignatureAlgorithms: []string{SignAlgEd25519},
+	}
+	noKey := &db.App{Secret: secret}
+	noSecret := &db.App{}
+
+	for _, c := range []struct {
+		name string
+		app  *db.App
+		sig  string
+		ok   bool
+	}{
+		{"legacy sha1", legacy, sha1Sig, true},
+		{"legacy sha1 upper case", legacy, "HMAC-SHA1:" + sha1Sig, true},
+		{"sha256", legacy, sha256Sig, true},
+		{"ed25519", legacy, ed25519Sig, true},
+		{"sha1 phased out", strict, sha1Sig, false},
+		{"sha256 phased out", strict, sha256Sig, false},
+		{"ed25519 only", strict, ed25519Sig, true},
+		{"ed25519 without key", noKey, ed25519Sig, false},
+		{"hmac without secret", noSecret, sign.ProtoHMACWithSHA1(state, ""), false},
+		{"tampered", legacy, "hmac-sha256:" + sign.HMACWithSHA256(sign.ProtoToValues(state), "x"), false},
+		{"unknown alg", legacy, "md5:abc", false},
+	} {
+		if _, err := verifyLoginStateSignature(c.app, state, c.sig); (err == nil) != c.ok {
+			t.Errorf("%s: unexpected result: %v", c.name, err)
+		}
+	}
+
+	// 签名内容与HMAC相同，改动任意字段都会导致验证失败
+	state.Nonce = "n2"
+	if _, err := verifyLoginStateSignature(legacy, state, ed25519Sig); err == nil {
+		t.Error("expect ed25519 mismatch after state changed")
+	}
+}
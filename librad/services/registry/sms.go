@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	v1pb "github.com/ntons/libra-go/api/libra/v1"
+	log "github.com/ntons/log-go"
+	"github.com/ntons/tongo/httputil"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 手机验证码登录
+// 验证码通过接入方设置的SMSSender发送，没有设置时无法发送，
+// 验证通过的号码以"phone:<E.164号码>"作为账号ID。
+//
+// 登录态消息定义如下，libra-go中尚未生成，这里直接按线格式解码：
+//
+//	message PhoneOtpLoginState {
+//	  string phone = 1;
+//	  string code = 2;
+//	}
+const phoneOtpLoginStateName = "libra.v1.PhoneOtpLoginState"
+
+const phoneAcctIdPrefix = "phone:"
+
+// 验证码用途
+const phoneOtpKind = "sms"
+
+// 验证码位数
+const phoneOtpLen = 6
+
+type SMSMessage struct {
+	AppId string `json:"app_id"`
+	// E.164格式的号码
+	To string `json:"to"`
+	// 验证码
+	Code string `json:"code"`
+	// 验证码过期时间
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+type SMSSender interface {
+	Send(ctx context.Context, msg *SMSMessage) error
+}
+
+var (
+	xSMSSenderMu sync.RWMutex
+	xSMSSender   SMSSender
+)
+
+// 设置短信发送器
+func SetSMSSender(sender SMSSender) {
+	xSMSSenderMu.Lock()
+	defer xSMSSenderMu.Unlock()
+	xSMSSender = sender
+}
+
+func sendSMS(ctx context.Context, msg *SMSMessage) error {
+	xSMSSenderMu.RLock()
+	sender := xSMSSender
+	xSMSSenderMu.RUnlock()
+	if sender == nil {
+		return errors.New("sms sender not set")
+	}
+	return sender.Send(ctx, msg)
+}
+
+// 号码归一化为E.164格式，去掉空格和分隔符
+func normalizePhone(s string) (_ string, err error) {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(s))
+	if len(s) < 9 || len(s) > 16 || s[0] != '+' || s[1] == '0' {
+		return "", errInvalidPhone
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return "", errInvalidPhone
+		}
+	}
+	return s, nil
+}
+
+func getPhoneAcctId(phone string) string {
+	return phoneAcctIdPrefix + phone
+}
+
+func newPhoneOtp() (_ string, err error) {
+	max := big.NewInt(1)
+	for i := 0; i < phoneOtpLen; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return
+	}
+	return fmt.Sprintf("%0*d", phoneOtpLen, n), nil
+}
+
+// 向号码发送验证码
+func RequestPhoneOtp(
+	ctx context.Context, app *db.App, phone, clientIp string) (err error) {
+	if phone, err = normalizePhone(phone); err != nil {
+		return
+	}
+	code, err := newPhoneOtp()
+	if err != nil {
+		log.Warnf("failed to generate otp: %v", err)
+		return errInternal
+	}
+	p := &cfg.Sms.policy
+	if err = db.IssueOtp(
+		ctx, app.Id, phoneOtpKind, phone, clientIp, code, p); err != nil {
+		return
+	}
+	if err = sendSMS(ctx, &SMSMessage{
+		AppId:    app.Id,
+		To:       phone,
+		Code:     code,
+		ExpireAt: time.Now().Add(p.Timeout),
+	}); err != nil {
+		log.Warnf("failed to send sms: %v, %v", app.Id, err)
+		return errSMSUnavailable
+	}
+	return
+}
+
+// 验证并消耗验证码，返回账号ID
+func VerifyPhoneOtp(
+	ctx context.Context, app *db.App, phone, code string) (_ string, err error) {
+	if phone, err = normalizePhone(phone); err != nil {
+		return
+	}
+	if err = db.CheckOtp(
+		ctx, app.Id, phoneOtpKind, phone, code, &cfg.Sms.policy); err != nil {
+		return
+	}
+	return getPhoneAcctId(phone), nil
+}
+
+// 验证号码后绑定到已有用户，号码已被其他用户绑定时失败
+func BindPhoneToUser(
+	ctx context.Context, app *db.App, userId, phone, code string) (
+	_ []string, err error) {
+	acctId, err := VerifyPhoneOtp(ctx, app, phone, code)
+	if err != nil {
+		return
+	}
+	return db.BindAcctIdToUser(ctx, app.Id, userId, []string{acctId}, false)
+}
+
+type phoneOtpLoginState struct {
+	Phone string
+	Code  string
+}
+
+func (x *phoneOtpLoginState) unmarshal(b []byte) error {
+	return unmarshalStringFields(b, map[protowire.Number]*string{
+		1: &x.Phone,
+		2: &x.Code,
+	})
+}
+
+func verifyPhoneOtpLoginState(
+	ctx context.Context, app *db.App, anyState *anypb.Any) (
+	_ *v1pb.UniformLoginState, err error) {
+	state := &phoneOtpLoginState{}
+	if err = state.unmarshal(anyState.GetValue()); err != nil {
+		return nil, errInvalidState
+	}
+	acctId, err := VerifyPhoneOtp(ctx, app, state.Phone, state.Code)
+	if err != nil {
+		return
+	}
+	return &v1pb.UniformLoginState{AcctIds: []string{acctId}}, nil
+}
+
+func init() {
+	RegisterLoginStateVerifier(phoneOtpLoginStateName, verifyPhoneOtpLoginState)
+	registerExtMethods(
+		newExtMethod("RequestPhoneOtp", requestPhoneOtp),
+		newExtMethod("BindPhoneToUser", bindPhoneToUser),
+	)
+}
+
+type xRequestPhoneOtpRequest struct {
+	AppId string `json:"app_id"`
+	Phone string `json:"phone"`
+}
+
+// 登录或绑定之前请求验证码
+func requestPhoneOtp(
+	ctx context.Context, req *xRequestPhoneOtpRequest) (_ *xEmpty, err error) {
+	app, err := requireExtLoginApp(ctx, req.AppId)
+	if err != nil {
+		return
+	}
+	if err = RequestPhoneOtp(ctx, app, req.Phone,
+		httputil.GetRemoteIpFromContext(ctx)); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xBindPhoneToUserRequest struct {
+	UserId string `json:"user_id,omitempty"`
+	Phone  string `json:"phone"`
+	Code   string `json:"code"`
+}
+
+type xBindPhoneToUserResponse struct {
+	AcctIds []string `json:"acct_ids"`
+}
+
+func bindPhoneToUser(
+	ctx context.Context, req *xBindPhoneToUserRequest) (
+	_ *xBindPhoneToUserResponse, err error) {
+	appId, userId, err := requireExtUser(ctx, req.UserId)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	acctIds, err := BindPhoneToUser(ctx, app, userId, req.Phone, req.Code)
+	if err != nil {
+		return
+	}
+	return &xBindPhoneToUserResponse{AcctIds: acctIds}, nil
+}
@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+		ok      bool
+	}{
+		{"+86 138-0013-8000", "+8613800138000", true},
+		{"+1 (415) 555-2671", "+14155552671", true},
+		{"13800138000", "", false},
+		{"+0123456789", "", false},
+		{"+86abc0138000", "", false},
+		{"+1234", "", false},
+	} {
+		out, err := normalizePhone(c.in)
+		if (err == nil) != c.ok || out != c.out {
+			t.Errorf("%q: unexpected result: %q, %v", c.in, out, err)
+		}
+	}
+}
+
+func TestNewPhoneOtp(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := newPhoneOtp()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != phoneOtpLen {
+			t.Fatalf("unexpected code: %q", code)
+		}
+	}
+}
+
+// 测试用的短信发送器，记录最后发送给号码的验证码
+type xFakeSMSSender struct {
+	mu   sync.Mutex
+	sent map[string]*SMSMessage
+}
+
+func newFakeSMSSender() *xFakeSMSSender {
+	return &xFakeSMSSender{sent: make(map[string]*SMSMessage)}
+}
+
+func (s *xFakeSMSSender) Send(ctx context.Context, msg *SMSMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[msg.AppId+"$"+msg.To] = msg
+	return nil
+}
+
+func (s *xFakeSMSSender) lastCode(appId, phone string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg, ok := s.sent[appId+"$"+phone]; ok {
+		return msg.Code
+	}
+	return ""
+}
+
+func TestSendSMS(t *testing.T) {
+	defer SetSMSSender(nil)
+	ctx := context.Background()
+	newMsg := func(code string) *SMSMessage {
+		return &SMSMessage{
+			AppId:    "app",
+			To:       "+8613800138000",
+			Code:     code,
+			ExpireAt: time.Now().Add(time.Minute),
+		}
+	}
+	// 没有设置发送器时不能发送，验证码不会输出到任何地方
+	SetSMSSender(nil)
+	if err := sendSMS(ctx, newMsg("000000")); err == nil {
+		t.Fatal("expect error without sender")
+	}
+	s := newFakeSMSSender()
+	SetSMSSender(s)
+	for _, code := range []string{"111111", "222222"} {
+		if err := sendSMS(ctx, newMsg(code)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code := s.lastCode("app", "+8613800138000"); code != "222222" {
+		t.Fatalf("unexpected code: %q", code)
+	}
+	if code := s.lastCode("app2", "+8613800138000"); code != "" {
+		t.Fatalf("unexpected code: %q", code)
+	}
+}
+
+func TestExtPhoneAuth(t *testing.T) {
+	ctx := context.Background()
+	if _, err := findExtMethod(t, "RequestPhoneOtp")(
+		ctx, map[string]interface{}{
+			"app_id": "unknown",
+			"phone":  "+8613800138000",
+		}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect invalid argument, but got: %v", err)
+	}
+	if _, err := findExtMethod(t, "BindPhoneToUser")(
+		ctx, map[string]interface{}{
+			"phone": "+8613800138000",
+			"code":  "000000",
+		}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expect unauthenticated, but got: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"context"
+
+	L "github.com/ntons/libra-go"
+	log "github.com/ntons/log-go"
+	"github.com/ntons/tongo/httputil"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 账号迁移
+// 只有设备ID作为账号的游客更换设备后无法登录原来的用户，
+// 在旧设备上签发迁移码，新设备使用迁移码后把新的账号ID绑定到原用户，
+// 账号ID已被其他用户(通常是新设备上的游客)绑定时直接接管。
+
+func init() {
+	registerExtMethods(
+		newExtMethod("IssueTransferCode", issueTransferCode),
+		newExtMethod("RedeemTransferCode", redeemTransferCode),
+	)
+}
+
+// 为用户签发迁移码，acctId为旧设备的账号ID，不需要解绑时可以为空
+func IssueTransferCode(
+	ctx context.Context, app *db.App, userId, acctId string) (
+	_ *db.TransferCode, err error) {
+	user, err := db.GetUser(ctx, app.Id, userId)
+	if err != nil {
+		return
+	}
+	if acctId != "" && !containsAny(user.AcctIds, []string{acctId}) {
+		return nil, db.ErrInvalidAcctId
+	}
+	return db.IssueTransferCode(
+		ctx, app.Id, userId, acctId, &cfg.Transfer.policy)
+}
+
+// 使用迁移码把新设备的账号ID绑定到原用户，返回原用户ID和绑定后的账号列表。
+// unbindOld为真时解绑旧设备的账号ID，旧设备上的会话同时失效。
+func RedeemTransferCode(
+	ctx context.Context, app *db.App, code, acctId, clientIp string,
+	unbindOld bool) (_ string, acctIds []string, err error) {
+	if acctId == "" {
+		return "", nil, db.ErrInvalidAcctId
+	}
+	x, err := db.RedeemTransferCode(
+		ctx, app.Id, code, clientIp, &cfg.Transfer.policy)
+	if err != nil {
+		return
+	}
+	if acctIds, err = db.BindAcctIdToUser(
+		ctx, app.Id, x.UserId, []string{acctId}, true); err != nil {
+		return
+	}
+	log.Infow("user transferred",
+		"app_id", app.Id,
+		"user_id", x.UserId,
+		"from", x.AcctId,
+		"to", acctId,
+	)
+	if unbindOld && x.AcctId != "" && x.AcctId != acctId {
+		if acctIds, err = db.UnbindAcctIdFromUser(
+			ctx, app.Id, x.UserId, []string{x.AcctId}); err != nil {
+			return
+		}
+		if err = db.LogoutUser(ctx, x.UserId); err != nil {
+			return
+		}
+	}
+	return x.UserId, acctIds, nil
+}
+
+type xIssueTransferCodeRequest struct {
+	UserId string `json:"user_id,omitempty"`
+	AcctId string `json:"acct_id,omitempty"`
+}
+
+type xIssueTransferCodeResponse struct {
+	Code     string `json:"code"`
+	ExpireAt int64  `json:"expire_at"`
+}
+
+// 旧设备上的用户为自己签发迁移码
+func issueTransferCode(
+	ctx context.Context, req *xIssueTransferCodeRequest) (
+	_ *xIssueTransferCodeResponse, err error) {
+	appId, userId, err := requireExtUser(ctx, req.UserId)
+	if err != nil {
+		return
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	x, err := IssueTransferCode(ctx, app, userId, req.AcctId)
+	if err != nil {
+		return
+	}
+	return &xIssueTransferCodeResponse{
+		Code:     x.Code,
+		ExpireAt: x.ExpireAt.Unix(),
+	}, nil
+}
+
+type xRedeemTransferCodeRequest struct {
+	Code      string `json:"code"`
+	AcctId    string `json:"acct_id"`
+	UnbindOld bool   `json:"unbind_old,omitempty"`
+}
+
+type xRedeemTransferCodeResponse struct {
+	UserId  string   `json:"user_id"`
+	AcctIds []string `json:"acct_ids"`
+}
+
+// 新设备使用迁移码，用户只能迁移自己绑定的账号ID，应用后台可以指定任意账号ID。
+// 迁移后账号ID属于原用户，新设备需要重新登录。
+func redeemTransferCode(
+	ctx context.Context, req *xRedeemTransferCodeRequest) (
+	_ *xRedeemTransferCodeResponse, err error) {
+	var appId string
+	if trusted := L.RequireAuthByToken(ctx); trusted != nil {
+		user, err := db.GetUser(ctx, trusted.AppId, trusted.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if !containsAny(user.AcctIds, []string{req.AcctId}) {
+			return nil, db.ErrInvalidAcctId
+		}
+		appId = trusted.AppId
+	} else if trusted := L.RequireAuthBySecret(ctx); trusted != nil {
+		appId = trusted.AppId
+	} else {
+		return nil, errLoginRequired
+	}
+	app := db.FindAppById(appId)
+	if app == nil {
+		return nil, db.ErrInvalidAppId
+	}
+	userId, acctIds, err := RedeemTransferCode(ctx, app, req.Code, req.AcctId,
+		httputil.GetRemoteIpFromContext(ctx), req.UnbindOld)
+	if err != nil {
+		return
+	}
+	return &xRedeemTransferCodeResponse{UserId: userId, AcctIds: acctIds}, nil
+}
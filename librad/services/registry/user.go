@@ -2,17 +2,14 @@ package registry
 
 import (
 	"context"
-	"strings"
 	"time"
 
 	L "github.com/ntons/libra-go"
 	v1pb "github.com/ntons/libra-go/api/libra/v1"
 	log "github.com/ntons/log-go"
 	"github.com/ntons/tongo/httputil"
-	"github.com/ntons/tongo/sign"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 
 	"github.com/ntons/libra/librad/db"
@@ -42,6 +39,18 @@ func fromDbUsers(x []*db.User) []*v1pb.UserData {
 	return r
 }
 
+// 可信的管理员ID，作为封禁等操作的操作者
+func getTrustedAdminId(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(L.XLibraTrustedAdminId); len(v) == 1 {
+		return v[0]
+	}
+	return ""
+}
+
 type userServer struct {
 	v1pb.UnimplementedUserServer
 }
@@ -103,6 +112,7 @@ func (srv *userServer) Get(
 	}, nil
 }
 
+// 按元数据查询见扩展接口QueryUsersByMetadata
 func (srv *userServer) Query(
 	ctx context.Context, req *v1pb.UserQueryRequest) (
 	_ *v1pb.UserQueryResponse, err error) {
@@ -170,26 +180,28 @@ func (srv *userServer) Ban(
 
 	if len(req.UserIds) > 0 {
 		var (
-			appId   = trusted.AppId
-			userIds = req.UserIds
-			now     = time.Now()
+			appId    = trusted.AppId
+			operator = getTrustedAdminId(ctx)
+			userIds  = req.UserIds
+			now      = time.Now()
 		)
 
 		if req.Seconds > 0 {
-			var (
-				banTo  = now.Add(time.Duration(req.Seconds) * time.Second)
-				banFor = req.Reason
-			)
-			if err = db.BanUsers(ctx, appId, userIds, banTo, banFor); err != nil {
+			var sanctions []*db.Sanction
+			if sanctions, err = db.BanUsers(
+				ctx, appId, operator, userIds,
+				req.Seconds, req.Reason); err != nil {
 				log.Warnf("failed to ban users: %v", err)
 				return nil, db.ErrDatabaseUnavailable
 			}
+			setSanctionIdsTrailer(ctx, sanctions)
 			if err = db.LogoutUser(ctx, userIds...); err != nil {
 				log.Warnf("failed to logout users: %v", err)
 				return nil, db.ErrDatabaseUnavailable
 			}
 		} else if req.Seconds < 0 {
-			if err = db.UnbanUsers(ctx, appId, userIds); err != nil {
+			if err = db.UnbanUsers(
+				ctx, appId, operator, userIds, req.Reason); err != nil {
 				log.Warnf("failed to unban users: %v", err)
 				return nil, db.ErrDatabaseUnavailable
 			}
@@ -231,20 +243,21 @@ func (srv *userServer) Block(
 
 	if len(keys) > 0 {
 		var (
-			appId = trusted.AppId
-			now   = time.Now()
+			appId    = trusted.AppId
+			operator = getTrustedAdminId(ctx)
 		)
 		if req.Seconds > 0 {
-			var (
-				banTo  = now.Add(time.Duration(req.Seconds) * time.Second)
-				banFor = req.Reason
-			)
-			if err = db.Block(ctx, appId, keys, banTo, banFor); err != nil {
+			var sanctions []*db.Sanction
+			if sanctions, err = db.Block(
+				ctx, appId, operator, keys,
+				req.Seconds, req.Reason); err != nil {
 				log.Warnf("failed to ban keys: %v", err)
 				return nil, db.ErrDatabaseUnavailable
 			}
+			setSanctionIdsTrailer(ctx, sanctions)
 		} else if req.Seconds < 0 {
-			if err = db.Allow(ctx, appId, keys); err != nil {
+			if err = db.Allow(
+				ctx, appId, operator, keys, req.Reason); err != nil {
 				log.Warnf("failed to unban keys: %v", err)
 				return nil, db.ErrDatabaseUnavailable
 			}
@@ -279,23 +292,23 @@ func (srv *userServer) CheckLoginState(
 		return nil, nil, db.ErrInvalidAppId
 	}
 
-	x, err := anypb.UnmarshalNew(anyState, proto.UnmarshalOptions{})
-	if err != nil {
+	verify := getLoginStateVerifier(anyState)
+	if verify == nil {
 		return nil, nil, errInvalidState
 	}
-
-	switch x := x.(type) {
-	case *v1pb.UniformLoginState:
-		if state, err = srv.CheckUniformLoginState(ctx, app, x); err != nil {
-			return
-		}
-	default:
-		return nil, nil, errInvalidState
+	if state, err = verify(ctx, app, anyState); err != nil {
+		return
 	}
 	return
 }
 
 func (srv *userServer) CheckUniformLoginState(
+	ctx context.Context, app *db.App, state *v1pb.UniformLoginState) (
+	_ *v1pb.UniformLoginState, err error) {
+	return checkUniformLoginState(ctx, app, state)
+}
+
+func checkUniformLoginState(
 	ctx context.Context, app *db.App, state *v1pb.UniformLoginState) (
 	_ *v1pb.UniformLoginState, err error) {
 	if state == nil {
@@ -312,10 +325,10 @@ func (srv *userServer) CheckUniformLoginState(
 	}
 	signature := state.Signature
 	state.Signature = ""
-	expected := sign.ProtoHMACWithSHA1(state, app.Secret)
-	if !strings.EqualFold(signature, expected) {
-		log.Warnf("signature mismatch: %s, %s, %s, %s",
-			signature, expected, app.Secret, state)
+	if alg, err := verifyLoginStateSignature(
+		app, state, signature); err != nil {
+		log.Warnf("invalid signature: %s, %s, %v, %s",
+			app.Id, alg, err, state)
 		return nil, errInvalidSignature
 	}
 	return state, nil
@@ -341,9 +354,22 @@ func (srv *userServer) Login(
 
 	deviceId := req.GetDevice().GetId()
 
+	if err = checkLoginClientVersion(
+		ctx, app, req.GetDevice().GetOs(),
+		req.GetClient().GetVersion()); err != nil {
+		return
+	}
+
+	// 登录请求中的客户端信息作为会话属性，只保留应用允许的键
+	attrs := map[string]string{
+		"client-version": req.GetClient().GetVersion(),
+		"device-os":      req.GetDevice().GetOs(),
+		"device-model":   req.GetDevice().GetModel(),
+	}
+
 	user, sess, err := db.LoginUser(
 		ctx, app, clientIp, deviceId, state.AcctIds,
-		req.CreateIfNotFound)
+		req.CreateIfNotFound, attrs)
 	if err != nil {
 		log.Warnf("failed to login user: %v", err)
 		return
@@ -445,6 +471,7 @@ func (srv *userServer) Unbind(
 	return resp, nil
 }
 
+// 直接覆盖，条件更新和增量见扩展接口UpdateUserMetadata
 func (srv *userServer) SetMetadata(
 	ctx context.Context, req *v1pb.UserSetMetadataRequest) (
 	_ *v1pb.UserSetMetadataResponse, err error) {
@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/ntons/libra/librad/db"
+)
+
+// 区服管理由应用后台调用，玩家的区服列表附带玩家在各区服的角色
+
+func init() {
+	registerExtMethods(
+		newExtMethod("SetZone", setZone),
+		newExtMethod("DeleteZone", deleteZone),
+		newExtMethod("ListZones", listZones),
+		newExtMethod("ListUserZones", listUserZones),
+	)
+}
+
+type xZoneData struct {
+	Id        uint32 `json:"id"`
+	Name      string `json:"name"`
+	OpenAt    int64  `json:"open_at,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Capacity  int64  `json:"capacity,omitempty"`
+	RoleCount int64  `json:"role_count,omitempty"`
+}
+
+func fromDbZone(x *db.Zone) *xZoneData {
+	r := &xZoneData{
+		Id:        x.Id,
+		Name:      x.Name,
+		Status:    x.Status,
+		Capacity:  x.Capacity,
+		RoleCount: x.RoleCount,
+	}
+	if !x.OpenAt.IsZero() {
+		r.OpenAt = x.OpenAt.Unix()
+	}
+	return r
+}
+
+func toDbZone(x *xZoneData) *db.Zone {
+	r := &db.Zone{
+		Id:       x.Id,
+		Name:     x.Name,
+		Status:   x.Status,
+		Capacity: x.Capacity,
+	}
+	if x.OpenAt > 0 {
+		r.OpenAt = time.Unix(x.OpenAt, 0)
+	}
+	return r
+}
+
+type xSetZoneRequest struct {
+	Zone *xZoneData `json:"zone"`
+}
+
+// 新建或修改区服，角色数不会被覆盖
+func setZone(
+	ctx context.Context, req *xSetZoneRequest) (_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if req.Zone == nil {
+		return nil, newInvalidArgumentError("zone required")
+	}
+	if err = db.SetZone(ctx, appId, toDbZone(req.Zone)); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xDeleteZoneRequest struct {
+	ZoneId uint32 `json:"zone_id"`
+}
+
+func deleteZone(
+	ctx context.Context, req *xDeleteZoneRequest) (_ *xEmpty, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	if err = db.DeleteZone(ctx, appId, req.ZoneId); err != nil {
+		return
+	}
+	return &xEmpty{}, nil
+}
+
+type xListZonesResponse struct {
+	Zones []*xZoneData `json:"zones"`
+}
+
+// 所有区服，包括未开服的
+func listZones(
+	ctx context.Context, req *xEmpty) (_ *xListZonesResponse, err error) {
+	appId, err := requireExtApp(ctx)
+	if err != nil {
+		return
+	}
+	zones, err := db.ListZones(ctx, appId)
+	if err != nil {
+		return
+	}
+	resp := &xListZonesResponse{}
+	for _, x := range zones {
+		resp.Zones = append(resp.Zones, fromDbZone(x))
+	}
+	return resp, nil
+}
+
+type xListUserZonesRequest struct {
+	// 使用应用密钥时指定
+	UserId string `json:"user_id,omitempty"`
+}
+
+type xUserZoneData struct {
+	*xZoneData
+	Roles []*xRoleData `json:"roles,omitempty"`
+}
+
+type xListUserZonesResponse struct {
+	Zones []*xUserZoneData `json:"zones"`
+}
+
+// 面向玩家的区服列表，推荐的区服排在前面
+func listUserZones(
+	ctx context.Context, req *xListUserZonesRequest) (
+	_ *xListUserZonesResponse, err error) {
+	appId, userId, err := requireExtUser(ctx, req.UserId)
+	if err != nil {
+		return
+	}
+	zones, err := db.ListZonesWithRoles(ctx, appId, userId)
+	if err != nil {
+		return
+	}
+	resp := &xListUserZonesResponse{}
+	for _, x := range zones {
+		z := &xUserZoneData{xZoneData: fromDbZone(x.Zone)}
+		for _, role := range x.Roles {
+			z.Roles = append(z.Roles, fromDbRoleData(role))
+		}
+		resp.Zones = append(resp.Zones, z)
+	}
+	return resp, nil
+}